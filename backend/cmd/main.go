@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
+	"time"
 
 	"videoDownload/internal/api"
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/store"
 
 	"github.com/gorilla/mux"
 )
@@ -47,6 +51,31 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	dataDir := flag.String("data-dir", "data", "任务记录和下载工作目录的存放目录")
+	maxActive := flag.Int("max-active", 3, "同时运行的最大任务数，超出的任务排队等待")
+	workTTL := flag.Duration("work-ttl", 72*time.Hour, "失败或中断的任务保留工作目录的时长，过期后删除已下载的分片，0 表示不清理")
+	proxy := flag.String("proxy", "", "默认代理，支持 http://、https://、socks5://，任务可单独指定；为空时使用环境变量")
+	flag.Parse()
+
+	api.SetMaxActiveTasks(*maxActive)
+
+	if err := httpclient.SetDefaultProxy(*proxy); err != nil {
+		log.Fatal("代理设置无效:", err)
+	}
+	if *proxy != "" {
+		fmt.Printf("默认代理: %s\n", httpclient.RedactProxy(*proxy))
+	}
+
+	taskStore, err := store.OpenFileStore(filepath.Join(*dataDir, "tasks.jsonl"))
+	if err != nil {
+		log.Fatal("打开任务存储失败:", err)
+	}
+	defer taskStore.Close()
+
+	if err := api.InitTasks(taskStore, filepath.Join(*dataDir, "work"), *workTTL); err != nil {
+		log.Fatal("恢复任务失败:", err)
+	}
+
 	router := mux.NewRouter()
 
 	// 应用CORS中间件到所有路由
@@ -56,9 +85,18 @@ func main() {
 	router.HandleFunc("/api/health", healthHandler).Methods("GET")
 	router.HandleFunc("/api/analyze", api.AnalyzeVideoResourcesHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/download", api.CreateDownloadHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/variants", api.ListVariantsHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/status", api.GetAllStatusHandler).Methods("GET")
 	router.HandleFunc("/api/status/{id}", api.GetTaskStatusHandler).Methods("GET")
 	router.HandleFunc("/api/progress/{id}", api.TaskProgressSSEHandler).Methods("GET")
+	router.HandleFunc("/api/tasks/{id}", api.CancelTaskHandler).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/tasks/{id}/cancel", api.CancelTaskHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/tasks/{id}/pause", api.PauseTaskHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/tasks/{id}/resume", api.ResumeTaskHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/tasks/{id}/retry", api.RetryTaskHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/tasks/{id}/priority", api.SetPriorityHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/queue", api.GetQueueHandler).Methods("GET")
+	router.HandleFunc("/api/queue/{id}/move", api.MoveQueuedTaskHandler).Methods("POST", "OPTIONS")
 
 	// 静态文件服务
 	frontendPath := filepath.Join("..", "frontend")
@@ -76,9 +114,17 @@ func main() {
 	fmt.Println("API端点:")
 	fmt.Println("  POST /api/analyze - 分析网页视频资源")
 	fmt.Println("  POST /api/download - 创建下载任务")
+	fmt.Println("  POST /api/variants - 列出 HLS 主播放列表的档位")
 	fmt.Println("  GET  /api/status - 获取所有任务状态")
 	fmt.Println("  GET  /api/status/{id} - 获取指定任务状态")
 	fmt.Println("  GET  /api/progress/{id} - SSE 实时进度推送")
+	fmt.Println("  DELETE /api/tasks/{id} - 取消任务 (也可 POST /api/tasks/{id}/cancel)")
+	fmt.Println("  POST /api/tasks/{id}/pause - 暂停任务")
+	fmt.Println("  POST /api/tasks/{id}/resume - 继续任务")
+	fmt.Println("  POST /api/tasks/{id}/retry - 重试失败的任务")
+	fmt.Println("  POST /api/tasks/{id}/priority - 修改任务优先级")
+	fmt.Println("  GET  /api/queue - 获取排队中的任务")
+	fmt.Println("  POST /api/queue/{id}/move - 调整排队任务的位置")
 	fmt.Println("CORS已启用，支持跨域请求")
 
 	if err := server.ListenAndServe(); err != nil {
@@ -1,6 +1,7 @@
 package analyzer
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -10,23 +11,32 @@ import (
 
 	"github.com/google/uuid"
 	"golang.org/x/net/html"
+	"videoDownload/internal/httpclient"
 	"videoDownload/internal/types"
 )
 
 type VideoAnalyzer struct {
-	client *http.Client
+	client *httpclient.Client
+	opts   types.HTTPOptions
 }
 
-func NewVideoAnalyzer() *VideoAnalyzer {
-	return &VideoAnalyzer{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// NewVideoAnalyzer 创建分析器，访问网页时附加 opts 中的请求头和 Cookie，发现的资源也会带上这些设置
+func NewVideoAnalyzer(opts types.HTTPOptions) (*VideoAnalyzer, error) {
+	client, err := httpclient.New(opts)
+	if err != nil {
+		return nil, err
 	}
+	return &VideoAnalyzer{client: client, opts: opts}, nil
+}
+
+// Close 释放分析器使用的 HTTP 客户端
+func (va *VideoAnalyzer) Close() {
+	va.client.Close()
 }
 
-func (va *VideoAnalyzer) AnalyzeURL(targetURL string) (*types.AnalyzeResponse, error) {
-	resp, err := va.client.Get(targetURL)
+// AnalyzeURL 获取并分析网页中的视频资源，ctx 取消（例如客户端断开）时停止请求
+func (va *VideoAnalyzer) AnalyzeURL(ctx context.Context, targetURL string) (*types.AnalyzeResponse, error) {
+	resp, err := va.client.Get(ctx, targetURL, 30*time.Second)
 	if err != nil {
 		return &types.AnalyzeResponse{
 			Success: false,
@@ -53,6 +63,15 @@ func (va *VideoAnalyzer) AnalyzeURL(targetURL string) (*types.AnalyzeResponse, e
 	pageTitle := va.extractPageTitle(doc)
 	videos := va.extractVideoResources(doc, targetURL)
 
+	// 下载这些资源时沿用分析网页的设置，CDN 通常要求 Referer 为所在网页
+	httpOpts := va.opts
+	if httpOpts.Referer == "" {
+		httpOpts.Referer = resp.Request.URL.String()
+	}
+	for i := range videos {
+		videos[i].HTTP = &httpOpts
+	}
+
 	return &types.AnalyzeResponse{
 		Success:   true,
 		PageTitle: pageTitle,
@@ -192,6 +211,7 @@ func (va *VideoAnalyzer) extractFromScriptContent(content string, baseURL *url.U
 	// 常见的视频URL模式
 	patterns := []string{
 		`["']([^"']*\.m3u8[^"']*)["']`,
+		`["']([^"']*\.mpd[^"']*)["']`,
 		`["']([^"']*\.mp4[^"']*)["']`,
 		`["']([^"']*\.webm[^"']*)["']`,
 		`["']([^"']*\.mov[^"']*)["']`,
@@ -201,6 +221,7 @@ func (va *VideoAnalyzer) extractFromScriptContent(content string, baseURL *url.U
 		`src:\s*["']([^"']*\.m3u8[^"']*)["']`,
 		`src:\s*["']([^"']*\.mp4[^"']*)["']`,
 		`url:\s*["']([^"']*\.m3u8[^"']*)["']`,
+		`url:\s*["']([^"']*\.mpd[^"']*)["']`,
 		`url:\s*["']([^"']*\.mp4[^"']*)["']`,
 	}
 	
@@ -327,6 +348,8 @@ func (va *VideoAnalyzer) detectVideoType(videoURL string) string {
 	
 	if strings.Contains(lower, ".m3u8") {
 		return "m3u8"
+	} else if strings.Contains(lower, ".mpd") {
+		return "mpd"
 	} else if strings.Contains(lower, ".mp4") {
 		return "mp4"
 	} else if strings.Contains(lower, ".webm") {
@@ -353,6 +376,8 @@ func (va *VideoAnalyzer) detectVideoTypeFromMime(mimeType string) string {
 		return "webm"
 	} else if strings.Contains(mimeType, "m3u8") {
 		return "m3u8"
+	} else if strings.Contains(mimeType, "dash+xml") {
+		return "mpd"
 	}
 	
 	return "unknown"
@@ -394,7 +419,7 @@ func (va *VideoAnalyzer) isValidVideoURL(videoURL string) bool {
 
 func (va *VideoAnalyzer) isVideoLink(link string) bool {
 	lower := strings.ToLower(link)
-	videoExtensions := []string{".mp4", ".webm", ".mov", ".avi", ".flv", ".mkv", ".m3u8"}
+	videoExtensions := []string{".mp4", ".webm", ".mov", ".avi", ".flv", ".mkv", ".m3u8", ".mpd"}
 	
 	for _, ext := range videoExtensions {
 		if strings.Contains(lower, ext) {
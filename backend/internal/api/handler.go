@@ -1,10 +1,16 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +19,8 @@ import (
 
 	"videoDownload/internal/analyzer"
 	"videoDownload/internal/downloader"
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/store"
 	"videoDownload/internal/types"
 )
 
@@ -21,17 +29,170 @@ type TaskManager struct {
 	mutex sync.RWMutex
 	clients map[string][]chan *types.DownloadTask
 	clientsMutex sync.RWMutex
+	controls map[string]*taskControl // 进行中任务的取消与暂停控制，由 mutex 保护
+	store store.TaskStore
+	savedAt map[string]time.Time // 每个任务最近一次持久化的时间，用于限制进度更新的写入频率
 }
 
 var globalTaskManager = &TaskManager{
 	tasks: make(map[string]*types.DownloadTask),
 	clients: make(map[string][]chan *types.DownloadTask),
+	controls: make(map[string]*taskControl),
+	store: store.NewMemoryStore(),
+	savedAt: make(map[string]time.Time),
 }
 
+// progressSaveInterval 下载进度写入任务存储的最小间隔，状态变化总是立即写入
+const progressSaveInterval = 5 * time.Second
+
+// InitTasks 改用 st 保存任务，并恢复上次运行留下的任务：未结束的任务按原始请求重新开始，
+// 已完成的分片从工作目录中复用，已暂停的任务恢复后保持暂停；没有原始请求的任务标记为 interrupted。
+// 已结束超过 workTTL 的任务的工作目录随后定期清理，workTTL 不大于 0 时不清理
+func InitTasks(st store.TaskStore, workDir string, workTTL time.Duration) error {
+	tasks, err := st.Load()
+	if err != nil {
+		return fmt.Errorf("加载任务失败: %v", err)
+	}
+	workRoot = workDir
+
+	tm := globalTaskManager
+	tm.mutex.Lock()
+	tm.store = st
+	for _, task := range tasks {
+		tm.tasks[task.ID] = task
+	}
+	tm.mutex.Unlock()
+
+	for _, task := range tasks {
+		switch task.Status {
+		case "queued", "pending", "downloading", "paused":
+			tm.restoreTask(task)
+		}
+	}
+
+	if workTTL > 0 {
+		go tm.sweepWorkDirs(workTTL)
+	}
+	return nil
+}
+
+// workSweepInterval 检查过期工作目录的间隔
+const workSweepInterval = time.Hour
+
+// sweepWorkDirs 启动时和之后每隔 workSweepInterval 清理一次工作目录
+func (tm *TaskManager) sweepWorkDirs(ttl time.Duration) {
+	for {
+		tm.removeStaleWorkDirs(ttl)
+		time.Sleep(workSweepInterval)
+	}
+}
+
+// staleWorkPrefix 是待删除工作目录改名后的前缀
+const staleWorkPrefix = ".stale-"
+
+// removeStaleWorkDirs 删除失败或中断超过 ttl、不会再重试的任务留下的工作目录，以及修改时间超过 ttl、不属于任何任务的目录。
+// 成功和取消的任务在下载结束时已删除工作目录
+func (tm *TaskManager) removeStaleWorkDirs(ttl time.Duration) {
+	entries, err := os.ReadDir(workRoot)
+	if err != nil {
+		return
+	}
+
+	// 持有锁判断并改名，同时重试的任务会使用新建的目录；耗时的删除在释放锁之后进行
+	var stale []string
+	tm.mutex.RLock()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if task, exists := tm.tasks[entry.Name()]; exists {
+			switch task.Status {
+			case "queued", "pending", "downloading", "paused":
+				continue
+			}
+			if time.Since(task.UpdatedAt) <= ttl {
+				continue
+			}
+		} else if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) <= ttl {
+			continue
+		}
+
+		dir := filepath.Join(workRoot, entry.Name())
+		if !strings.HasPrefix(entry.Name(), staleWorkPrefix) {
+			renamed := filepath.Join(workRoot, staleWorkPrefix+entry.Name())
+			if err := os.Rename(dir, renamed); err != nil {
+				continue
+			}
+			dir = renamed
+		}
+		stale = append(stale, dir)
+	}
+	tm.mutex.RUnlock()
+
+	for _, dir := range stale {
+		fmt.Printf("清理过期的工作目录: %s\n", strings.TrimPrefix(filepath.Base(dir), staleWorkPrefix))
+		os.RemoveAll(dir)
+	}
+}
+
+// restoreTask 把服务重启前未结束的任务重新排队，已暂停的任务直接开始并保持暂停
+func (tm *TaskManager) restoreTask(task *types.DownloadTask) {
+	tm.mutex.Lock()
+	if task.Request == nil {
+		task.Status = "interrupted"
+		task.ErrorMessage = "服务重启时任务中断"
+		task.UpdatedAt = time.Now()
+		tm.persist(task)
+		tm.mutex.Unlock()
+		return
+	}
+
+	paused := task.Status == "paused"
+	if !paused {
+		// 恢复运行属于重启后的重新排队，不经过状态切换表
+		task.Status = "queued"
+	}
+	task.DownloadSpeed = 0
+	task.TimeRemaining = 0
+	task.UpdatedAt = time.Now()
+	tm.persist(task)
+	tm.mutex.Unlock()
+
+	fmt.Printf("恢复任务 %s: %s\n", task.ID, task.URL)
+	if paused {
+		globalScheduler.startNow(task.ID)
+	} else {
+		globalScheduler.enqueue(task.ID, task.Priority)
+	}
+}
+
+// persist 把任务写入存储，调用方需持有 mutex
+func (tm *TaskManager) persist(task *types.DownloadTask) {
+	tm.savedAt[task.ID] = time.Now()
+	if err := tm.store.Save(task); err != nil {
+		fmt.Printf("保存任务 %s 失败: %v\n", task.ID, err)
+	}
+}
+
+// persistProgress 与 persist 相同，但距上次写入不足 progressSaveInterval 时跳过
+func (tm *TaskManager) persistProgress(task *types.DownloadTask) {
+	if time.Since(tm.savedAt[task.ID]) >= progressSaveInterval {
+		tm.persist(task)
+	}
+}
+
+var (
+	errTaskNotFound      = errors.New("任务不存在")
+	errTaskFinished      = errors.New("任务已结束")
+	errInvalidTransition = errors.New("任务状态不允许该操作")
+	errTaskNotQueued     = errors.New("任务不在排队中")
+)
+
 func (tm *TaskManager) AddTask(task *types.DownloadTask) {
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 	tm.tasks[task.ID] = task
+	tm.persist(task)
 }
 
 func (tm *TaskManager) GetTask(id string) (*types.DownloadTask, bool) {
@@ -52,12 +213,17 @@ func (tm *TaskManager) GetAllTasks() []*types.DownloadTask {
 	return tasks
 }
 
-func (tm *TaskManager) CompleteTask(id string, fileSize int64) {
+// CompleteTask 把任务标记为完成，gaps 不为空时状态为 completed_with_gaps 并记录缺失的时间范围
+func (tm *TaskManager) CompleteTask(id string, fileSize int64, gaps []types.TimeRange) {
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 	
-	if task, exists := tm.tasks[id]; exists {
-		task.Status = "completed"
+	status := "completed"
+	if len(gaps) > 0 {
+		status = "completed_with_gaps"
+	}
+	if task, exists := tm.tasks[id]; exists && setStatus(task, status) == nil {
+		task.Gaps = gaps
 		task.Progress = 100
 		task.UpdatedAt = time.Now()
 		task.EndTime = time.Now()
@@ -73,23 +239,273 @@ func (tm *TaskManager) CompleteTask(id string, fileSize int64) {
 				task.AverageSpeed = float64(fileSize) / float64(task.TotalDuration)
 			}
 		}
+		tm.persist(task)
 		
 		// 通知所有订阅的客户端
 		tm.broadcastUpdate(task)
 	}
 }
 
+// taskControl 是进行中任务的取消函数和暂停控制
+type taskControl struct {
+	cancel context.CancelFunc
+	gate   *downloader.PauseGate
+}
+
+// taskTransitions 列出每个状态允许转入的状态，不在表中的状态为终态；失败的任务可以重试
+var taskTransitions = map[string][]string{
+	"error":       {"queued"},
+	"queued":      {"pending", "cancelled", "interrupted"},
+	"pending":     {"downloading", "error", "cancelled", "interrupted"},
+	"downloading": {"paused", "completed", "completed_with_gaps", "error", "cancelled", "interrupted"},
+	"paused":      {"downloading", "completed", "completed_with_gaps", "error", "cancelled", "interrupted"},
+}
+
+// setStatus 按 taskTransitions 检查并切换任务状态，状态不变时视为合法
+func setStatus(task *types.DownloadTask, status string) error {
+	if task.Status == status {
+		return nil
+	}
+	for _, next := range taskTransitions[task.Status] {
+		if next == status {
+			task.Status = status
+			return nil
+		}
+	}
+	if len(taskTransitions[task.Status]) == 0 {
+		return errTaskFinished
+	}
+	return fmt.Errorf("%w: %s -> %s", errInvalidTransition, task.Status, status)
+}
+
+// startTask 为任务创建可被 CancelTask 取消的 context 和可被 PauseTask 暂停的控制，调用方需持有 mutex
+func (tm *TaskManager) startTask(id string) (context.Context, *downloader.PauseGate) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gate := downloader.NewPauseGate()
+	tm.controls[id] = &taskControl{cancel: cancel, gate: gate}
+	return ctx, gate
+}
+
+// launchTask 开始调度器分配了名额的任务；paused 为 true 时任务开始后保持暂停。
+// 任务已不在排队状态（例如出队前刚被取消）时返回 false
+func (tm *TaskManager) launchTask(id string, paused bool) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists || task.Request == nil {
+		return false
+	}
+	if !paused {
+		if setStatus(task, "pending") != nil {
+			return false
+		}
+		if task.StartTime.IsZero() {
+			// 排队等待的时间不计入下载耗时
+			task.StartTime = time.Now()
+		}
+		task.UpdatedAt = time.Now()
+		tm.persist(task)
+		tm.broadcastUpdate(task)
+	}
+
+	ctx, gate := tm.startTask(id)
+	if paused {
+		gate.Pause()
+	}
+	go executeDownload(ctx, gate, id, *task.Request, task.OutputFilePath)
+	return true
+}
+
+// releaseTask 在下载协程结束时释放任务的 context
+func (tm *TaskManager) releaseTask(id string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if control, ok := tm.controls[id]; ok {
+		control.cancel()
+		delete(tm.controls, id)
+	}
+}
+
+// CancelTask 取消排队中、等待中、下载中或已暂停的任务，并通知订阅的客户端
+func (tm *TaskManager) CancelTask(id string) (*types.DownloadTask, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists {
+		return nil, errTaskNotFound
+	}
+	// 取消直播录制只是停止录制，已录制的部分合并后任务正常完成
+	if control, ok := tm.controls[id]; ok && task.Live {
+		control.cancel()
+		delete(tm.controls, id)
+		return task, nil
+	}
+	if err := setStatus(task, "cancelled"); err != nil {
+		return task, err
+	}
+
+	globalScheduler.dequeue(id)
+	if control, ok := tm.controls[id]; ok {
+		control.cancel()
+		delete(tm.controls, id)
+	}
+	task.DownloadSpeed = 0
+	task.TimeRemaining = 0
+	task.UpdatedAt = time.Now()
+	task.EndTime = time.Now()
+	tm.persist(task)
+
+	// 通知所有订阅的客户端
+	tm.broadcastUpdate(task)
+	return task, nil
+}
+
+// markCancelled 把下载协程因取消而结束、但状态尚未切换的任务标记为已取消
+func (tm *TaskManager) markCancelled(id string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists || task.Status == "cancelled" || setStatus(task, "cancelled") != nil {
+		return
+	}
+	task.DownloadSpeed = 0
+	task.TimeRemaining = 0
+	task.UpdatedAt = time.Now()
+	task.EndTime = time.Now()
+	tm.persist(task)
+	tm.broadcastUpdate(task)
+}
+
+// PauseTask 暂停下载中的任务，进行中的分片会继续完成，但不再发起新的分片请求
+func (tm *TaskManager) PauseTask(id string) (*types.DownloadTask, error) {
+	return tm.switchPause(id, "paused", (*downloader.PauseGate).Pause)
+}
+
+// ResumeTask 继续已暂停的任务，从磁盘上已完成的分片之后接着下载
+func (tm *TaskManager) ResumeTask(id string) (*types.DownloadTask, error) {
+	return tm.switchPause(id, "downloading", (*downloader.PauseGate).Resume)
+}
+
+func (tm *TaskManager) switchPause(id, status string, apply func(*downloader.PauseGate)) (*types.DownloadTask, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists {
+		return nil, errTaskNotFound
+	}
+	control, running := tm.controls[id]
+	if !running {
+		return task, errTaskFinished
+	}
+	if err := setStatus(task, status); err != nil {
+		return task, err
+	}
+
+	apply(control.gate)
+	task.DownloadSpeed = 0
+	task.TimeRemaining = 0
+	task.UpdatedAt = time.Now()
+	tm.persist(task)
+
+	// 通知所有订阅的客户端
+	tm.broadcastUpdate(task)
+	return task, nil
+}
+
+// RetryTask 把失败的任务重新排队，复用工作目录中已完成的分片和保存的播放列表，只下载失败或缺失的分片。
+// 任务保持原来的 ID，调用方需在返回后把任务加入调度队列
+func (tm *TaskManager) RetryTask(id string) (*types.DownloadTask, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists {
+		return nil, errTaskNotFound
+	}
+	if task.Request == nil {
+		return task, fmt.Errorf("%w: 任务缺少原始请求", errInvalidTransition)
+	}
+	if globalScheduler.running(id) {
+		// 下载协程尚未结束，名额仍被占用
+		return task, fmt.Errorf("%w: 任务仍在结束中", errInvalidTransition)
+	}
+	if err := setStatus(task, "queued"); err != nil {
+		return task, err
+	}
+
+	task.Retries++
+	task.Progress = 0
+	task.ErrorMessage = ""
+	task.DownloadSpeed = 0
+	task.TimeRemaining = 0
+	task.SegmentReport = nil
+	task.Gaps = nil
+	task.StartTime = time.Time{}
+	task.EndTime = time.Time{}
+	task.UpdatedAt = time.Now()
+	tm.persist(task)
+
+	// 通知所有订阅的客户端
+	tm.broadcastUpdate(task)
+	return task, nil
+}
+
+// SetPriority 修改未结束任务的优先级，排队中的任务按新优先级重新确定位置
+func (tm *TaskManager) SetPriority(id string, priority int) (*types.DownloadTask, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	task, exists := tm.tasks[id]
+	if !exists {
+		return nil, errTaskNotFound
+	}
+	if len(taskTransitions[task.Status]) == 0 {
+		return task, errTaskFinished
+	}
+
+	task.Priority = priority
+	task.UpdatedAt = time.Now()
+	globalScheduler.reprioritize(id, priority)
+	tm.persist(task)
+
+	// 通知所有订阅的客户端
+	tm.broadcastUpdate(task)
+	return task, nil
+}
+
+// QueueStatus 返回调度器的名额占用情况和按开始顺序排列的排队任务
+func (tm *TaskManager) QueueStatus() types.QueueStatus {
+	maxActive, active, ids := globalScheduler.snapshot()
+
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	status := types.QueueStatus{MaxActive: maxActive, Active: active, Tasks: make([]*types.DownloadTask, 0, len(ids))}
+	for _, id := range ids {
+		if task, exists := tm.tasks[id]; exists {
+			status.Tasks = append(status.Tasks, task)
+		}
+	}
+	return status
+}
+
 func (tm *TaskManager) UpdateTask(id string, status string, progress int, errorMsg string) {
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 	
-	if task, exists := tm.tasks[id]; exists {
-		task.Status = status
+	// 不合法的状态切换（例如已取消的任务收到下载协程迟到的更新）直接忽略
+	if task, exists := tm.tasks[id]; exists && setStatus(task, status) == nil {
 		task.Progress = progress
 		task.UpdatedAt = time.Now()
 		if errorMsg != "" {
 			task.ErrorMessage = errorMsg
 		}
+		tm.persist(task)
 		
 		// 通知所有订阅的客户端
 		tm.broadcastUpdate(task)
@@ -100,14 +516,16 @@ func (tm *TaskManager) UpdateTaskWithDetails(id string, status string, progress
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 	
-	if task, exists := tm.tasks[id]; exists {
-		task.Status = status
+	// 暂停期间进行中的分片仍会上报进度，此时保持 paused 状态
+	if task, exists := tm.tasks[id]; exists && (task.Status == "paused" || setStatus(task, status) == nil) {
 		task.Progress = progress
 		task.UpdatedAt = time.Now()
 		task.DownloadedSize = downloadedSize
 		task.FileSize = fileSize
 		task.DownloadSpeed = speed
 		
+		// 分片下载的总大小按 #EXTINF 时长和已知分片的码率估算，剩余时间随之修正
+		task.TimeRemaining = 0
 		if speed > 0 && fileSize > downloadedSize {
 			remainingBytes := fileSize - downloadedSize
 			task.TimeRemaining = int64(float64(remainingBytes) / speed)
@@ -116,12 +534,210 @@ func (tm *TaskManager) UpdateTaskWithDetails(id string, status string, progress
 		if errorMsg != "" {
 			task.ErrorMessage = errorMsg
 		}
+		tm.persistProgress(task)
 		
 		// 通知所有订阅的客户端
 		tm.broadcastUpdate(task)
 	}
 }
 
+// SetOutputFile 更新任务的输出文件路径，下载器可能按分片格式调整扩展名
+func (tm *TaskManager) SetOutputFile(id string, outputFilePath string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if task, exists := tm.tasks[id]; exists {
+		task.OutputFilePath = outputFilePath
+		tm.persist(task)
+	}
+}
+
+// SetRenditions 记录单独保存的音频、字幕轨道文件
+func (tm *TaskManager) SetRenditions(id string, renditions []types.RenditionFile) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if task, exists := tm.tasks[id]; exists {
+		task.Renditions = renditions
+		tm.persist(task)
+	}
+}
+
+// SetSegmentReport 记录重新下载的分片，report 为 nil 时清除上一次的报告
+func (tm *TaskManager) SetSegmentReport(id string, report *types.SegmentReport) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if task, exists := tm.tasks[id]; exists {
+		task.SegmentReport = report
+		tm.persist(task)
+	}
+}
+
+// UpdateRecording 更新直播录制任务的已录制时长，录制任务没有百分比进度
+func (tm *TaskManager) UpdateRecording(id string, recorded time.Duration) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if task, exists := tm.tasks[id]; exists && (task.Status == "paused" || setStatus(task, "downloading") == nil) {
+		task.Live = true
+		task.RecordedTime = int64(recorded.Seconds())
+		task.UpdatedAt = time.Now()
+		tm.persistProgress(task)
+
+		// 通知所有订阅的客户端
+		tm.broadcastUpdate(task)
+	}
+}
+
+// scheduler 限制同时运行的任务数，超出的任务按优先级排队，运行中的任务结束后自动开始下一个
+type scheduler struct {
+	mu        sync.Mutex
+	maxActive int
+	active    map[string]bool // 已开始且下载协程尚未结束的任务，暂停的任务仍占用名额
+	queue     []string        // 排队中的任务，队首最先开始
+	priority  map[string]int  // 排队中任务的优先级
+}
+
+// defaultMaxActive 默认同时运行的最大任务数
+const defaultMaxActive = 3
+
+var globalScheduler = &scheduler{
+	maxActive: defaultMaxActive,
+	active:    make(map[string]bool),
+	priority:  make(map[string]int),
+}
+
+// SetMaxActiveTasks 设置同时运行的最大任务数，n 小于 1 时按 1 处理；调大后立即开始排队的任务，
+// 调小时已运行的任务不受影响
+func SetMaxActiveTasks(n int) {
+	s := globalScheduler
+	s.mu.Lock()
+	s.maxActive = max(n, 1)
+	s.mu.Unlock()
+	s.dispatch()
+}
+
+// enqueue 把任务排在所有优先级不低于它的任务之后，有空闲名额时立即开始
+func (s *scheduler) enqueue(id string, priority int) {
+	s.mu.Lock()
+	s.insert(id, priority)
+	s.mu.Unlock()
+	s.dispatch()
+}
+
+// insert 按优先级插入任务，调用方需持有 mu
+func (s *scheduler) insert(id string, priority int) {
+	i := len(s.queue)
+	for j, queued := range s.queue {
+		if s.priority[queued] < priority {
+			i = j
+			break
+		}
+	}
+	s.queue = slices.Insert(s.queue, i, id)
+	s.priority[id] = priority
+}
+
+// remove 从队列中移除任务，返回任务原来的位置，不在队列中时返回 -1；调用方需持有 mu
+func (s *scheduler) remove(id string) int {
+	i := slices.Index(s.queue, id)
+	if i >= 0 {
+		s.queue = slices.Delete(s.queue, i, i+1)
+		delete(s.priority, id)
+	}
+	return i
+}
+
+// dequeue 把被取消的任务移出队列
+func (s *scheduler) dequeue(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+}
+
+// reprioritize 修改排队中任务的优先级并重新确定它的位置
+func (s *scheduler) reprioritize(id string, priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remove(id) >= 0 {
+		s.insert(id, priority)
+	}
+}
+
+// move 把排队中的任务移到 position，超出范围时移到队首或队尾；优先级保持不变，只影响之后插入的任务
+func (s *scheduler) move(id string, position int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	priority, queued := s.priority[id]
+	if !queued {
+		return errTaskNotQueued
+	}
+	s.remove(id)
+	position = min(max(position, 0), len(s.queue))
+	s.queue = slices.Insert(s.queue, position, id)
+	s.priority[id] = priority
+	return nil
+}
+
+// snapshot 返回最大任务数、当前运行的任务数和排队中的任务
+func (s *scheduler) snapshot() (int, int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxActive, len(s.active), slices.Clone(s.queue)
+}
+
+// dispatch 在有空闲名额时依次开始队首的任务。开始任务时不持有 mu，
+// 因此 TaskManager 可以在持有自己的锁时调用调度器
+func (s *scheduler) dispatch() {
+	for {
+		s.mu.Lock()
+		if len(s.active) >= s.maxActive || len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		id := s.queue[0]
+		s.remove(id)
+		s.active[id] = true
+		s.mu.Unlock()
+
+		if !globalTaskManager.launchTask(id, false) {
+			s.release(id)
+		}
+	}
+}
+
+// startNow 不经过排队直接开始任务并保持暂停，用于恢复重启前已暂停的任务
+func (s *scheduler) startNow(id string) {
+	s.mu.Lock()
+	s.active[id] = true
+	s.mu.Unlock()
+
+	if !globalTaskManager.launchTask(id, true) {
+		s.release(id)
+	}
+}
+
+// running 报告任务的下载协程是否仍占用名额
+func (s *scheduler) running(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[id]
+}
+
+func (s *scheduler) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, id)
+}
+
+// finished 在下载协程结束时释放名额并开始下一个排队的任务
+func (s *scheduler) finished(id string) {
+	s.release(id)
+	s.dispatch()
+}
+
 func (tm *TaskManager) broadcastUpdate(task *types.DownloadTask) {
 	tm.clientsMutex.RLock()
 	clients := tm.clients[task.ID]
@@ -174,26 +790,67 @@ func CreateDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !downloader.IsValidVariantPolicy(req.VariantPolicy) {
+		http.Error(w, "Invalid variant_policy", http.StatusBadRequest)
+		return
+	}
+
+	if req.OutputFormat != "" && req.OutputFormat != "mp4" && req.OutputFormat != "ts" {
+		http.Error(w, "Invalid output_format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Start < 0 || req.End < 0 || (req.End > 0 && req.End <= req.Start) {
+		http.Error(w, "Invalid start/end", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := adFilter(req); err != nil || req.AdMaxDuration < 0 {
+		http.Error(w, "Invalid ad filter", http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxMissingSegments < 0 || req.MaxMissingSeconds < 0 {
+		http.Error(w, "Invalid max_missing_segments/max_missing_seconds", http.StatusBadRequest)
+		return
+	}
+
+	client, err := httpclient.New(req.HTTPOptions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.Close()
+
 	taskID := uuid.New().String()
-	outputFilename := fmt.Sprintf("video_%s.mp4", taskID[:8])
+	outputFilename := fmt.Sprintf("video_%s.%s", taskID[:8], outputExtension(req.OutputFormat))
 	
 	task := &types.DownloadTask{
 		ID:             taskID,
 		URL:            req.URL,
-		Status:         "pending",
+		Status:         "queued",
 		Progress:       0,
 		OutputFilePath: outputFilename,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
-		StartTime:      time.Now(), // 记录开始时间
+		Priority:       req.Priority,
+		Request:        &req,
 	}
 
 	globalTaskManager.AddTask(task)
-
-	go executeDownload(taskID, req.URL, outputFilename)
+	// 先编码响应再入队，避免与开始任务时的状态修改并发
+	body, _ := json.Marshal(task)
+	globalScheduler.enqueue(taskID, req.Priority)
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(task)
+	w.Write(append(body, '\n'))
+}
+
+func outputExtension(format string) string {
+	if format == "ts" {
+		return "ts"
+	}
+	return "mp4"
 }
 
 func AnalyzeVideoResourcesHandler(w http.ResponseWriter, r *http.Request) {
@@ -210,11 +867,16 @@ func AnalyzeVideoResourcesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 创建视频分析器
-	videoAnalyzer := analyzer.NewVideoAnalyzer()
-	
+	// 创建视频分析器，分析网页时使用请求中的请求头和 Cookie
+	videoAnalyzer, err := analyzer.NewVideoAnalyzer(req.HTTPOptions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer videoAnalyzer.Close()
+
 	// 分析视频资源
-	result, err := videoAnalyzer.AnalyzeURL(req.URL)
+	result, err := videoAnalyzer.AnalyzeURL(r.Context(), req.URL)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Analysis failed: %v", err), http.StatusInternalServerError)
 		return
@@ -224,6 +886,44 @@ func AnalyzeVideoResourcesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// ListVariantsHandler 返回 HLS 主播放列表中的全部档位，供用户选择下载策略
+func ListVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req types.VariantsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.URL == "" {
+		http.Error(w, "URL is required", http.StatusBadRequest)
+		return
+	}
+
+	client, err := httpclient.New(req.HTTPOptions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer client.Close()
+
+	variants, renditions, err := downloader.ListVariants(r.Context(), client, req.URL)
+	if err != nil {
+		json.NewEncoder(w).Encode(types.VariantsResponse{
+			Success: false,
+			Error:   fmt.Sprintf("获取档位失败: %v", err),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(types.VariantsResponse{
+		Success:    true,
+		Variants:   variants,
+		Renditions: renditions,
+	})
+}
+
 func GetAllStatusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -246,45 +946,190 @@ func GetTaskStatusHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(task)
 }
 
-func executeDownload(taskID, url, outputFilename string) {
-	globalTaskManager.UpdateTask(taskID, "downloading", 0, "")
+// CancelTaskHandler 取消下载任务，停止全部请求并清理临时文件，订阅该任务的 SSE 连接随之关闭
+func CancelTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	startTime := time.Now()
-	var lastUpdateTime time.Time
-	var lastDownloadedSize int64
+	vars := mux.Vars(r)
+	taskID := vars["id"]
 
-	progressCallback := func(current, total int) {
-		if total > 0 {
-			progress := int(float64(current) / float64(total) * 100)
-			
-			// 使用分片数量计算估算的文件大小（每个分片约 1MB）
-			estimatedTotalSize := int64(total * 1024 * 1024)
-			downloadedSize := int64(current * 1024 * 1024)
-			
-			// 计算下载速度
-			currentTime := time.Now()
-			var speed float64
-			if !lastUpdateTime.IsZero() && currentTime.Sub(lastUpdateTime) > time.Second {
-				timeDiff := currentTime.Sub(lastUpdateTime).Seconds()
-				sizeDiff := downloadedSize - lastDownloadedSize
-				speed = float64(sizeDiff) / timeDiff
-				lastUpdateTime = currentTime
-				lastDownloadedSize = downloadedSize
-			} else if lastUpdateTime.IsZero() {
-				lastUpdateTime = currentTime
-				lastDownloadedSize = downloadedSize
-				speed = float64(downloadedSize) / time.Since(startTime).Seconds()
-			}
-			
-			globalTaskManager.UpdateTaskWithDetails(taskID, "downloading", progress, "", downloadedSize, estimatedTotalSize, speed)
+	task, err := globalTaskManager.CancelTask(taskID)
+	writeTaskActionResult(w, task, err)
+}
+
+// PauseTaskHandler 暂停下载中的任务
+func PauseTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	task, err := globalTaskManager.PauseTask(vars["id"])
+	writeTaskActionResult(w, task, err)
+}
+
+// ResumeTaskHandler 继续已暂停的任务
+func ResumeTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	task, err := globalTaskManager.ResumeTask(vars["id"])
+	writeTaskActionResult(w, task, err)
+}
+
+// RetryTaskHandler 重新开始失败的任务，只下载失败或缺失的分片后重新合并
+func RetryTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	task, err := globalTaskManager.RetryTask(vars["id"])
+	if err != nil {
+		writeTaskActionResult(w, task, err)
+		return
+	}
+
+	// 先编码响应再入队，避免与开始任务时的状态修改并发
+	body, _ := json.Marshal(task)
+	globalScheduler.enqueue(task.ID, task.Priority)
+	w.Write(append(body, '\n'))
+}
+
+// SetPriorityHandler 修改任务的优先级
+func SetPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req types.PriorityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	task, err := globalTaskManager.SetPriority(vars["id"], req.Priority)
+	writeTaskActionResult(w, task, err)
+}
+
+// GetQueueHandler 返回排队中的任务，按开始顺序排列
+func GetQueueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(globalTaskManager.QueueStatus())
+}
+
+// MoveQueuedTaskHandler 把排队中的任务移动到队列的指定位置，返回调整后的队列
+func MoveQueuedTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req types.QueueMoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if _, exists := globalTaskManager.GetTask(vars["id"]); !exists {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err := globalScheduler.move(vars["id"], req.Position); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(globalTaskManager.QueueStatus())
+}
+
+func writeTaskActionResult(w http.ResponseWriter, task *types.DownloadTask, err error) {
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		http.Error(w, "Task not found", http.StatusNotFound)
+	case errors.Is(err, errTaskFinished):
+		http.Error(w, "Task already finished", http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		json.NewEncoder(w).Encode(task)
+	}
+}
+
+func executeDownload(ctx context.Context, gate *downloader.PauseGate, taskID string, req types.DownloadRequest, outputFilename string) {
+	// end 在发布终态之前释放任务的控制和调度名额，客户端收到失败状态后立即重试也不会被拒绝
+	ended := false
+	end := func() {
+		if !ended {
+			ended = true
+			globalTaskManager.releaseTask(taskID)
+			globalScheduler.finished(taskID)
 		}
 	}
+	defer end()
+	// 重启后恢复的暂停任务保持暂停，等待继续
+	if !gate.Paused() {
+		globalTaskManager.UpdateTask(taskID, "downloading", 0, "")
+	}
+
+	var speed speedWindow
+
+	emit := func(ev downloader.Event) {
+		var info downloader.ProgressEvent
+		switch ev := ev.(type) {
+		case downloader.RecordingEvent:
+			globalTaskManager.UpdateRecording(taskID, ev.Recorded)
+			return
+		case downloader.ProgressEvent:
+			info = ev
+		default:
+			return
+		}
+
+		if info.Total == 0 && info.DownloadedBytes == 0 {
+			return
+		}
+		// 有估算的总大小时按字节计算进度，否则按分片数
+		var progress int
+		switch {
+		case info.TotalBytes > 0:
+			progress = int(float64(info.DownloadedBytes) / float64(info.TotalBytes) * 100)
+		case info.Total > 0:
+			progress = int(float64(info.Downloaded) / float64(info.Total) * 100)
+		}
+		progress = min(progress, 100)
+
+		bytesPerSecond := speed.add(time.Now(), info.DownloadedBytes)
+		globalTaskManager.UpdateTaskWithDetails(taskID, "downloading", progress, "", info.DownloadedBytes, info.TotalBytes, bytesPerSecond)
+	}
+
+	opts, err := downloadOptions(req)
+	if err != nil {
+		end()
+		globalTaskManager.UpdateTask(taskID, "error", 0, err.Error())
+		return
+	}
+	// 任务结束后释放代理的连接池
+	defer opts.Client.Close()
+	opts.WorkDir = taskWorkDir(taskID)
+	opts.Pause = gate
+	opts.Report = &downloader.IntegrityReport{
+		MaxMissingSegments: req.MaxMissingSegments,
+		MaxMissingDuration: time.Duration(req.MaxMissingSeconds * float64(time.Second)),
+	}
+	result, err := download(ctx, req.URL, outputFilename, opts, emit)
+	if ctx.Err() != nil && (result == nil || !result.Stopped) {
+		// 状态已由 CancelTask 设置；停止录制后没有可保存内容的直播在这里标记为已取消
+		end()
+		globalTaskManager.markCancelled(taskID)
+		return
+	}
+
+	globalTaskManager.SetSegmentReport(taskID, opts.Report.Snapshot())
 
-	err := downloadWithProgress(url, outputFilename, progressCallback)
-	
 	if err != nil {
+		end()
 		globalTaskManager.UpdateTask(taskID, "error", 0, err.Error())
 	} else {
+		if result.OutputFilename != "" && result.OutputFilename != outputFilename {
+			outputFilename = result.OutputFilename
+			globalTaskManager.SetOutputFile(taskID, outputFilename)
+		}
+
 		// 获取下载完成后的文件大小
 		fileInfo, err := os.Stat(outputFilename)
 		var fileSize int64
@@ -292,12 +1137,111 @@ func executeDownload(taskID, url, outputFilename string) {
 			fileSize = fileInfo.Size()
 		}
 		
-		globalTaskManager.CompleteTask(taskID, fileSize)
+		globalTaskManager.SetRenditions(taskID, result.Renditions)
+		end()
+		globalTaskManager.CompleteTask(taskID, fileSize, result.Gaps)
 	}
 }
 
-func downloadWithProgress(url, outputFilename string, progressCallback func(int, int)) error {
-	return downloader.DownloadM3U8(url, outputFilename, progressCallback)
+// speedWindowSpan 是计算下载速度的滑动窗口长度
+const speedWindowSpan = 5 * time.Second
+
+// speedWindow 按最近 speedWindowSpan 内接收的字节计算速度，避免单个分片完成时的跳变
+type speedWindow struct {
+	samples []speedSample
+}
+
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// add 记录一次累计字节数并返回窗口内的平均速度（字节/秒），样本不足时返回 0。
+// 累计字节数减少（失败的请求被扣除）时重新开始统计
+func (w *speedWindow) add(at time.Time, bytes int64) float64 {
+	if n := len(w.samples); n > 0 && bytes < w.samples[n-1].bytes {
+		w.samples = w.samples[:0]
+	}
+	w.samples = append(w.samples, speedSample{at: at, bytes: bytes})
+
+	// 保留窗口起点之前的最后一个样本作为基准
+	drop := 0
+	for drop+1 < len(w.samples) && at.Sub(w.samples[drop+1].at) >= speedWindowSpan {
+		drop++
+	}
+	w.samples = w.samples[drop:]
+
+	first := w.samples[0]
+	elapsed := at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes-first.bytes) / elapsed
+}
+
+// download 通过 downloader.DefaultRegistry 按 URL 选择下载器
+func download(ctx context.Context, url, outputFilename string, opts downloader.Options, emit func(downloader.Event)) (*downloader.Result, error) {
+	d, err := downloader.DefaultRegistry.Lookup(ctx, opts.Client, url)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("选择下载器 %s: %s\n", d.Name(), url)
+	return d.Download(ctx, url, outputFilename, opts, emit)
+}
+
+// workRoot 存放各任务工作目录的根目录，进程重启后同一任务可以复用已下载的分片；InitTasks 会改为数据目录下的 work
+var workRoot = filepath.Join(os.TempDir(), "videodownload")
+
+func taskWorkDir(taskID string) string {
+	return filepath.Join(workRoot, taskID)
+}
+
+// downloadOptions 把请求转换为下载选项，请求头或 Cookie 无效时返回错误
+func downloadOptions(req types.DownloadRequest) (downloader.Options, error) {
+	client, err := httpclient.New(req.HTTPOptions)
+	if err != nil {
+		return downloader.Options{}, err
+	}
+	ads, err := adFilter(req)
+	if err != nil {
+		client.Close()
+		return downloader.Options{}, err
+	}
+	return downloader.Options{
+		VariantPolicy: req.VariantPolicy,
+		MaxBandwidth:  req.MaxBandwidth,
+		MaxDuration:   time.Duration(req.MaxDuration) * time.Second,
+		StopAt:        req.StopAt,
+
+		AudioLanguages:    req.AudioLanguages,
+		SubtitleLanguages: req.SubtitleLanguages,
+
+		ClipStart: time.Duration(req.Start * float64(time.Second)),
+		ClipEnd:   time.Duration(req.End * float64(time.Second)),
+		ExactClip: req.ExactTrim,
+
+		Ads: ads,
+
+		Client: client,
+	}, nil
+}
+
+// adFilter 按请求创建广告过滤条件，没有开启 skip_ads 时返回 nil
+func adFilter(req types.DownloadRequest) (*downloader.AdFilter, error) {
+	if !req.SkipAds {
+		return nil, nil
+	}
+	filter := &downloader.AdFilter{
+		MaxDuration: time.Duration(req.AdMaxDuration * float64(time.Second)),
+	}
+	if req.AdURLPattern != "" {
+		pattern, err := regexp.Compile(req.AdURLPattern)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 ad_url_pattern: %v", err)
+		}
+		filter.URLPattern = pattern
+	}
+	return filter, nil
 }
 
 // SSE 处理函数
@@ -318,9 +1262,10 @@ func TaskProgressSSEHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Cache-Control")
 	
-	// 创建客户端通道
+	// 创建客户端通道。通道不关闭，移除后 broadcastUpdate 可能仍持有它，非阻塞发送不会出错
 	clientChan := make(chan *types.DownloadTask, 10)
 	globalTaskManager.AddClient(taskID, clientChan)
+	defer globalTaskManager.RemoveClient(taskID, clientChan)
 	
 	// 发送当前任务状态
 	if task, exists := globalTaskManager.GetTask(taskID); exists {
@@ -342,16 +1287,12 @@ func TaskProgressSSEHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "data: %s\n\n", taskJSON)
 			w.(http.Flusher).Flush()
 			
-			// 如果任务完成或出错，关闭连接
-			if task.Status == "completed" || task.Status == "error" {
-				globalTaskManager.RemoveClient(taskID, clientChan)
-				close(clientChan)
+			// 如果任务完成、出错、被取消或中断，关闭连接
+			if task.Status == "completed" || task.Status == "completed_with_gaps" || task.Status == "error" || task.Status == "cancelled" || task.Status == "interrupted" {
 				return
 			}
 		case <-notify:
 			// 客户端断开连接
-			globalTaskManager.RemoveClient(taskID, clientChan)
-			close(clientChan)
 			return
 		}
 	}
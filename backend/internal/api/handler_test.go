@@ -0,0 +1,328 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"videoDownload/internal/downloader"
+	"videoDownload/internal/store"
+	"videoDownload/internal/types"
+)
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantErr  error
+	}{
+		{"queued", "pending", nil},
+		{"queued", "queued", nil},
+		{"pending", "downloading", nil},
+		{"downloading", "paused", nil},
+		{"paused", "downloading", nil},
+		{"paused", "cancelled", nil},
+		{"downloading", "completed", nil},
+		{"downloading", "completed_with_gaps", nil},
+		{"pending", "paused", errInvalidTransition},
+		{"pending", "completed", errInvalidTransition},
+		{"queued", "downloading", errInvalidTransition},
+		{"downloading", "interrupted", nil},
+		{"completed", "downloading", errTaskFinished},
+		{"cancelled", "downloading", errTaskFinished},
+		{"error", "queued", nil},
+		{"error", "downloading", errInvalidTransition},
+		{"completed", "queued", errTaskFinished},
+		{"cancelled", "queued", errTaskFinished},
+		{"interrupted", "queued", errTaskFinished},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			task := &types.DownloadTask{Status: tt.from}
+			err := setStatus(task, tt.to)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("setStatus = %v, 期望 %v", err, tt.wantErr)
+			}
+			want := tt.to
+			if err != nil {
+				want = tt.from
+			}
+			if task.Status != want {
+				t.Errorf("状态 = %s, 期望 %s", task.Status, want)
+			}
+		})
+	}
+}
+
+func newTestTaskManager(task *types.DownloadTask, running bool) *TaskManager {
+	tm := &TaskManager{
+		tasks:    map[string]*types.DownloadTask{task.ID: task},
+		clients:  make(map[string][]chan *types.DownloadTask),
+		controls: make(map[string]*taskControl),
+		store:    store.NewMemoryStore(),
+		savedAt:  make(map[string]time.Time),
+	}
+	if running {
+		tm.controls[task.ID] = &taskControl{cancel: func() {}, gate: downloader.NewPauseGate()}
+	}
+	return tm
+}
+
+func TestTaskManagerTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		running    bool // 下载协程仍在运行
+		action     func(tm *TaskManager, id string) (*types.DownloadTask, error)
+		wantErr    error
+		wantStatus string
+		wantPaused bool
+	}{
+		{"cancel queued", "queued", false, (*TaskManager).CancelTask, nil, "cancelled", false},
+		{"cancel pending", "pending", true, (*TaskManager).CancelTask, nil, "cancelled", false},
+		{"cancel downloading", "downloading", true, (*TaskManager).CancelTask, nil, "cancelled", false},
+		{"cancel paused", "paused", true, (*TaskManager).CancelTask, nil, "cancelled", false},
+		{"cancel completed", "completed", false, (*TaskManager).CancelTask, errTaskFinished, "completed", false},
+		{"pause downloading", "downloading", true, (*TaskManager).PauseTask, nil, "paused", true},
+		{"pause pending", "pending", true, (*TaskManager).PauseTask, errInvalidTransition, "pending", false},
+		{"pause queued", "queued", false, (*TaskManager).PauseTask, errTaskFinished, "queued", false},
+		{"pause without download", "downloading", false, (*TaskManager).PauseTask, errTaskFinished, "downloading", false},
+		{"resume downloading", "downloading", true, (*TaskManager).ResumeTask, nil, "downloading", false},
+		{"resume error", "error", false, (*TaskManager).ResumeTask, errTaskFinished, "error", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &types.DownloadTask{ID: "task-" + tt.name, Status: tt.status}
+			tm := newTestTaskManager(task, tt.running)
+			control := tm.controls[task.ID]
+
+			_, err := tt.action(tm, task.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+			}
+			if task.Status != tt.wantStatus {
+				t.Errorf("状态 = %s, 期望 %s", task.Status, tt.wantStatus)
+			}
+			if control != nil && control.gate.Paused() != tt.wantPaused {
+				t.Errorf("暂停状态 = %v, 期望 %v", control.gate.Paused(), tt.wantPaused)
+			}
+			if tt.wantStatus == "cancelled" && tm.controls[task.ID] != nil {
+				t.Error("取消后应释放任务的控制")
+			}
+		})
+	}
+}
+
+func TestCancelLiveRecording(t *testing.T) {
+	task := &types.DownloadTask{ID: "live", Status: "downloading", Live: true}
+	tm := newTestTaskManager(task, true)
+	stopped := false
+	tm.controls[task.ID].cancel = func() { stopped = true }
+
+	if _, err := tm.CancelTask(task.ID); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+	if !stopped || tm.controls[task.ID] != nil {
+		t.Error("取消直播录制应停止下载协程并释放控制")
+	}
+	// 录制停止后合并已录制的分片，任务正常完成
+	if task.Status != "downloading" {
+		t.Errorf("状态 = %s, 期望 downloading", task.Status)
+	}
+	tm.CompleteTask(task.ID, 100, nil)
+	if task.Status != "completed" {
+		t.Errorf("合并后状态 = %s, 期望 completed", task.Status)
+	}
+}
+
+func TestRetryTask(t *testing.T) {
+	request := &types.DownloadRequest{URL: "https://example.com/video.m3u8"}
+
+	tests := []struct {
+		name       string
+		status     string
+		request    *types.DownloadRequest
+		wantErr    error
+		wantStatus string
+	}{
+		{"error", "error", request, nil, "queued"},
+		{"error without request", "error", nil, errInvalidTransition, "error"},
+		{"cancelled", "cancelled", request, errTaskFinished, "cancelled"},
+		{"interrupted", "interrupted", request, errTaskFinished, "interrupted"},
+		{"downloading", "downloading", request, errInvalidTransition, "downloading"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &types.DownloadTask{ID: "retry-" + tt.name, Status: tt.status, Request: tt.request, ErrorMessage: "失败", Progress: 30}
+			tm := newTestTaskManager(task, false)
+
+			_, err := tm.RetryTask(task.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+			}
+			if task.Status != tt.wantStatus {
+				t.Errorf("状态 = %s, 期望 %s", task.Status, tt.wantStatus)
+			}
+			if tt.wantErr == nil && (task.Retries != 1 || task.ErrorMessage != "" || task.Progress != 0) {
+				t.Errorf("重试后 retries = %d, error_message = %q, progress = %d", task.Retries, task.ErrorMessage, task.Progress)
+			}
+		})
+	}
+}
+
+// terminalStore 记录任务写入终态时调度器是否仍占用它的名额
+type terminalStore struct {
+	store.TaskStore
+	runningAtError *bool
+}
+
+func (s *terminalStore) Save(task *types.DownloadTask) error {
+	if task.Status == "error" {
+		running := globalScheduler.running(task.ID)
+		s.runningAtError = &running
+	}
+	return s.TaskStore.Save(task)
+}
+
+func TestRetryRightAfterFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	task := &types.DownloadTask{ID: "fail-fast", Status: "pending", Request: &types.DownloadRequest{URL: server.URL + "/video.mp4"}}
+	tm := newTestTaskManager(task, true)
+	st := &terminalStore{TaskStore: tm.store}
+	tm.store = st
+	defer func(prevTM *TaskManager, prevScheduler *scheduler, prevRoot string) {
+		globalTaskManager, globalScheduler, workRoot = prevTM, prevScheduler, prevRoot
+	}(globalTaskManager, globalScheduler, workRoot)
+	globalTaskManager = tm
+	globalScheduler = &scheduler{active: map[string]bool{task.ID: true}, priority: make(map[string]int)}
+	workRoot = t.TempDir()
+
+	executeDownload(context.Background(), downloader.NewPauseGate(), task.ID, *task.Request, filepath.Join(t.TempDir(), "out.mp4"))
+
+	// 客户端一收到失败状态就可能重试，此时名额必须已经释放
+	if st.runningAtError == nil || *st.runningAtError {
+		t.Fatal("发布失败状态时任务仍占用调度名额，立即重试会被拒绝")
+	}
+	if _, err := tm.RetryTask(task.ID); err != nil {
+		t.Fatalf("RetryTask: %v", err)
+	}
+}
+
+func TestTaskManagerIgnoresLateUpdates(t *testing.T) {
+	task := &types.DownloadTask{ID: "late", Status: "downloading"}
+	tm := newTestTaskManager(task, true)
+
+	if _, err := tm.PauseTask(task.ID); err != nil {
+		t.Fatalf("PauseTask: %v", err)
+	}
+	// 暂停期间进行中的分片上报的进度不改变 paused 状态
+	tm.UpdateTaskWithDetails(task.ID, "downloading", 40, "", 100, 200, 10)
+	if task.Status != "paused" || task.Progress != 40 {
+		t.Errorf("状态 = %s, 进度 = %d, 期望 paused 且进度更新", task.Status, task.Progress)
+	}
+
+	if _, err := tm.CancelTask(task.ID); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+	// 已取消的任务收到下载协程迟到的进度和失败状态
+	tm.UpdateTaskWithDetails(task.ID, "downloading", 50, "", 100, 200, 10)
+	tm.UpdateTask(task.ID, "error", 50, "context canceled")
+	if task.Status != "cancelled" || task.ErrorMessage != "" {
+		t.Errorf("状态 = %s, error_message = %q, 期望保持 cancelled", task.Status, task.ErrorMessage)
+	}
+
+	if _, err := tm.CancelTask("missing"); !errors.Is(err, errTaskNotFound) {
+		t.Errorf("取消不存在的任务: %v", err)
+	}
+}
+
+func TestSchedulerQueue(t *testing.T) {
+	// maxActive 为 0 时不会开始任何任务，只检查排队顺序
+	s := &scheduler{active: make(map[string]bool), priority: make(map[string]int)}
+	s.enqueue("a", 0)
+	s.enqueue("b", 5)
+	s.enqueue("c", 0)
+	s.enqueue("d", 5)
+	s.enqueue("e", -1)
+
+	check := func(want ...string) {
+		t.Helper()
+		if _, _, got := s.snapshot(); !slices.Equal(got, want) {
+			t.Errorf("队列 = %v, 期望 %v", got, want)
+		}
+	}
+	check("b", "d", "a", "c", "e")
+
+	s.reprioritize("e", 10)
+	check("e", "b", "d", "a", "c")
+
+	if err := s.move("c", 0); err != nil {
+		t.Fatal(err)
+	}
+	check("c", "e", "b", "d", "a")
+	if err := s.move("a", 100); err != nil {
+		t.Fatal(err)
+	}
+	check("c", "e", "b", "d", "a")
+	if err := s.move("missing", 0); !errors.Is(err, errTaskNotQueued) {
+		t.Errorf("移动不在队列中的任务: %v", err)
+	}
+
+	s.dequeue("b")
+	s.reprioritize("b", 3) // 已出队的任务不再入队
+	check("c", "e", "d", "a")
+}
+
+func TestRemoveStaleWorkDirs(t *testing.T) {
+	root := t.TempDir()
+	defer func(prev string) { workRoot = prev }(workRoot)
+	workRoot = root
+
+	const ttl = time.Hour
+	old := time.Now().Add(-2 * ttl)
+	tasks := []*types.DownloadTask{
+		{ID: "failed-old", Status: "error", UpdatedAt: old},
+		{ID: "failed-recent", Status: "error", UpdatedAt: time.Now()},
+		{ID: "interrupted-old", Status: "interrupted", UpdatedAt: old},
+		{ID: "downloading-old", Status: "downloading", UpdatedAt: old},
+	}
+	tm := newTestTaskManager(tasks[0], false)
+	for _, task := range tasks {
+		tm.tasks[task.ID] = task
+	}
+
+	for _, name := range []string{"failed-old", "failed-recent", "interrupted-old", "downloading-old", "orphan-old", "orphan-recent"} {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, "-old") {
+			os.Chtimes(dir, old, old)
+		}
+	}
+
+	tm.removeStaleWorkDirs(ttl)
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if want := []string{"downloading-old", "failed-recent", "orphan-recent"}; !slices.Equal(left, want) {
+		t.Errorf("剩余的工作目录 = %v, 期望 %v", left, want)
+	}
+}
@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// AdFilter 判断哪些不连续段是插入的广告，满足任一条件的段在下载前丢弃
+type AdFilter struct {
+	MaxDuration time.Duration  // 不超过该时长且不是最长的段视为广告，0 表示不按时长判断
+	URLPattern  *regexp.Regexp // 分片地址匹配该正则的段视为广告，为 nil 时不按地址判断
+	// 分片所在主机与正片不同的段总是视为广告，正片主机为累计时长最长的主机
+}
+
+// discontinuityGroup 是以 #EXT-X-DISCONTINUITY 分隔的一段连续分片
+type discontinuityGroup struct {
+	segments []segment
+	duration float64
+	host     string // 第一个分片的主机
+}
+
+func groupDiscontinuities(segments []segment) []discontinuityGroup {
+	var groups []discontinuityGroup
+	for i, seg := range segments {
+		if i == 0 || seg.Discontinuity != segments[i-1].Discontinuity {
+			groups = append(groups, discontinuityGroup{host: segmentHost(seg)})
+		}
+		g := &groups[len(groups)-1]
+		g.segments = append(g.segments, seg)
+		g.duration += seg.Duration
+	}
+	return groups
+}
+
+// filterAds 丢弃被判定为广告的不连续段，只有一段时不做处理
+func filterAds(segments []segment, filter *AdFilter) ([]segment, error) {
+	groups := groupDiscontinuities(segments)
+	if filter == nil || len(groups) < 2 {
+		return segments, nil
+	}
+
+	mainHost := contentHost(segments)
+	longest := 0
+	for i, g := range groups {
+		if g.duration > groups[longest].duration {
+			longest = i
+		}
+	}
+
+	var kept []segment
+	dropped, droppedDuration := 0, 0.0
+	for i, g := range groups {
+		if reason := filter.match(g, mainHost, i == longest); reason != "" {
+			fmt.Printf("丢弃广告段 %d (%d 个分片, %.1f 秒): %s\n", i+1, len(g.segments), g.duration, reason)
+			dropped++
+			droppedDuration += g.duration
+			continue
+		}
+		kept = append(kept, g.segments...)
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("所有不连续段都被判定为广告，请调整广告过滤条件")
+	}
+	if dropped > 0 {
+		fmt.Printf("共丢弃 %d 个广告段，%.1f 秒\n", dropped, droppedDuration)
+	}
+	return kept, nil
+}
+
+// match 返回段被判定为广告的原因，不是广告时返回空字符串
+func (f *AdFilter) match(g discontinuityGroup, mainHost string, longest bool) string {
+	if f.URLPattern != nil {
+		for _, seg := range g.segments {
+			if f.URLPattern.MatchString(seg.URL) {
+				return "分片地址匹配 " + f.URLPattern.String()
+			}
+		}
+	}
+	if mainHost != "" && g.host != mainHost {
+		return "分片主机 " + g.host + " 与正片不同"
+	}
+	if f.MaxDuration > 0 && !longest && g.duration <= f.MaxDuration.Seconds() {
+		return fmt.Sprintf("时长不超过 %s", f.MaxDuration)
+	}
+	return ""
+}
+
+// contentHost 返回累计时长最长的分片主机，视为正片所在的主机
+func contentHost(segments []segment) string {
+	durations := make(map[string]float64)
+	best := ""
+	for _, seg := range segments {
+		host := segmentHost(seg)
+		durations[host] += seg.Duration
+		if best == "" || durations[host] > durations[best] {
+			best = host
+		}
+	}
+	return best
+}
+
+func segmentHost(seg segment) string {
+	u, err := url.Parse(seg.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,93 @@
+package downloader
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+// adSpec 描述一个分片的主机、时长和不连续序号
+type adSpec struct {
+	host     string
+	duration float64
+	group    int64
+}
+
+func adSegments(specs ...adSpec) []segment {
+	segments := make([]segment, len(specs))
+	for i, s := range specs {
+		segments[i] = segment{Index: i, URL: "https://" + s.host + "/seg.ts", Duration: s.duration, Discontinuity: s.group}
+	}
+	return segments
+}
+
+func TestFilterAds(t *testing.T) {
+	// 正片两段，中间插入 15 秒同主机的广告和一段其他主机的广告
+	segments := adSegments(
+		adSpec{"cdn.example.com", 10, 0}, adSpec{"cdn.example.com", 10, 0},
+		adSpec{"ads.example.net", 5, 1},
+		adSpec{"cdn.example.com", 15, 2},
+		adSpec{"cdn.example.com", 10, 3}, adSpec{"cdn.example.com", 10, 3}, adSpec{"cdn.example.com", 10, 3},
+	)
+
+	tests := []struct {
+		name     string
+		segments []segment
+		filter   *AdFilter
+		want     []int
+		wantErr  bool
+	}{
+		{
+			name:     "no filter",
+			segments: segments,
+			want:     []int{0, 1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:     "other host",
+			segments: segments,
+			filter:   &AdFilter{},
+			want:     []int{0, 1, 3, 4, 5, 6},
+		},
+		{
+			name:     "max duration keeps longest group",
+			segments: segments,
+			filter:   &AdFilter{MaxDuration: 20 * time.Second},
+			want:     []int{4, 5, 6},
+		},
+		{
+			name:     "url pattern",
+			segments: adSegments(adSpec{"a.com", 4, 0}, adSpec{"a.com", 4, 1}),
+			filter:   &AdFilter{URLPattern: regexp.MustCompile(`a\.com/seg`)},
+			wantErr:  true,
+		},
+		{
+			name:     "single group untouched",
+			segments: adSegments(adSpec{"a.com", 4, 0}, adSpec{"b.com", 4, 0}),
+			filter:   &AdFilter{MaxDuration: time.Minute},
+			want:     []int{0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, err := filterAds(tt.segments, tt.filter)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("filterAds: %v", err)
+			}
+			var got []int
+			for _, seg := range kept {
+				got = append(got, seg.Index)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("保留的分片 = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
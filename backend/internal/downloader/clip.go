@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clipping 报告是否只下载一段时间范围
+func (o Options) clipping() bool {
+	return o.ClipStart > 0 || o.ClipEnd > 0
+}
+
+// clipSegments 按累计的分片时长选出与 [start, end) 有重叠的分片，end 为 0 表示到结尾。
+// 返回选中的分片和第一个选中分片的起始时间（秒）；有分片缺少时长时无法定位，返回错误
+func clipSegments(segments []segment, start, end time.Duration) ([]segment, float64, error) {
+	from, to := start.Seconds(), end.Seconds()
+
+	var clipped []segment
+	var first, t float64
+	for _, seg := range segments {
+		if seg.Duration <= 0 {
+			return nil, 0, fmt.Errorf("分片 %s 缺少时长，无法按时间范围下载", seg.Filename)
+		}
+		if t+seg.Duration > from && (to <= 0 || t < to) {
+			if len(clipped) == 0 {
+				first = t
+			}
+			clipped = append(clipped, seg)
+		}
+		t += seg.Duration
+	}
+	if len(clipped) == 0 {
+		return nil, 0, fmt.Errorf("时间范围超出了视频时长 (%.1f 秒)", t)
+	}
+	return clipped, first, nil
+}
+
+// clipTracks 把每个轨道的分片裁剪到 opts 的时间范围，并记下每个轨道第一个选中分片的起始时间
+func clipTracks(tracks []*track, opts Options) error {
+	for _, t := range tracks {
+		segments, first, err := clipSegments(t.segments, opts.ClipStart, opts.ClipEnd)
+		if err != nil {
+			return fmt.Errorf("轨道 %s: %v", trackLabel(t), err)
+		}
+		t.segments = segments
+		t.start = first
+	}
+	return nil
+}
+
+// trimOutput 用 ffmpeg 重新编码输出文件，精确截取从 offset 秒开始、时长为 duration 的部分；
+// duration 不大于 0 时截取到结尾。选中的分片已经覆盖了时间范围，没有 ffmpeg 时保留按分片边界截取的结果
+func trimOutput(ctx context.Context, tmpDir, outputFilename string, offset, duration float64) error {
+	if !FFmpegAvailable() {
+		fmt.Println("未找到 ffmpeg，输出按分片边界截取，首尾可能多出不足一个分片的内容")
+		return nil
+	}
+
+	untrimmed := filepath.Join(tmpDir, "untrimmed"+filepath.Ext(outputFilename))
+	if err := moveFile(outputFilename, untrimmed); err != nil {
+		return fmt.Errorf("移动输出文件失败: %v", err)
+	}
+
+	args := []string{"-y", "-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-i", untrimmed}
+	if duration > 0 {
+		args = append(args, "-t", strconv.FormatFloat(duration, 'f', 3, 64))
+	}
+	args = append(args, "-map", "0")
+	// 精确截取需要重新编码，WebM 使用 ffmpeg 的默认编码器
+	if !strings.EqualFold(filepath.Ext(outputFilename), ".webm") {
+		args = append(args, "-c:v", "libx264", "-c:a", "aac")
+	}
+	args = append(args, outputFilename)
+
+	fmt.Printf("精确截取: 从 %.3f 秒开始\n", offset)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg 截取失败: %v", err)
+	}
+	return os.Remove(untrimmed)
+}
+
+// trims 报告输出文件是否会被精确截取
+func (o Options) trims() bool {
+	return o.clipping() && o.ExactClip && FFmpegAvailable()
+}
+
+// trimClip 在 opts.ExactClip 时把输出文件精确截取到时间范围，origin 为输出文件开头对应的源时间（秒）。
+// 开头的分片缺失时输出晚于范围起点开始，从输出开头截取
+func trimClip(ctx context.Context, tmpDir, outputFilename string, origin float64, opts Options) error {
+	if !opts.clipping() || !opts.ExactClip {
+		return nil
+	}
+	from := max(opts.ClipStart.Seconds(), origin)
+	var duration float64
+	if opts.ClipEnd > 0 {
+		duration = opts.ClipEnd.Seconds() - from
+		if duration <= 0 {
+			return fmt.Errorf("时间范围内的分片全部缺失")
+		}
+	}
+	return trimOutput(ctx, tmpDir, outputFilename, from-origin, duration)
+}
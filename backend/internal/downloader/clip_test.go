@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// timedSegments 构造时长依次为 durations 的分片
+func timedSegments(durations ...float64) []segment {
+	segments := make([]segment, len(durations))
+	for i, d := range durations {
+		segments[i] = segment{Index: i, Filename: fmt.Sprintf("segment_%04d.ts", i), Duration: d}
+	}
+	return segments
+}
+
+func TestClipSegments(t *testing.T) {
+	tests := []struct {
+		name       string
+		segments   []segment
+		start, end time.Duration
+		want       []int
+		wantFirst  float64
+		wantErr    bool
+	}{
+		{
+			name:      "middle",
+			segments:  timedSegments(4, 4, 4, 4, 4),
+			start:     5 * time.Second,
+			end:       11 * time.Second,
+			want:      []int{1, 2},
+			wantFirst: 4,
+		},
+		{
+			name:      "boundaries",
+			segments:  timedSegments(4, 4, 4, 4),
+			start:     4 * time.Second,
+			end:       8 * time.Second,
+			want:      []int{1},
+			wantFirst: 4,
+		},
+		{
+			name:      "to the end",
+			segments:  timedSegments(2, 3, 5),
+			start:     4 * time.Second,
+			want:      []int{1, 2},
+			wantFirst: 2,
+		},
+		{
+			name:     "from the start",
+			segments: timedSegments(2, 3, 5),
+			end:      time.Second,
+			want:     []int{0},
+		},
+		{
+			name:     "beyond duration",
+			segments: timedSegments(4, 4),
+			start:    10 * time.Second,
+			wantErr:  true,
+		},
+		{
+			name:     "missing duration",
+			segments: timedSegments(4, 0, 4),
+			start:    time.Second,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clipped, first, err := clipSegments(tt.segments, tt.start, tt.end)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clipSegments: %v", err)
+			}
+			var got []int
+			for _, seg := range clipped {
+				got = append(got, seg.Index)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("选中的分片 = %v, 期望 %v", got, tt.want)
+			}
+			if first != tt.wantFirst {
+				t.Errorf("起始时间 = %.1f, 期望 %.1f", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestClipTracks(t *testing.T) {
+	video := &track{segments: timedSegments(4, 4, 4, 4)}
+	audio := &track{segments: timedSegments(3, 3, 3, 3, 3)}
+	opts := Options{ClipStart: 5 * time.Second, ClipEnd: 9 * time.Second}
+
+	if err := clipTracks([]*track{video, audio}, opts); err != nil {
+		t.Fatalf("clipTracks: %v", err)
+	}
+	// 各轨道记下自己第一个选中分片的起始时间
+	if video.start != 4 || audio.start != 3 {
+		t.Errorf("起始时间 = %.1f, %.1f, 期望 4, 3", video.start, audio.start)
+	}
+	if len(video.segments) != 2 || len(audio.segments) != 2 {
+		t.Errorf("视频 %d 个分片、音频 %d 个分片, 期望各 2 个", len(video.segments), len(audio.segments))
+	}
+}
@@ -0,0 +1,123 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+const encryptionAES128 = "AES-128"
+
+// segmentKey 对应播放列表中的一条 #EXT-X-KEY，作用于其后的分片直到下一条 #EXT-X-KEY
+type segmentKey struct {
+	Method string
+	URI    string
+	IV     []byte // 为空时由分片的媒体序列号推导
+}
+
+// keyCache 缓存已经获取的密钥，密钥轮换时每个 URI 只请求一次
+type keyCache struct {
+	mu     sync.Mutex
+	keys   map[string][]byte
+	client *httpclient.Client
+}
+
+func newKeyCache(client *httpclient.Client) *keyCache {
+	return &keyCache{keys: make(map[string][]byte), client: client}
+}
+
+func (kc *keyCache) get(ctx context.Context, keyURI string) ([]byte, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if key, ok := kc.keys[keyURI]; ok {
+		return key, nil
+	}
+
+	req, err := kc.client.NewRequest(ctx, http.MethodGet, keyURI)
+	if err != nil {
+		return nil, fmt.Errorf("创建密钥请求失败: %v", err)
+	}
+	resp, err := kc.client.Do(req, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("获取密钥失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取密钥 HTTP 错误: %d", resp.StatusCode)
+	}
+
+	key, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, fmt.Errorf("读取密钥失败: %v", err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("密钥长度错误: 期望 %d 字节，实际 %d 字节", aes.BlockSize, len(key))
+	}
+
+	kc.keys[keyURI] = key
+	return key, nil
+}
+
+// segmentIV 返回分片的解密 IV，未显式指定时使用大端序的媒体序列号
+func segmentIV(seg segment) []byte {
+	if len(seg.Key.IV) > 0 {
+		return seg.Key.IV
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seg.Sequence))
+	return iv
+}
+
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("密文长度 %d 不是 %d 的整数倍", len(data), aes.BlockSize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// 去除 PKCS#7 填充
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plain) {
+		return nil, fmt.Errorf("无效的填充，密钥或 IV 可能不正确")
+	}
+	if !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("无效的填充，密钥或 IV 可能不正确")
+	}
+
+	return plain[:len(plain)-padding], nil
+}
+
+func parseIV(value string) ([]byte, error) {
+	hexValue := strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	iv, err := hex.DecodeString(hexValue)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 IV: %s", value)
+	}
+	if len(iv) > aes.BlockSize {
+		return nil, fmt.Errorf("IV 长度错误: %s", value)
+	}
+	// 不足 16 字节时左侧补零
+	if len(iv) < aes.BlockSize {
+		iv = append(make([]byte, aes.BlockSize-len(iv)), iv...)
+	}
+	return iv, nil
+}
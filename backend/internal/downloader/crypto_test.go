@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// encryptAES128 按 HLS 的方式以 AES-128-CBC 加密并添加 PKCS#7 填充
+func encryptAES128(t *testing.T, plain, key, iv []byte) []byte {
+	t.Helper()
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestDecryptAES128(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := segmentIV(segment{Sequence: 42, Key: &segmentKey{}})
+	plain := bytes.Repeat([]byte{0x47, 1, 2, 3}, 47)
+	encrypted := encryptAES128(t, plain, key, iv)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		key     []byte
+		iv      []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "decrypts", data: encrypted, key: key, iv: iv, want: plain},
+		{name: "full padding block", data: encryptAES128(t, plain[:32], key, iv), key: key, iv: iv, want: plain[:32]},
+		{name: "wrong key", data: encrypted, key: []byte("fedcba9876543210"), iv: iv, wantErr: true},
+		{name: "truncated", data: encrypted[:len(encrypted)-1], key: key, iv: iv, wantErr: true},
+		{name: "empty", data: nil, key: key, iv: iv, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptAES128(tt.data, tt.key, tt.iv)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decryptAES128: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Error("解密结果与原文不一致")
+			}
+		})
+	}
+}
+
+func TestSegmentIV(t *testing.T) {
+	explicit := append(make([]byte, 15), 9)
+
+	tests := []struct {
+		name string
+		seg  segment
+		want []byte
+	}{
+		{"from media sequence", segment{Sequence: 0x0102, Key: &segmentKey{}}, append(make([]byte, 14), 0x01, 0x02)},
+		{"sequence zero", segment{Key: &segmentKey{}}, make([]byte, 16)},
+		{"explicit iv", segment{Sequence: 7, Key: &segmentKey{IV: explicit}}, explicit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := segmentIV(tt.seg); !bytes.Equal(got, tt.want) {
+				t.Errorf("IV = %x, 期望 %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIV(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{"0x000102030405060708090A0B0C0D0E0F", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, false},
+		{"0X1", nil, true},
+		{"0x0102", append(make([]byte, 14), 1, 2), false},
+		{"0xZZ", nil, true},
+		{"0x" + "00112233445566778899aabbccddeeff00", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseIV(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIV: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("IV = %x, 期望 %x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/remux"
+	"videoDownload/internal/types"
+)
+
+var dashContentTypes = []string{"application/dash+xml"}
+
+// dashDownloader 是 Registry 中的 DASH 下载器
+type dashDownloader struct{}
+
+func (dashDownloader) Name() string {
+	return "DASH"
+}
+
+// Probe 读取资源开头，判断是否为 MPD 清单
+func (dashDownloader) Probe(ctx context.Context, client *httpclient.Client, mpdURL string) (bool, error) {
+	resp, err := client.Get(ctx, mpdURL, 30*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(head), "<MPD"), nil
+}
+
+func (dashDownloader) Download(ctx context.Context, mpdURL, outputFilename string, opts Options, emit func(Event)) (*Result, error) {
+	return DownloadDASH(ctx, mpdURL, outputFilename, opts, progressEvents(emit))
+}
+
+// DownloadDASH 下载 DASH 点播清单中选中的视频和音频表示，并封装为 outputFilename。
+// 工作目录和 ctx 取消的处理同 DownloadM3U8
+func DownloadDASH(ctx context.Context, mpdURL string, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
+	fmt.Printf("开始下载 DASH: %s\n", mpdURL)
+
+	return withWorkDir(ctx, opts.WorkDir, outputFilename, func(dir string) (*Result, error) {
+		return downloadDASH(ctx, mpdURL, dir, outputFilename, opts, progressCallback)
+	})
+}
+
+func downloadDASH(ctx context.Context, mpdURL, tmpDir, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
+	client := opts.Client
+	m, baseURL, err := fetchMPD(ctx, client, mpdURL)
+	if err != nil {
+		return nil, fmt.Errorf("解析 MPD 文件失败: %v", err)
+	}
+	if m.Type == "dynamic" {
+		return nil, fmt.Errorf("暂不支持直播 DASH")
+	}
+
+	tracks, ext, err := buildDASHTracks(ctx, m, baseURL, tmpDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.clipping() {
+		if err := clipTracks(tracks, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// 分片封装决定输出容器，WebM 表示输出 WebM，其余输出 MP4
+	if !strings.EqualFold(filepath.Ext(outputFilename), ext) {
+		outputFilename = strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ext
+		fmt.Printf("DASH 分片输出为 %s: %s\n", ext, outputFilename)
+	}
+	for _, t := range tracks {
+		t.output = t.dir + ext
+	}
+
+	if err := downloadTracks(ctx, client, tracks, newKeyCache(client), opts.Pause, opts.Report, progressCallback); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("\n开始合并分片...")
+	gaps, origin := skipMissingTracks(tracks, opts.Report)
+	for _, t := range tracks {
+		if err := mergeFMP4(ctx, t.segments, t.dir, t.output); err != nil {
+			return nil, fmt.Errorf("合并轨道 %s 失败: %v", trackLabel(t), err)
+		}
+	}
+
+	result, err := muxDASHTracks(ctx, tracks, outputFilename)
+	if err != nil {
+		return nil, fmt.Errorf("封装音视频轨道失败: %v", err)
+	}
+	result.Gaps = outputGaps(gaps, origin, opts)
+	if err := trimClip(ctx, tmpDir, outputFilename, origin, opts); err != nil {
+		return nil, err
+	}
+	fmt.Printf("下载完成: %s\n", outputFilename)
+	return result, nil
+}
+
+// buildDASHTracks 在每个 Period 中选出视频和音频表示并生成分片，多个 Period 的分片按顺序接在同一轨道后面。
+// 第一个轨道是视频（清单只有音频时为第一条音轨），返回值 ext 为输出文件应使用的扩展名
+func buildDASHTracks(ctx context.Context, m *mpd, mpdURL *url.URL, tmpDir string, opts Options) ([]*track, string, error) {
+	rootURL, err := resolveBaseURL(mpdURL, m.BaseURL)
+	if err != nil {
+		return nil, "", err
+	}
+	durations := periodDurations(m)
+	client := opts.Client
+
+	var tracks []*track
+	ext := ".mp4"
+	for pi := range m.Periods {
+		period := &m.Periods[pi]
+		periodURL, err := resolveBaseURL(rootURL, period.BaseURL)
+		if err != nil {
+			return nil, "", err
+		}
+		reps, err := period.representations(periodURL)
+		if err != nil {
+			return nil, "", err
+		}
+		selected, err := selectRepresentations(reps, opts)
+		if err != nil {
+			return nil, "", fmt.Errorf("Period %d: %v", pi+1, err)
+		}
+
+		if tracks == nil {
+			for i, r := range selected {
+				t := &track{dir: filepath.Join(tmpDir, "video")}
+				if r.kind() == "audio" {
+					t.rendition = types.MediaRendition{Type: renditionAudio, Language: r.set.Lang, Name: r.set.Label}
+					t.dir = filepath.Join(tmpDir, fmt.Sprintf("audio_%d", i))
+				}
+				tracks = append(tracks, t)
+			}
+			if strings.HasSuffix(selected[0].mimeType(), "/webm") {
+				ext = ".webm"
+			}
+		} else if len(selected) != len(tracks) {
+			return nil, "", fmt.Errorf("各 Period 的音视频轨道数量不一致，无法拼接")
+		}
+
+		for i, r := range selected {
+			if err := appendRepresentation(ctx, client, tracks[i], r, durations[pi], pi); err != nil {
+				return nil, "", fmt.Errorf("生成 %s 分片失败: %v", trackLabel(tracks[i]), err)
+			}
+		}
+	}
+	return tracks, ext, nil
+}
+
+// appendRepresentation 把表示的分片接在轨道末尾。初始化分片与上一个 Period 相同时沿用，
+// 这样同一轨道的分片可以直接拼接
+func appendRepresentation(ctx context.Context, client *httpclient.Client, t *track, r dashRepresentation, periodDuration float64, period int) error {
+	init, segments, err := representationSegments(ctx, client, r, periodDuration)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("表示 %s 中没有分片", r.rep.ID)
+	}
+
+	if init != nil {
+		init.Filename = fmt.Sprintf("init_%02d.mp4", period)
+		if n := len(t.segments); n > 0 {
+			if prev := t.segments[n-1].Init; prev != nil && prev.URL == init.URL && prev.Offset == init.Offset && prev.Length == init.Length {
+				init = prev
+			}
+		}
+	}
+	for _, seg := range segments {
+		seg.Index = len(t.segments)
+		seg.Filename = fmt.Sprintf("segment_%05d.m4s", seg.Index)
+		seg.Init = init
+		t.segments = append(t.segments, seg)
+	}
+	return nil
+}
+
+// selectRepresentations 按 opts 的档位策略选出视频表示，按 opts.AudioLanguages 选出音频自适应集，
+// 每个音频自适应集再按档位策略选一个表示。未指定语言时使用 main 角色或第一个音频自适应集
+func selectRepresentations(reps []dashRepresentation, opts Options) ([]dashRepresentation, error) {
+	var videos []dashRepresentation
+	var variants []types.StreamVariant
+	var audioSets []*mpdAdaptationSet
+	audioReps := make(map[*mpdAdaptationSet][]dashRepresentation)
+	for _, r := range reps {
+		switch r.kind() {
+		case "video":
+			videos = append(videos, r)
+			variants = append(variants, types.StreamVariant{
+				Bandwidth:  r.rep.Bandwidth,
+				Resolution: fmt.Sprintf("%dx%d", r.rep.Width, r.rep.Height),
+				Width:      r.rep.Width,
+				Height:     r.rep.Height,
+				Codecs:     r.rep.Codecs,
+			})
+		case "audio":
+			if audioReps[r.set] == nil {
+				audioSets = append(audioSets, r.set)
+			}
+			audioReps[r.set] = append(audioReps[r.set], r)
+		}
+	}
+	if len(videos) == 0 && len(audioSets) == 0 {
+		return nil, fmt.Errorf("MPD 中没有可用的视频或音频表示")
+	}
+
+	var selected []dashRepresentation
+	if len(videos) > 0 {
+		i, err := selectVariantIndex(variants, opts)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("选择视频表示 %s: 带宽 %d, 分辨率 %s\n", videos[i].rep.ID, variants[i].Bandwidth, variants[i].Resolution)
+		selected = append(selected, videos[i])
+	}
+
+	for _, set := range selectAudioSets(audioSets, opts.AudioLanguages) {
+		candidates := audioReps[set]
+		bandwidths := make([]types.StreamVariant, len(candidates))
+		for i, r := range candidates {
+			bandwidths[i] = types.StreamVariant{Bandwidth: r.rep.Bandwidth}
+		}
+		i, err := selectVariantIndex(bandwidths, opts)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, candidates[i])
+	}
+
+	for _, r := range selected {
+		if r.protected() {
+			return nil, fmt.Errorf("表示 %s 受 DRM 保护，无法下载", r.rep.ID)
+		}
+	}
+	return selected, nil
+}
+
+func selectAudioSets(sets []*mpdAdaptationSet, languages []string) []*mpdAdaptationSet {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	var picked []*mpdAdaptationSet
+	seen := make(map[*mpdAdaptationSet]bool)
+	for _, lang := range languages {
+		for _, set := range sets {
+			if seen[set] || !matchRendition(types.MediaRendition{Language: set.Lang, Name: set.Label}, lang) {
+				continue
+			}
+			picked = append(picked, set)
+			seen[set] = true
+			if !strings.EqualFold(lang, "all") {
+				break
+			}
+		}
+	}
+	if len(picked) > 0 {
+		return picked
+	}
+	if len(languages) > 0 {
+		fmt.Println("未找到指定语言的音轨，使用默认音轨")
+	}
+
+	for _, set := range sets {
+		for _, role := range set.Roles {
+			if role.Value == "main" {
+				return []*mpdAdaptationSet{set}
+			}
+		}
+	}
+	return sets[:1]
+}
+
+// muxDASHTracks 把各轨道封装为输出文件：优先使用原生的分片 MP4 封装，轨道结构不支持时交给 ffmpeg；
+// 没有 ffmpeg 时输出视频轨道，音频轨道单独保存并记入 Result
+func muxDASHTracks(ctx context.Context, tracks []*track, outputFilename string) (*Result, error) {
+	result := &Result{OutputFilename: outputFilename}
+	if len(tracks) == 1 {
+		return result, moveFile(tracks[0].output, outputFilename)
+	}
+
+	inputs := make([]string, len(tracks))
+	for i, t := range tracks {
+		inputs[i] = t.output
+	}
+	err := remux.MuxFragmented(ctx, inputs, outputFilename)
+	if err == nil {
+		fmt.Printf("使用原生封装合并 %d 条轨道\n", len(tracks))
+		return result, nil
+	}
+	os.Remove(outputFilename)
+	if !errors.Is(err, remux.ErrUnsupportedLayout) {
+		return nil, err
+	}
+	fmt.Printf("原生封装不支持该轨道结构 (%v)，改用 ffmpeg\n", err)
+
+	var renditions []types.RenditionFile
+	for _, t := range tracks[1:] {
+		path := t.output
+		if !FFmpegAvailable() {
+			path = renditionPath(outputFilename, t.rendition, "")
+			if err := moveFile(t.output, path); err != nil {
+				return nil, err
+			}
+		}
+		renditions = append(renditions, types.RenditionFile{
+			Type:     t.rendition.Type,
+			Language: t.rendition.Language,
+			Name:     t.rendition.Name,
+			Path:     path,
+		})
+	}
+	if !FFmpegAvailable() {
+		result.Renditions = renditions
+	}
+	return result, muxRenditions(ctx, tracks[0].output, renditions, outputFilename)
+}
@@ -0,0 +1,559 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+const (
+	directChunkSize   = 4 << 20 // 每个 Range 请求的字节数
+	directConnections = 4       // 同时使用的连接数
+
+	// directSourceFilename 记录工作目录中的分块来自哪个远端文件，远端文件变化后已下载的分块作废
+	directSourceFilename = "source.json"
+	// directPartialFilename 是单连接下载时写入的未完成文件，失败后保留以便续传
+	directPartialFilename = "stream.part"
+)
+
+// directExtensions 按扩展名即可确定为单个媒体文件的 URL
+var directExtensions = []string{".mp4", ".m4v", ".m4a", ".webm", ".mkv", ".mov", ".flv", ".avi", ".mp3"}
+
+// directContentTypes 单个媒体文件的 Content-Type 与扩展名
+var directContentTypes = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/x-matroska": ".mkv",
+	"video/quicktime":  ".mov",
+	"video/x-flv":      ".flv",
+	"video/x-msvideo":  ".avi",
+	"audio/mp4":        ".m4a",
+	"audio/webm":       ".webm",
+	"audio/mpeg":       ".mp3",
+}
+
+// remoteFile 是探测到的远端文件
+type remoteFile struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`   // 未知时为 -1
+	Ranges       bool   `json:"ranges"` // 服务器支持 Range 请求且文件大小已知
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"-"`
+	Partial      bool   `json:"-"` // 探测请求返回了 206，不能分块时仍可尝试续传
+}
+
+// fileDownloader 是 Registry 中的直接下载器
+type fileDownloader struct{}
+
+func (fileDownloader) Name() string {
+	return "直接下载"
+}
+
+// Probe 接受 Content-Type 为任意视频或音频类型的资源
+func (fileDownloader) Probe(ctx context.Context, client *httpclient.Client, fileURL string) (bool, error) {
+	contentType, err := fetchContentType(ctx, client, fileURL)
+	if err != nil {
+		return false, err
+	}
+	mt := mediaType(contentType)
+	return strings.HasPrefix(mt, "video/") || strings.HasPrefix(mt, "audio/"), nil
+}
+
+func (fileDownloader) Download(ctx context.Context, fileURL, outputFilename string, opts Options, emit func(Event)) (*Result, error) {
+	return DownloadFile(ctx, fileURL, outputFilename, opts, progressEvents(emit))
+}
+
+// DownloadFile 直接下载单个媒体文件，不做转封装，输出文件的扩展名按源文件调整。
+// 服务器支持 Range 时分块并发下载，分块保存在 opts.WorkDir 并记入清单，重新调用会跳过已完成的分块；
+// 不支持时单连接顺序下载，失败后重新调用会尽量从已下载的位置续传。工作目录与 ctx 取消的处理同 DownloadM3U8
+func DownloadFile(ctx context.Context, fileURL string, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
+	fmt.Printf("开始直接下载: %s\n", fileURL)
+
+	return withWorkDir(ctx, opts.WorkDir, outputFilename, func(dir string) (*Result, error) {
+		return downloadFile(ctx, fileURL, dir, outputFilename, opts, progressCallback)
+	})
+}
+
+func downloadFile(ctx context.Context, fileURL, dir, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
+	client := opts.Client
+	if opts.clipping() {
+		fmt.Println("直接下载不支持时间范围，忽略 start/end")
+	}
+	rf, resp, err := probeFile(ctx, client, fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	outputFilename = directOutputFilename(outputFilename, fileURL, rf.ContentType)
+	result := &Result{OutputFilename: outputFilename}
+
+	if err := checkSource(dir, rf); err != nil {
+		return nil, err
+	}
+	if !rf.Ranges {
+		if err := streamResumable(ctx, client, rf, resp.Body, dir, outputFilename, opts.Pause, progressCallback); err != nil {
+			return nil, err
+		}
+		fmt.Printf("\n下载完成: %s\n", outputFilename)
+		return result, nil
+	}
+	resp.Body.Close()
+
+	chunks := splitChunks(rf)
+	fmt.Printf("文件大小 %d 字节，分为 %d 块，%d 个连接\n", rf.Size, len(chunks), directConnections)
+
+	if err := downloadChunks(ctx, client, rf, chunks, dir, opts.Pause, progressCallback); err != nil {
+		return nil, fmt.Errorf("下载文件失败: %v", err)
+	}
+	if err := joinChunks(ctx, chunks, dir, outputFilename); err != nil {
+		os.Remove(outputFilename)
+		return nil, fmt.Errorf("合并分块失败: %v", err)
+	}
+
+	fmt.Printf("\n下载完成: %s\n", outputFilename)
+	return result, nil
+}
+
+// probeFile 请求文件的第一个字节。服务器返回 206 时据 Content-Range 得到文件大小；
+// 返回 200 说明不支持 Range，响应体就是完整文件，由调用方继续读取或关闭
+func probeFile(ctx context.Context, client *httpclient.Client, fileURL string) (*remoteFile, *http.Response, error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, fileURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("请求文件失败: %v", err)
+	}
+
+	rf := &remoteFile{
+		URL:          fileURL,
+		Size:         -1,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		rf.Partial = true
+		var start, end int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &rf.Size); err != nil || start != 0 {
+			rf.Size = -1
+		}
+		rf.Ranges = rf.Size > 0 && resp.Header.Get("Accept-Ranges") != "none"
+		if !rf.Ranges {
+			// 无法分块时重新请求完整文件
+			resp.Body.Close()
+			req.Header.Del("Range")
+			if resp, err = client.Do(req, 0); err != nil {
+				return nil, nil, fmt.Errorf("请求文件失败: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return nil, nil, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+			}
+			rf.Size = resp.ContentLength
+		}
+	case http.StatusOK:
+		rf.Size = resp.ContentLength
+	default:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+	return rf, resp, nil
+}
+
+// checkSource 确认工作目录中已有的分块来自同一个远端文件，不一致时清空工作目录
+func checkSource(dir string, rf *remoteFile) error {
+	sourcePath := filepath.Join(dir, directSourceFilename)
+
+	var prev remoteFile
+	if data, err := os.ReadFile(sourcePath); err == nil && json.Unmarshal(data, &prev) == nil {
+		if prev.URL != rf.URL || prev.Size != rf.Size || prev.ETag != rf.ETag || prev.LastModified != rf.LastModified {
+			fmt.Println("远端文件已变化，重新下载全部分块")
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				os.RemoveAll(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	data, err := json.Marshal(rf)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		return fmt.Errorf("写入工作目录失败: %v", err)
+	}
+	return nil
+}
+
+// splitChunks 把文件按 directChunkSize 切分为带字节范围的分块
+func splitChunks(rf *remoteFile) []segment {
+	var chunks []segment
+	for offset := int64(0); offset < rf.Size; offset += directChunkSize {
+		chunks = append(chunks, segment{
+			URL:      rf.URL,
+			Index:    len(chunks),
+			Filename: fmt.Sprintf("chunk_%05d", len(chunks)),
+			Offset:   offset,
+			Length:   min(directChunkSize, rf.Size-offset),
+		})
+	}
+	return chunks
+}
+
+// downloadChunks 并发下载分块，清单中已记录且校验通过的分块直接计为完成；
+// 进度按实际字节每 500ms 报告一次，gate 暂停期间不再开始新的分块
+func downloadChunks(ctx context.Context, client *httpclient.Client, rf *remoteFile, chunks []segment, dir string, gate *PauseGate, progressCallback func(ProgressInfo)) error {
+	m, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	var downloadedBytes, completed atomic.Int64
+	report := func() {
+		info := ProgressInfo{
+			Downloaded:      int(completed.Load()),
+			Total:           len(chunks),
+			DownloadedBytes: downloadedBytes.Load(),
+			TotalBytes:      rf.Size,
+		}
+		fmt.Printf("\r下载进度: %d/%d 字节 (%.1f%%)", info.DownloadedBytes, info.TotalBytes,
+			float64(info.DownloadedBytes)/float64(info.TotalBytes)*100)
+		if progressCallback != nil {
+			progressCallback(info)
+		}
+	}
+
+	stop := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	semaphore := make(chan struct{}, directConnections)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var downloadError error
+	skipped := 0
+
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func(c segment) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			if gate.wait(ctx) != nil {
+				return
+			}
+
+			if m.complete(c) {
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+				downloadedBytes.Add(c.Length)
+			} else if err := downloadChunk(ctx, client, c, dir, m, &downloadedBytes); err != nil {
+				mu.Lock()
+				if downloadError == nil {
+					downloadError = fmt.Errorf("下载分块 %s 失败: %v", c.Filename, err)
+				}
+				mu.Unlock()
+				return
+			}
+			completed.Add(1)
+		}(chunk)
+	}
+
+	wg.Wait()
+	close(stop)
+	<-reporterDone
+	report()
+
+	if skipped > 0 {
+		fmt.Printf("\n跳过 %d 个已完成的分块\n", skipped)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return downloadError
+}
+
+// downloadChunk 下载单个分块，失败时最多重试 3 次，失败请求已计入进度的字节会被扣除
+func downloadChunk(ctx context.Context, client *httpclient.Client, c segment, dir string, m *manifest, downloadedBytes *atomic.Int64) error {
+	var err error
+	for retries := 0; retries < 3; retries++ {
+		var n int64
+		n, err = fetchChunk(ctx, client, c, dir, m, downloadedBytes)
+		if err == nil {
+			return nil
+		}
+		downloadedBytes.Add(-n)
+		if retries < 2 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(retries+1) * time.Second):
+			}
+		}
+	}
+	return err
+}
+
+// fetchChunk 请求分块的字节范围并写入工作目录，返回已读取的字节数
+func fetchChunk(ctx context.Context, client *httpclient.Client, c segment, dir string, m *manifest, downloadedBytes *atomic.Int64) (int64, error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, c.URL)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.Offset, c.Offset+c.Length-1))
+
+	resp, err := client.Do(req, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+	if err := checkContentRange(resp.Header.Get("Content-Range"), c.Offset); err != nil {
+		return 0, err
+	}
+
+	r := &chunkReader{r: resp.Body, remaining: c.Length, total: downloadedBytes}
+	err = writeSegmentFile(c, r, dir, m, nil)
+	return r.read, err
+}
+
+// chunkReader 读取分块并累计进度，响应提前结束时返回 io.ErrUnexpectedEOF，避免不完整的分块被记入清单
+type chunkReader struct {
+	r         io.Reader
+	remaining int64
+	read      int64
+	total     *atomic.Int64
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	cr.read += int64(n)
+	cr.total.Add(int64(n))
+	if err == io.EOF && cr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// streamResumable 单连接下载无法分块的文件。数据先写入工作目录中的 directPartialFilename，
+// 失败时保留；重新调用时用 Range 请求接着已有的部分下载，服务器不接受时从头下载 body
+func streamResumable(ctx context.Context, client *httpclient.Client, rf *remoteFile, body io.Reader, dir, outputFilename string, gate *PauseGate, progressCallback func(ProgressInfo)) error {
+	partial := filepath.Join(dir, directPartialFilename)
+	resumable := rf.Partial
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+	switch {
+	case offset > 0 && offset == rf.Size:
+		return moveFile(partial, outputFilename)
+	case offset > 0:
+		// 探测请求返回 200 的服务器忽略 Range，不必再尝试
+		var resp *http.Response
+		if resumable {
+			resp = resumeFile(ctx, client, rf.URL, offset)
+		}
+		if resp != nil {
+			defer resp.Body.Close()
+			body = resp.Body
+			fmt.Printf("服务器不支持分块下载，从 %d 字节处继续单连接下载\n", offset)
+		} else {
+			fmt.Println("服务器不支持断点续传，从头重新下载")
+			offset = 0
+			resumable = false
+		}
+	default:
+		fmt.Println("服务器不支持分块下载，使用单连接下载")
+	}
+
+	if err := streamFile(ctx, body, rf.Size, offset, partial, gate, progressCallback); err != nil {
+		if !resumable {
+			return fmt.Errorf("%v（服务器不支持断点续传，重试时将从头下载）", err)
+		}
+		return err
+	}
+	return moveFile(partial, outputFilename)
+}
+
+// resumeFile 请求 offset 之后的数据，服务器按请求返回 206 时返回响应，否则返回 nil
+func resumeFile(ctx context.Context, client *httpclient.Client, fileURL string, offset int64) *http.Response {
+	req, err := client.NewRequest(ctx, http.MethodGet, fileURL)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := client.Do(req, 0)
+	if err != nil {
+		return nil
+	}
+	if resp.StatusCode != http.StatusPartialContent || checkContentRange(resp.Header.Get("Content-Range"), offset) != nil {
+		resp.Body.Close()
+		return nil
+	}
+	return resp
+}
+
+// streamFile 单连接顺序写入文件，offset 之前的数据已在文件中；暂停期间停止读取响应体
+func streamFile(ctx context.Context, body io.Reader, size, offset int64, outputFilename string, gate *PauseGate, progressCallback func(ProgressInfo)) error {
+	out, err := os.OpenFile(outputFilename, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+	if err := out.Truncate(offset); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+
+	report := func(written int64) {
+		info := ProgressInfo{DownloadedBytes: written, TotalBytes: max(size, 0)}
+		fmt.Printf("\r下载进度: %d 字节", written)
+		if progressCallback != nil {
+			progressCallback(info)
+		}
+	}
+
+	buf := make([]byte, 256<<10)
+	written := offset
+	var lastReport time.Time
+	for {
+		if err := gate.wait(ctx); err != nil {
+			return err
+		}
+
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return fmt.Errorf("写入输出文件失败: %v", err)
+			}
+			written += int64(n)
+		}
+		if time.Since(lastReport) >= 500*time.Millisecond {
+			report(written)
+			lastReport = time.Now()
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("下载文件失败: %v", readErr)
+		}
+	}
+	report(written)
+
+	if size > 0 && written != size {
+		return fmt.Errorf("文件不完整: 收到 %d 字节，应为 %d 字节", written, size)
+	}
+	return out.Close()
+}
+
+// joinChunks 按顺序拼接分块
+func joinChunks(ctx context.Context, chunks []segment, dir, outputFilename string) error {
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+
+	for _, c := range chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, c.Filename))
+		if err != nil {
+			return fmt.Errorf("分块 %s 不存在", c.Filename)
+		}
+		_, err = io.Copy(out, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("写入输出文件失败: %v", err)
+		}
+	}
+	return out.Close()
+}
+
+// directOutputFilename 把输出文件的扩展名改为源文件的格式，无法确定格式时保持不变
+func directOutputFilename(outputFilename, fileURL, contentType string) string {
+	ext := urlExtension(fileURL)
+	if !slices.Contains(directExtensions, ext) {
+		ext = directContentTypes[mediaType(contentType)]
+	}
+	if ext == "" || strings.EqualFold(filepath.Ext(outputFilename), ext) {
+		return outputFilename
+	}
+
+	outputFilename = strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ext
+	fmt.Printf("按源文件格式输出: %s\n", outputFilename)
+	return outputFilename
+}
+
+// urlExtension 返回 URL 路径的小写扩展名，忽略查询参数
+func urlExtension(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(path.Ext(u.Path))
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
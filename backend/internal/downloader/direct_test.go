@@ -0,0 +1,218 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer 支持 Range 请求，记录每个请求的 Range 头
+type rangeServer struct {
+	data   []byte
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.mu.Unlock()
+	http.ServeContent(w, r, "video.mp4", time.Unix(0, 0), bytes.NewReader(s.data))
+}
+
+func (s *rangeServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func TestDownloadFileResumesChunks(t *testing.T) {
+	data := make([]byte, 2*directChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	rs := &rangeServer{data: data}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	fileURL := server.URL + "/video.mp4"
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out.mp4")
+
+	if _, err := downloadFile(context.Background(), fileURL, dir, out, Options{}, nil); err != nil {
+		t.Fatalf("downloadFile: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Fatal("输出与源文件不一致")
+	}
+	if got := len(rs.requests()); got != 4 {
+		t.Fatalf("首次下载发出 %d 个请求, 期望探测 1 个加分块 3 个", got)
+	}
+
+	// 第二块只写了一半，重新下载时只请求这一块
+	if err := os.Truncate(filepath.Join(dir, "chunk_00001"), 100); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(out)
+	rs.ranges = nil
+
+	if _, err := downloadFile(context.Background(), fileURL, dir, out, Options{}, nil); err != nil {
+		t.Fatalf("续传: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Fatal("续传后的输出与源文件不一致")
+	}
+	want := []string{"bytes=0-0", "bytes=4194304-8388607"}
+	if got := rs.requests(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("续传的请求 = %v, 期望 %v", got, want)
+	}
+}
+
+func TestDownloadFileWithoutRanges(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/webm")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	out := filepath.Join(t.TempDir(), "out.mp4")
+	result, err := downloadFile(context.Background(), server.URL+"/watch", t.TempDir(), out, Options{}, nil)
+	if err != nil {
+		t.Fatalf("downloadFile: %v", err)
+	}
+	if want := strings.TrimSuffix(out, ".mp4") + ".webm"; result.OutputFilename != want {
+		t.Fatalf("输出文件 = %s, 期望 %s", result.OutputFilename, want)
+	}
+	if got, _ := os.ReadFile(result.OutputFilename); !bytes.Equal(got, data) {
+		t.Fatal("输出与源文件不一致")
+	}
+}
+
+// flakyStreamServer 不给出文件大小，无法分块下载；第一次返回完整文件时只发送一半数据就断开连接
+type flakyStreamServer struct {
+	data         []byte
+	honourRanges bool // 是否仍然按 Range 请求返回 206
+	mu           sync.Mutex
+	ranges       []string
+	full         int
+}
+
+func (s *flakyStreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rangeHeader := r.Header.Get("Range")
+	partial := s.honourRanges && rangeHeader != ""
+	s.mu.Lock()
+	s.ranges = append(s.ranges, rangeHeader)
+	if !partial {
+		s.full++
+	}
+	full := s.full
+	s.mu.Unlock()
+
+	var start int64
+	if partial {
+		fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+		// 大小未知的 Content-Range，无法分块
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, len(s.data)-1))
+		w.WriteHeader(http.StatusPartialContent)
+		if rangeHeader == "bytes=0-0" {
+			w.Write(s.data[:1])
+			return
+		}
+		w.Write(s.data[start:])
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+	if full == 1 {
+		w.Write(s.data[:len(s.data)/2])
+		// 中途断开连接
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(s.data)
+}
+
+func TestStreamFileResume(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	tests := []struct {
+		name         string
+		honourRanges bool
+		wantResume   string // 第二次下载发出的续传请求，为空表示从头下载
+	}{
+		{"ranges honoured", true, fmt.Sprintf("bytes=%d-", len(data)/2)},
+		{"ranges ignored", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &flakyStreamServer{data: data, honourRanges: tt.honourRanges}
+			server := httptest.NewServer(fs)
+			defer server.Close()
+
+			dir := t.TempDir()
+			out := filepath.Join(t.TempDir(), "out.mp4")
+			_, err := downloadFile(context.Background(), server.URL+"/video.mp4", dir, out, Options{}, nil)
+			if err == nil {
+				t.Fatal("连接断开时期望返回错误")
+			}
+			if cannotResume := strings.Contains(err.Error(), "不支持断点续传"); cannotResume == tt.honourRanges {
+				t.Errorf("错误信息 = %v", err)
+			}
+			if info, err := os.Stat(filepath.Join(dir, directPartialFilename)); err != nil || info.Size() == 0 {
+				t.Fatal("失败后应保留已下载的部分")
+			}
+
+			if _, err := downloadFile(context.Background(), server.URL+"/video.mp4", dir, out, Options{}, nil); err != nil {
+				t.Fatalf("重新下载: %v", err)
+			}
+			if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+				t.Fatal("输出与源文件不一致")
+			}
+			requests := fs.ranges
+			resumed := slices.Contains(requests, tt.wantResume)
+			if tt.wantResume != "" && !resumed {
+				t.Errorf("请求 = %q, 期望包含续传请求 %s", requests, tt.wantResume)
+			}
+			if tt.wantResume == "" && fs.full != 2 {
+				t.Errorf("完整请求 %d 次, 期望从头下载 2 次", fs.full)
+			}
+		})
+	}
+}
+
+func TestCheckSourceChanged(t *testing.T) {
+	dir := t.TempDir()
+	rf := &remoteFile{URL: "http://example.com/a.mp4", Size: 10, Ranges: true, ETag: `"1"`}
+	if err := checkSource(dir, rf); err != nil {
+		t.Fatal(err)
+	}
+	chunk := filepath.Join(dir, "chunk_00000")
+	os.WriteFile(chunk, []byte("old"), 0644)
+
+	if err := checkSource(dir, rf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(chunk); err != nil {
+		t.Fatal("远端文件未变化时不应删除分块")
+	}
+
+	changed := *rf
+	changed.ETag = `"2"`
+	if err := checkSource(dir, &changed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(chunk); !os.IsNotExist(err) {
+		t.Fatal("远端文件变化后应删除分块")
+	}
+}
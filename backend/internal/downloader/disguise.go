@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"videoDownload/internal/remux"
+)
+
+const (
+	// disguiseSniffSize 是查找真实分片数据的范围，伪装的图片头通常只有几百字节
+	disguiseSniffSize = 256 * 1024
+	// disguiseConfirmPackets 确认 TS 起点需要连续出现的同步字节数，图片数据中偶然出现的 0x47 不会被误判
+	disguiseConfirmPackets = 5
+)
+
+// imageSignatures 是伪装分片常用的图片文件头
+var imageSignatures = []struct {
+	name  string
+	magic []byte
+}{
+	{"PNG", []byte("\x89PNG\r\n\x1a\n")},
+	{"JPEG", []byte{0xFF, 0xD8, 0xFF}},
+	{"GIF", []byte("GIF8")},
+	{"BMP", []byte("BM")},
+}
+
+// fmp4BoxTypes 是 fMP4 初始化分片和媒体片段可能的第一个 box
+var fmp4BoxTypes = [][]byte{[]byte("ftyp"), []byte("styp"), []byte("moof"), []byte("sidx")}
+
+// unwrapSegment 检查分片开头，以图片文件头开头时去掉 TS 同步点或 fMP4 box 之前的全部数据。
+// 只处理图片文件头，字幕等其他分片原样返回
+func unwrapSegment(seg segment, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, disguiseSniffSize)
+	head, err := br.Peek(disguiseSniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("读取分片 %s 失败: %v", seg.Filename, err)
+	}
+
+	image := imageSignature(head)
+	if image == "" {
+		return br, nil
+	}
+	start := mediaStart(head)
+	if start < 0 {
+		return nil, fmt.Errorf("分片 %s 以 %s 图片头开头，但前 %d 字节中没有 TS 或 fMP4 数据", seg.Filename, image, len(head))
+	}
+
+	fmt.Printf("\n分片 %s 伪装为 %s 图片，去掉开头 %d 字节\n", seg.Filename, image, start)
+	if _, err := br.Discard(start); err != nil {
+		return nil, fmt.Errorf("读取分片 %s 失败: %v", seg.Filename, err)
+	}
+	return br, nil
+}
+
+func imageSignature(head []byte) string {
+	for _, sig := range imageSignatures {
+		if bytes.HasPrefix(head, sig.magic) {
+			return sig.name
+		}
+	}
+	return ""
+}
+
+// mediaStart 返回第一个 TS 同步点或 fMP4 box 的位置，找不到时返回 -1
+func mediaStart(data []byte) int {
+	for i := range data {
+		if data[i] == remux.SyncByte && tsSyncAt(data, i) {
+			return i
+		}
+		if i >= 4 && fmp4BoxAt(data, i-4) {
+			return i - 4
+		}
+	}
+	return -1
+}
+
+// tsSyncAt 报告从 pos 开始是否有连续的 TS 包，数据不足 disguiseConfirmPackets 个包时检查剩余的完整包
+func tsSyncAt(data []byte, pos int) bool {
+	packets := min(disguiseConfirmPackets, (len(data)-pos)/remux.PacketSize)
+	if packets == 0 {
+		return false
+	}
+	for n := 1; n < packets; n++ {
+		if data[pos+n*remux.PacketSize] != remux.SyncByte {
+			return false
+		}
+	}
+	return true
+}
+
+// fmp4BoxAt 报告 pos 处是否为常见的 fMP4 顶层 box
+func fmp4BoxAt(data []byte, pos int) bool {
+	if pos+8 > len(data) {
+		return false
+	}
+	size := int(data[pos])<<24 | int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+	if size < 8 && size != 1 {
+		return false
+	}
+	for _, typ := range fmp4BoxTypes {
+		if bytes.Equal(data[pos+4:pos+8], typ) {
+			return true
+		}
+	}
+	return false
+}
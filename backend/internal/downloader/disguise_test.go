@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"videoDownload/internal/remux"
+)
+
+func TestUnwrapSegment(t *testing.T) {
+	ts := bytes.Repeat(tsPacket(0x100, 0, true), disguiseConfirmPackets+1)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	// 图片数据中偶然出现的同步字节不应被当作 TS 起点
+	noise := append([]byte{remux.SyncByte, 1, 2, 3}, make([]byte, 300)...)
+	fmp4 := append([]byte{0, 0, 0, 16}, []byte("ftypisom\x00\x00\x00\x01")...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"plain ts", ts, ts, false},
+		{"png before ts", bytes.Join([][]byte{png, noise, ts}, nil), ts, false},
+		{"jpeg before fmp4", bytes.Join([][]byte{{0xFF, 0xD8, 0xFF, 0xE0}, make([]byte, 50), fmp4}, nil), fmp4, false},
+		{"subtitles untouched", []byte("WEBVTT\n\n"), []byte("WEBVTT\n\n"), false},
+		{"image only", append(png, make([]byte, 1000)...), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := unwrapSegment(segment{Filename: "segment_0000.ts"}, bytes.NewReader(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unwrapSegment: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("输出 %d 字节, 期望 %d 字节", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestUnwrapSegmentLarge(t *testing.T) {
+	// 真实数据超过探测范围时仍然完整输出
+	ts := bytes.Repeat(tsPacket(0x100, 0, true), 2*disguiseSniffSize/remux.PacketSize)
+	data := append([]byte("GIF89a"+strings.Repeat("x", 100)), ts...)
+	r, err := unwrapSegment(segment{Filename: "segment_0000.ts"}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unwrapSegment: %v", err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, ts) {
+		t.Errorf("输出 %d 字节, 期望 %d 字节", len(got), len(ts))
+	}
+}
@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/remux"
+)
+
+func hasInitSegments(segments []segment) bool {
+	for _, seg := range segments {
+		if seg.Init != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadInitSegments 下载所有 #EXT-X-MAP 初始化分片，同一个初始化分片只下载一次
+func downloadInitSegments(ctx context.Context, client *httpclient.Client, segments []segment, tmpDir string, keys *keyCache, report *IntegrityReport) error {
+	m, err := loadManifest(tmpDir)
+	if err != nil {
+		return err
+	}
+	seen := make(map[*segment]bool)
+
+	for _, seg := range segments {
+		if seg.Init == nil || seen[seg.Init] {
+			continue
+		}
+		seen[seg.Init] = true
+
+		if m.complete(*seg.Init) {
+			continue
+		}
+		if err := downloadWithRetry(ctx, client, *seg.Init, tmpDir, keys, m, nil, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeFMP4 将初始化分片和 .m4s 片段拼接为 MP4。
+// 片段按初始化分片分组（不连续点之后可能切换 #EXT-X-MAP），只有一组时直接拼接到输出文件，
+// 多组时每组先拼接为独立的 MP4，再交给 ffmpeg 合并。安装了 ffmpeg 时不连续点也作为分组边界，
+// 由 ffmpeg 接续各组的时间戳并留出缺失分片的空白；直接拼接时片段保留原有的 tfdt，空白自然保留
+func mergeFMP4(ctx context.Context, segments []segment, tmpDir, outputFilename string) error {
+	if len(segments) == 0 {
+		return fmt.Errorf("没有可合并的分片")
+	}
+	splitDiscontinuities := FFmpegAvailable()
+	var groups [][]segment
+	for i, seg := range segments {
+		if i == 0 || seg.Init != segments[i-1].Init ||
+			(splitDiscontinuities && seg.Discontinuity != segments[i-1].Discontinuity) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], seg)
+	}
+
+	if len(groups) == 1 {
+		return concatFMP4Group(ctx, groups[0], tmpDir, outputFilename)
+	}
+
+	fmt.Printf("初始化分片切换或时间戳不连续，共 %d 段\n", len(groups))
+
+	var parts []string
+	var durations []float64
+	var discontinuities []remux.Discontinuity
+	for i, group := range groups {
+		ext := ".mp4"
+		if group[0].Init == nil {
+			ext = ".ts"
+		}
+		partPath := filepath.Join(tmpDir, fmt.Sprintf("part_%02d%s", i, ext))
+		if err := concatFMP4Group(ctx, group, tmpDir, partPath); err != nil {
+			return err
+		}
+		parts = append(parts, partPath)
+
+		var duration float64
+		for _, seg := range group {
+			duration += seg.Duration
+		}
+		durations = append(durations, duration)
+		if group[0].Gap > 0 {
+			discontinuities = append(discontinuities, remux.Discontinuity{Input: i, Gap: group[0].gap()})
+		}
+	}
+
+	// 各段的初始化信息或时间戳不同，只能交给 ffmpeg 重新封装
+	merger := &ffmpegMerger{listDir: tmpDir, discontinuities: discontinuities, durations: durations}
+	return merger.Merge(ctx, parts, outputFilename)
+}
+
+// concatFMP4Group 按顺序写入初始化分片和同组的全部片段，得到一个可播放的分片 MP4
+func concatFMP4Group(ctx context.Context, group []segment, tmpDir, outputFilename string) error {
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+
+	files := make([]string, 0, len(group)+1)
+	if group[0].Init != nil {
+		files = append(files, group[0].Init.Filename)
+	}
+	for _, seg := range group {
+		files = append(files, seg.Filename)
+	}
+
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := appendFile(out, filepath.Join(tmpDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+func appendFile(dst io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("分片文件 %s 不存在", filepath.Base(path))
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("写入分片 %s 失败: %v", filepath.Base(path), err)
+	}
+	return nil
+}
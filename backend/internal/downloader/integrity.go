@@ -0,0 +1,250 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"videoDownload/internal/remux"
+	"videoDownload/internal/types"
+)
+
+// minSegmentSize 是媒体分片的最小字节数，即一个 TS 包；WebVTT 字幕分片不受限制
+const minSegmentSize = remux.PacketSize
+
+// segmentCheck 在分片写入时校验内容，通过 finish 判断分片是否完整可用：
+// 响应体字节数与 Content-Length 一致，不是 HTML 错误页，不小于 minSegmentSize，
+// TS 分片每 188 字节都是同步字节且没有不完整的包
+type segmentCheck struct {
+	seg      segment
+	expected int64           // 响应体应有的字节数，-1 表示未知
+	received *countingReader // 实际读取的响应体，解密和去除伪装之前
+	tsURL    bool            // 分片地址以 .ts 结尾
+
+	size int64
+	head []byte // 开头的数据，用于识别内容类型
+	ts   bool   // 按 TS 包校验
+	err  error  // 写入过程中发现的第一个错误
+}
+
+func newSegmentCheck(seg segment, contentLength int64, received *countingReader) *segmentCheck {
+	expected := contentLength
+	if seg.Length > 0 {
+		expected = seg.Length
+	}
+	c := &segmentCheck{seg: seg, expected: expected, received: received}
+	if u, err := url.Parse(seg.URL); err == nil {
+		c.tsURL = strings.EqualFold(path.Ext(u.Path), ".ts")
+	}
+	return c
+}
+
+func (c *segmentCheck) Write(p []byte) (int, error) {
+	if c.size == 0 && len(p) > 0 {
+		c.ts = p[0] == remux.SyncByte
+		if c.tsURL && !c.ts {
+			c.fail("不是有效的 MPEG-TS 数据")
+		}
+	}
+	if n := 512 - len(c.head); n > 0 {
+		c.head = append(c.head, p[:min(n, len(p))]...)
+	}
+
+	if c.ts && c.err == nil {
+		// 下一个包头在 p 中的位置
+		for i := (remux.PacketSize - int(c.size%remux.PacketSize)) % remux.PacketSize; i < len(p); i += remux.PacketSize {
+			if p[i] != remux.SyncByte {
+				c.fail(fmt.Sprintf("第 %d 字节处缺少 TS 同步字节", c.size+int64(i)))
+				break
+			}
+		}
+	}
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+func (c *segmentCheck) fail(reason string) {
+	if c.err == nil {
+		c.err = fmt.Errorf("分片 %s 校验失败: %s", c.seg.Filename, reason)
+	}
+}
+
+// finish 在分片写入完成后返回校验结果
+func (c *segmentCheck) finish() error {
+	if c.expected >= 0 && c.received.read != c.expected {
+		c.fail(fmt.Sprintf("响应体不完整，收到 %d / %d 字节", c.received.read, c.expected))
+	}
+	if isHTML(c.head) {
+		// HTML 错误页优先于其他原因报告
+		c.err = nil
+		c.fail("服务器返回了 HTML 页面")
+	}
+
+	text := bytes.HasPrefix(bytes.TrimPrefix(c.head, []byte("\xef\xbb\xbf")), []byte("WEBVTT"))
+	switch {
+	case c.size == 0:
+		c.fail("文件为空")
+	case !text && c.size < minSegmentSize:
+		c.fail(fmt.Sprintf("只有 %d 字节", c.size))
+	case c.ts && c.size%remux.PacketSize != 0:
+		c.fail(fmt.Sprintf("最后一个 TS 包不完整 (%d 字节)", c.size%remux.PacketSize))
+	}
+	return c.err
+}
+
+func isHTML(head []byte) bool {
+	s := strings.ToLower(strings.TrimSpace(string(head)))
+	return strings.HasPrefix(s, "<!doctype html") || strings.HasPrefix(s, "<html")
+}
+
+// IntegrityReport 汇总一个任务中重新下载后修复的分片和最终仍然失败的分片，
+// 并按上限允许部分分片缺失。nil 的 *IntegrityReport 不记录，也不允许缺失
+type IntegrityReport struct {
+	// 允许缺失的分片数和总时长，都为 0 时任一分片失败都会使下载失败，都设置时需同时满足
+	MaxMissingSegments int
+	MaxMissingDuration time.Duration
+
+	mu              sync.Mutex
+	report          types.SegmentReport
+	missing         map[string]bool // 按 missingKey 记录允许缺失的分片
+	missingDuration float64
+}
+
+// record 记录需要重试的分片：ok 表示最后一次下载成功，reason 为第一次失败（修复）或最后一次失败（仍然失败）的原因
+func (r *IntegrityReport) record(seg segment, attempts int, reason error, ok bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	issue := types.SegmentIssue{
+		Segment:  seg.Filename,
+		URL:      seg.URL,
+		Reason:   reason.Error(),
+		Attempts: attempts,
+	}
+	if ok {
+		r.report.Repaired = append(r.report.Repaired, issue)
+	} else {
+		r.report.Bad = append(r.report.Bad, issue)
+	}
+}
+
+// tolerate 在上限内把失败的分片记为允许缺失并返回 true
+func (r *IntegrityReport) tolerate(seg segment) bool {
+	if r == nil || (r.MaxMissingSegments <= 0 && r.MaxMissingDuration <= 0) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.MaxMissingSegments > 0 && len(r.missing)+1 > r.MaxMissingSegments {
+		return false
+	}
+	if r.MaxMissingDuration > 0 && r.missingDuration+seg.Duration > r.MaxMissingDuration.Seconds() {
+		return false
+	}
+	if r.missing == nil {
+		r.missing = make(map[string]bool)
+	}
+	r.missing[missingKey(seg)] = true
+	r.missingDuration += seg.Duration
+	return true
+}
+
+func (r *IntegrityReport) isMissing(seg segment) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.missing[missingKey(seg)]
+}
+
+// missingKey 区分不同轨道中同名的分片
+func missingKey(seg segment) string {
+	return fmt.Sprintf("%s@%d+%d", seg.URL, seg.Offset, seg.Length)
+}
+
+// skipMissing 去掉允许缺失的分片，返回剩余的分片、缺失的时间范围和第一个剩余分片的起始时间（秒，
+// 都从 start 即 segments 起点的源时间算起）。缺失处之后的分片作为新的不连续段并记下缺失的时长，
+// 合并时在原位置留出同样长的空白，之后的内容不会提前。开头缺失的分片不在输出中，也不留空白
+func skipMissing(segments []segment, report *IntegrityReport, track string, start float64) ([]segment, []types.TimeRange, float64) {
+	var kept []segment
+	var gaps []types.TimeRange
+	t, first := start, -1.0
+	var shift int64
+	var gap float64
+	for _, seg := range segments {
+		if report.isMissing(seg) {
+			if n := len(gaps); n > 0 && gaps[n-1].End == t {
+				gaps[n-1].End += seg.Duration
+			} else {
+				gaps = append(gaps, types.TimeRange{Start: t, End: t + seg.Duration, Track: track})
+				if len(kept) > 0 {
+					shift++
+				}
+			}
+			if len(kept) > 0 {
+				gap += seg.Duration
+			}
+		} else {
+			if first < 0 {
+				first = t
+			}
+			seg.Discontinuity += shift
+			seg.Gap += gap
+			gap = 0
+			kept = append(kept, seg)
+		}
+		t += seg.Duration
+	}
+	if first < 0 {
+		first = t
+	}
+	label := track
+	if label == "" {
+		label = "视频"
+	}
+	for _, g := range gaps {
+		fmt.Printf("%s缺失 %.1f - %.1f 秒\n", label, g.Start, g.End)
+	}
+	return kept, gaps, first
+}
+
+// outputGaps 把源时间的缺失范围换算为输出文件中的位置：输出从 origin 开始，
+// 精确截取时再减去截掉的开头；开头缺失的内容不在输出中，位置为负数
+func outputGaps(gaps []types.TimeRange, origin float64, opts Options) []types.TimeRange {
+	if opts.trims() {
+		origin = max(origin, opts.ClipStart.Seconds())
+	}
+	shifted := make([]types.TimeRange, 0, len(gaps))
+	for _, g := range gaps {
+		g.Start -= origin
+		g.End -= origin
+		shifted = append(shifted, g)
+	}
+	return shifted
+}
+
+// Snapshot 返回当前报告的副本，没有任何记录时返回 nil
+func (r *IntegrityReport) Snapshot() *types.SegmentReport {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.report.Repaired) == 0 && len(r.report.Bad) == 0 {
+		return nil
+	}
+	return &types.SegmentReport{
+		Repaired: append([]types.SegmentIssue(nil), r.report.Repaired...),
+		Bad:      append([]types.SegmentIssue(nil), r.report.Bad...),
+	}
+}
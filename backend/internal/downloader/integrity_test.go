@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"videoDownload/internal/types"
+)
+
+func TestSegmentCheck(t *testing.T) {
+	packets := bytes.Repeat(tsPacket(0x100, 0, true), 3)
+	corrupt := append([]byte{}, packets...)
+	corrupt[188] = 0
+
+	tests := []struct {
+		name     string
+		url      string
+		length   int64 // 字节范围长度，0 表示按 Content-Length
+		expected int64 // Content-Length，-1 表示未知
+		data     []byte
+		chunk    int // 每次写入的字节数，0 表示一次写入
+		wantErr  string
+	}{
+		{name: "valid ts", url: "a.ts", expected: 564, data: packets},
+		{name: "valid ts in small writes", url: "a.ts", expected: -1, data: packets, chunk: 100},
+		{name: "missing sync byte", url: "a.ts", expected: -1, data: corrupt, chunk: 7, wantErr: "第 188 字节处缺少 TS 同步字节"},
+		{name: "partial packet", url: "a.ts", expected: -1, data: packets[:500], wantErr: "最后一个 TS 包不完整"},
+		{name: "short body", url: "a.ts", expected: 1000, data: packets, wantErr: "响应体不完整"},
+		{name: "byte range length", url: "a.ts", length: 376, expected: 564, data: packets[:376]},
+		{name: "html error page", url: "a.ts", expected: -1, data: []byte("<!DOCTYPE html><html>403</html>"), wantErr: "HTML"},
+		{name: "not ts", url: "a.ts", expected: -1, data: bytes.Repeat([]byte{1}, 400), wantErr: "不是有效的 MPEG-TS 数据"},
+		{name: "empty", url: "a.m4s", expected: -1, wantErr: "文件为空"},
+		{name: "too small", url: "a.m4s", expected: -1, data: []byte("moof"), wantErr: "只有 4 字节"},
+		{name: "short subtitles", url: "a.vtt", expected: -1, data: []byte("\ufeffWEBVTT\n\n")},
+		{name: "fmp4 not checked as ts", url: "a.m4s", expected: -1, data: bytes.Repeat([]byte{2}, 400)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg := segment{URL: "https://cdn.example.com/" + tt.url, Filename: "segment_0000" + tt.url[1:], Length: tt.length}
+			received := &countingReader{read: int64(len(tt.data))}
+			c := newSegmentCheck(seg, tt.expected, received)
+
+			chunk := tt.chunk
+			if chunk == 0 {
+				chunk = max(len(tt.data), 1)
+			}
+			for data := tt.data; len(data) > 0; {
+				n := min(chunk, len(data))
+				c.Write(data[:n])
+				data = data[n:]
+			}
+
+			err := c.finish()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("finish: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, 期望包含 %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntegrityReport(t *testing.T) {
+	var nilReport *IntegrityReport
+	nilReport.record(segment{}, 1, errors.New("x"), true)
+	if nilReport.Snapshot() != nil {
+		t.Error("nil 报告不应记录")
+	}
+
+	r := &IntegrityReport{}
+	if r.Snapshot() != nil {
+		t.Error("没有记录时期望返回 nil")
+	}
+	r.record(segment{Filename: "segment_0001.ts", URL: "u1"}, 2, errors.New("超时"), true)
+	r.record(segment{Filename: "segment_0002.ts", URL: "u2"}, 3, errors.New("HTTP 错误: 404"), false)
+
+	report := r.Snapshot()
+	if len(report.Repaired) != 1 || report.Repaired[0].Segment != "segment_0001.ts" || report.Repaired[0].Attempts != 2 {
+		t.Errorf("修复的分片 = %+v", report.Repaired)
+	}
+	if len(report.Bad) != 1 || report.Bad[0].Reason != "HTTP 错误: 404" || report.Bad[0].Attempts != 3 {
+		t.Errorf("失败的分片 = %+v", report.Bad)
+	}
+}
+
+func TestIntegrityReportTolerate(t *testing.T) {
+	segments := timedSegments(4, 4, 4, 4)
+	for i := range segments {
+		segments[i].URL = "https://cdn.example.com/" + segments[i].Filename
+	}
+
+	tests := []struct {
+		name   string
+		report *IntegrityReport
+		want   []bool
+	}{
+		{"nil report", nil, []bool{false}},
+		{"no limits", &IntegrityReport{}, []bool{false}},
+		{"segment limit", &IntegrityReport{MaxMissingSegments: 2}, []bool{true, true, false}},
+		{"duration limit", &IntegrityReport{MaxMissingDuration: 10 * time.Second}, []bool{true, true, false}},
+		{"both limits", &IntegrityReport{MaxMissingSegments: 3, MaxMissingDuration: 5 * time.Second}, []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.report.tolerate(segments[i]); got != want {
+					t.Fatalf("第 %d 个失败的分片 tolerate = %v, 期望 %v", i+1, got, want)
+				}
+				if got := tt.report.isMissing(segments[i]); got != want {
+					t.Errorf("isMissing = %v, 期望 %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipMissing(t *testing.T) {
+	segments := timedSegments(4, 4, 4, 4, 4, 4)
+	for i := range segments {
+		segments[i].URL = "https://cdn.example.com/" + segments[i].Filename
+	}
+	report := &IntegrityReport{MaxMissingSegments: 10}
+	for _, i := range []int{0, 2, 3} {
+		report.tolerate(segments[i])
+	}
+
+	kept, gaps, first := skipMissing(segments, report, "AUDIO", 100)
+	var indexes []int
+	var discontinuities []int64
+	var shifts []float64
+	for _, seg := range kept {
+		indexes = append(indexes, seg.Index)
+		discontinuities = append(discontinuities, seg.Discontinuity)
+		shifts = append(shifts, seg.Gap)
+	}
+	if !slices.Equal(indexes, []int{1, 4, 5}) {
+		t.Errorf("保留的分片 = %v, 期望 [1 4 5]", indexes)
+	}
+	// 开头缺失的分片不留空白，中间缺失处之后的分片开始新的不连续段并留出缺失的时长
+	if !slices.Equal(discontinuities, []int64{0, 1, 1}) || !slices.Equal(shifts, []float64{0, 8, 0}) {
+		t.Errorf("不连续序号 = %v, 空白 = %v, 期望 [0 1 1], [0 8 0]", discontinuities, shifts)
+	}
+	want := []types.TimeRange{{Start: 100, End: 104, Track: "AUDIO"}, {Start: 108, End: 116, Track: "AUDIO"}}
+	if !slices.Equal(gaps, want) {
+		t.Errorf("缺失范围 = %v, 期望 %v", gaps, want)
+	}
+	if first != 104 {
+		t.Errorf("第一个保留分片的起始时间 = %.1f, 期望 104", first)
+	}
+
+	// 输出从第一个保留的分片开始，开头缺失的部分位置为负数
+	output := outputGaps(gaps, first, Options{})
+	wantOutput := []types.TimeRange{{Start: -4, End: 0, Track: "AUDIO"}, {Start: 4, End: 12, Track: "AUDIO"}}
+	if !slices.Equal(output, wantOutput) {
+		t.Errorf("输出中的缺失范围 = %v, 期望 %v", output, wantOutput)
+	}
+
+	if kept, gaps, _ := skipMissing(segments, nil, "", 0); len(kept) != len(segments) || gaps != nil {
+		t.Errorf("没有报告时保留 %d 个分片，缺失 %v", len(kept), gaps)
+	}
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// 连续刷新播放列表失败的最大次数
+	maxLiveReloadFailures = 3
+	// 播放列表长时间没有新分片时视为直播已结束
+	liveStallTargetDurations = 6
+)
+
+// recordLive 持续刷新直播播放列表，按 #EXT-X-MEDIA-SEQUENCE 只下载新出现的分片，
+// 直到出现 #EXT-X-ENDLIST、达到 opts 中的停止条件或 ctx 被取消。
+// ctx 取消与其他停止条件一样结束录制，返回已录制的分片供调用方合并。
+// 返回按录制顺序重新编号的分片，其中可能包含允许缺失的分片。
+func recordLive(ctx context.Context, pl *playlist, tmpDir string, opts Options, progressCallback func(ProgressInfo)) ([]segment, error) {
+	fmt.Printf("检测到直播播放列表，开始录制: %s\n", pl.URL)
+
+	client := opts.Client
+	keys := newKeyCache(client)
+	inits := make(map[string]*segment)
+	var recorded []segment
+	nextIndex := 0
+	var recordedDuration time.Duration
+	lastSequence := int64(-1)
+	lastNewSegment := time.Now()
+	failures := 0
+
+	// 直播的不连续段尚未结束，广告只按分片主机和地址判断
+	mainHost := contentHost(pl.Segments)
+
+	for {
+		var fresh []segment
+		newest := lastSequence
+		for _, seg := range pl.Segments {
+			if seg.Sequence <= lastSequence {
+				continue
+			}
+			if lastSequence >= 0 && newest == lastSequence && seg.Sequence > lastSequence+1 {
+				fmt.Printf("\n直播窗口已滑过 %d 个分片，录制出现缺口\n", seg.Sequence-lastSequence-1)
+			}
+			newest = seg.Sequence
+
+			if opts.Ads != nil {
+				g := discontinuityGroup{segments: []segment{seg}, host: segmentHost(seg)}
+				if reason := opts.Ads.match(g, mainHost, true); reason != "" {
+					fmt.Printf("\n跳过广告分片 %d: %s\n", seg.Sequence, reason)
+					continue
+				}
+			}
+
+			seg.Index = nextIndex
+			nextIndex++
+			seg.Filename = renumberFilename(seg)
+			seg.Init = canonicalInit(inits, seg.Init)
+			fresh = append(fresh, seg)
+		}
+		if newest > lastSequence {
+			lastSequence = newest
+			lastNewSegment = time.Now()
+		}
+
+		if len(fresh) > 0 {
+			if err := downloadInitSegments(ctx, client, fresh, tmpDir, keys, opts.Report); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return nil, fmt.Errorf("下载初始化分片失败: %v", err)
+			}
+			if err := downloadSegments(ctx, client, fresh, tmpDir, keys, opts.Pause, opts.Report, nil, nil); err != nil {
+				if ctx.Err() != nil {
+					// 取消时这一批分片未下载完，不计入录制
+					break
+				}
+				return nil, fmt.Errorf("下载分片失败: %v", err)
+			}
+
+			for _, seg := range fresh {
+				recordedDuration += time.Duration(seg.Duration * float64(time.Second))
+			}
+			recorded = append(recorded, fresh...)
+
+			fmt.Printf("\r已录制: %s (%d 个分片)", recordedDuration.Truncate(time.Second), len(recorded))
+			if progressCallback != nil {
+				progressCallback(ProgressInfo{
+					Downloaded: len(recorded),
+					Current:    fresh[len(fresh)-1].Filename,
+					Live:       true,
+					Recorded:   recordedDuration,
+				})
+			}
+		}
+
+		if stop, reason := liveStopReason(pl, opts, recordedDuration); stop {
+			fmt.Printf("\n停止录制: %s\n", reason)
+			break
+		}
+
+		targetDuration := pl.TargetDuration
+		if targetDuration <= 0 {
+			targetDuration = 10 * time.Second
+		}
+		if time.Since(lastNewSegment) > liveStallTargetDurations*targetDuration {
+			fmt.Println("\n停止录制: 直播播放列表长时间未更新")
+			break
+		}
+
+		// 播放列表未变化时按规范等待半个目标时长后再刷新
+		wait := targetDuration
+		if len(fresh) == 0 {
+			wait = targetDuration / 2
+		}
+		if !opts.StopAt.IsZero() {
+			wait = min(wait, max(time.Until(opts.StopAt), 0))
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		next, err := fetchPlaylist(ctx, client, pl.URL)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failures++
+			if failures >= maxLiveReloadFailures {
+				return nil, fmt.Errorf("刷新直播播放列表失败: %v", err)
+			}
+			fmt.Printf("\n刷新直播播放列表失败 (%d/%d): %v\n", failures, maxLiveReloadFailures, err)
+			continue
+		}
+		failures = 0
+		pl = next
+	}
+	if ctx.Err() != nil {
+		fmt.Println("\n停止录制: 任务已取消")
+	}
+
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("未录制到任何分片")
+	}
+
+	return recorded, nil
+}
+
+func liveStopReason(pl *playlist, opts Options, recorded time.Duration) (bool, string) {
+	if pl.EndList {
+		return true, "直播已结束"
+	}
+	if opts.MaxDuration > 0 && recorded >= opts.MaxDuration {
+		return true, "达到最长录制时长"
+	}
+	if !opts.StopAt.IsZero() && !time.Now().Before(opts.StopAt) {
+		return true, "到达停止时间"
+	}
+	return false, ""
+}
+
+// renumberFilename 按录制序号重新命名分片，保持每次刷新播放列表之间文件名唯一
+func renumberFilename(seg segment) string {
+	if seg.Init != nil {
+		return fmt.Sprintf("segment_%06d.m4s", seg.Index)
+	}
+	return fmt.Sprintf("segment_%06d.ts", seg.Index)
+}
+
+// canonicalInit 让每次刷新解析出的相同初始化分片指向同一个对象，避免重复下载
+func canonicalInit(inits map[string]*segment, init *segment) *segment {
+	if init == nil {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s@%d+%d", init.URL, init.Offset, init.Length)
+	if existing, ok := inits[key]; ok {
+		return existing
+	}
+
+	canonical := *init
+	canonical.Index = len(inits)
+	canonical.Filename = fmt.Sprintf("init_%02d.mp4", canonical.Index)
+	inits[key] = &canonical
+	return &canonical
+}
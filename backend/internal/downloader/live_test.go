@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/remux"
+)
+
+func TestLiveStopReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		pl       playlist
+		opts     Options
+		recorded time.Duration
+		want     bool
+	}{
+		{"live continues", playlist{}, Options{}, time.Hour, false},
+		{"endlist", playlist{EndList: true}, Options{}, 0, true},
+		{"below max duration", playlist{}, Options{MaxDuration: time.Minute}, 50 * time.Second, false},
+		{"max duration reached", playlist{}, Options{MaxDuration: time.Minute}, time.Minute, true},
+		{"stop time in future", playlist{}, Options{StopAt: time.Now().Add(time.Hour)}, 0, false},
+		{"stop time passed", playlist{}, Options{StopAt: time.Now().Add(-time.Second)}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop, reason := liveStopReason(&tt.pl, tt.opts, tt.recorded)
+			if stop != tt.want {
+				t.Errorf("stop = %v (%s), 期望 %v", stop, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalInit(t *testing.T) {
+	inits := make(map[string]*segment)
+	a := canonicalInit(inits, &segment{URL: "https://cdn.example.com/init.mp4", Filename: "init_00.mp4"})
+	// 下一次刷新解析出的相同初始化分片
+	b := canonicalInit(inits, &segment{URL: "https://cdn.example.com/init.mp4", Filename: "init_00.mp4"})
+	c := canonicalInit(inits, &segment{URL: "https://cdn.example.com/init.mp4", Filename: "init_00.mp4", Length: 100})
+
+	if a != b {
+		t.Error("相同的初始化分片应指向同一个对象")
+	}
+	if c == a || c.Filename != "init_01.mp4" {
+		t.Errorf("字节范围不同的初始化分片 = %+v", c)
+	}
+	if canonicalInit(inits, nil) != nil {
+		t.Error("没有初始化分片时应返回 nil")
+	}
+}
+
+func TestRecordLiveCancelKeepsRecording(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			// 没有 #EXT-X-ENDLIST 的直播播放列表
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:10,\na.ts\n#EXTINF:10,\nb.ts\n")
+			return
+		}
+		w.Write(tsPacket(0x100, 0, true))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := filepath.Join(t.TempDir(), "live.ts")
+	workDir := filepath.Join(t.TempDir(), "work")
+	opts := Options{Client: httpclient.Default, WorkDir: workDir}
+
+	// 录制到第一批分片后取消，等待刷新播放列表的录制应停止并合并
+	result, err := DownloadM3U8(ctx, server.URL+"/live.m3u8", out, opts, func(info ProgressInfo) {
+		if info.Live {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("DownloadM3U8: %v", err)
+	}
+	if !result.Stopped {
+		t.Error("取消后停止的直播录制应标记为 Stopped")
+	}
+	data, err := os.ReadFile(result.OutputFilename)
+	if err != nil {
+		t.Fatalf("取消后应保留录制的输出: %v", err)
+	}
+	if len(data) != 2*remux.PacketSize {
+		t.Errorf("输出 %d 字节, 期望 2 个分片共 %d 字节", len(data), 2*remux.PacketSize)
+	}
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Error("合并后应删除工作目录")
+	}
+}
@@ -1,203 +1,602 @@
 package downloader
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/remux"
 )
 
 type ProgressInfo struct {
 	Downloaded int
-	Total      int
+	Total      int // 直播录制时总数未知，为 0
 	Current    string
+	Live       bool          // 直播录制模式
+	Recorded   time.Duration // 直播录制模式下已录制的时长
+
+	// 实际接收的字节数。直接下载时 Downloaded/Total 为分块数；
+	// 分片下载时 TotalBytes 是按已知分片大小估算的总大小
+	DownloadedBytes int64
+	TotalBytes      int64 // 无法得知或估算总大小时为 0
+}
+
+// Options 控制一次 M3U8 下载的行为
+type Options struct {
+	VariantPolicy string // 主播放列表的档位选择策略，空值等同于 VariantHighest
+	MaxBandwidth  int    // VariantMaxBandwidth 策略的带宽上限 (bps)
+
+	// 直播录制的停止条件，播放列表出现 #EXT-X-ENDLIST 时总会停止
+	MaxDuration time.Duration // 最长录制时长，0 表示不限制
+	StopAt      time.Time     // 停止录制的时间点，零值表示不限制
+
+	// #EXT-X-MEDIA 轨道选择，按语言代码或名称匹配，"all" 表示全部
+	AudioLanguages    []string // 为空时使用默认音轨
+	SubtitleLanguages []string // 为空时不下载字幕
+
+	// 任务工作目录，为空时使用临时目录并在结束后删除
+	WorkDir string
+
+	// 暂停控制，为 nil 时不可暂停
+	Pause *PauseGate
+
+	// 只下载的时间范围，按分片时长选出有重叠的分片；ClipEnd 为 0 表示到结尾，直播录制时忽略
+	ClipStart time.Duration
+	ClipEnd   time.Duration
+	ExactClip bool // 合并后用 ffmpeg 重新编码，精确截取到范围边界
+
+	// 广告过滤条件，为 nil 时保留全部不连续段
+	Ads *AdFilter
+
+	// 记录重新下载的分片，并按其中的上限允许分片缺失；为 nil 时不记录，任一分片失败都会使下载失败
+	Report *IntegrityReport
+
+	// 发送全部请求的客户端，附加任务的请求头和 Cookie；为 nil 时使用 httpclient.Default
+	Client *httpclient.Client
 }
 
 type segment struct {
 	URL      string
 	Index    int
 	Filename string
+	Sequence int64       // 媒体序列号，用于推导 AES-128 的默认 IV
+	Key      *segmentKey // 为 nil 表示分片未加密
+	Init     *segment    // fMP4 分片对应的 #EXT-X-MAP 初始化分片，TS 分片为 nil
+	Offset   int64       // 字节范围起点，Length 为 0 时忽略
+	Length   int64       // 字节范围长度，为 0 表示请求整个资源
+	Duration float64     // #EXTINF 时长（秒）
+
+	// 不连续段序号，每遇到 #EXT-X-DISCONTINUITY 加一，起始值为 #EXT-X-DISCONTINUITY-SEQUENCE。
+	// 序号不同的相邻分片之间时间戳不连续，编码参数也可能变化
+	Discontinuity int64
+	// 与上一个分片之间缺失的时长（秒），合并时在不连续点留出同样长的空白
+	Gap float64
+}
+
+func (s segment) gap() time.Duration {
+	return time.Duration(s.Gap * float64(time.Second))
+}
+
+// hlsContentTypes 是 M3U8 播放列表常见的 Content-Type
+var hlsContentTypes = []string{"application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl"}
+
+// hlsDownloader 是 Registry 中的 HLS 下载器
+type hlsDownloader struct{}
+
+func (hlsDownloader) Name() string {
+	return "HLS"
+}
+
+// Probe 读取资源开头，判断是否为 M3U8 播放列表，用于扩展名和 Content-Type 都无法识别的地址
+func (hlsDownloader) Probe(ctx context.Context, client *httpclient.Client, m3u8URL string) (bool, error) {
+	resp, err := client.Get(ctx, m3u8URL, 30*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(string(head), "\ufeff")), "#EXTM3U"), nil
+}
+
+func (hlsDownloader) Download(ctx context.Context, m3u8URL, outputFilename string, opts Options, emit func(Event)) (*Result, error) {
+	return DownloadM3U8(ctx, m3u8URL, outputFilename, opts, progressEvents(emit))
 }
 
-func DownloadM3U8(m3u8URL string, outputFilename string, progressCallback func(int, int)) error {
+// DownloadM3U8 下载 M3U8 并合并为 outputFilename。opts.WorkDir 非空时分片保存在该目录并记入清单，
+// 下载失败时保留，重新调用会跳过其中已完成的分片，成功后删除；为空时使用临时目录。
+// ctx 取消时停止全部请求和合并，删除工作目录与未完成的输出文件并返回 ctx.Err()；
+// 直播录制则停止录制，合并已录制的分片并返回 Stopped 的结果
+func DownloadM3U8(ctx context.Context, m3u8URL string, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
 	fmt.Printf("开始下载 M3U8: %s\n", m3u8URL)
 
-	tmpDir, err := os.MkdirTemp("", "m3u8_download_*")
+	return withWorkDir(ctx, opts.WorkDir, outputFilename, func(dir string) (*Result, error) {
+		return downloadM3U8(ctx, m3u8URL, dir, outputFilename, opts, progressCallback)
+	})
+}
+
+// withWorkDir 在工作目录中执行 download。workDir 为空时使用临时目录并总是删除；
+// 否则下载失败时保留以便重试，成功或取消后删除。ctx 取消时删除未完成的输出文件和独立轨道文件并返回 ctx.Err()，
+// 直播录制停止后已合并的输出（Result.Stopped）除外
+func withWorkDir(ctx context.Context, workDir, outputFilename string, download func(dir string) (*Result, error)) (*Result, error) {
+	if workDir == "" {
+		tmpDir, err := os.MkdirTemp("", "m3u8_download_*")
+		if err != nil {
+			return nil, fmt.Errorf("创建临时目录失败: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		result, err := download(tmpDir)
+		if ctx.Err() != nil && !stopped(result, err) {
+			return nil, cancelled(ctx, outputFilename)
+		}
+		return result, err
+	}
+
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, fmt.Errorf("创建工作目录失败: %v", err)
+	}
+	result, err := download(workDir)
+	if ctx.Err() != nil && !stopped(result, err) {
+		os.RemoveAll(workDir)
+		return nil, cancelled(ctx, outputFilename)
+	}
 	if err != nil {
-		return fmt.Errorf("创建临时目录失败: %v", err)
+		fmt.Printf("已完成的分片保留在 %s，重试时将跳过\n", workDir)
+		return nil, err
 	}
-	defer os.RemoveAll(tmpDir)
+	os.RemoveAll(workDir)
+	return result, nil
+}
 
-	segments, err := parseM3U8(m3u8URL)
+// stopped 报告 download 是否在取消后仍然得到了完整的输出
+func stopped(result *Result, err error) bool {
+	return err == nil && result != nil && result.Stopped
+}
+
+// cancelled 删除取消时可能只写了一半的输出文件，以及 renditionPath 保存的独立音频、字幕轨道
+func cancelled(ctx context.Context, outputFilename string) error {
+	os.Remove(outputFilename)
+	removeRenditionFiles(outputFilename)
+	fmt.Println("\n下载已取消")
+	return ctx.Err()
+}
+
+// removeRenditionFiles 删除与 outputFilename 同名的 *.audio.* 和 *.subtitles.* 轨道文件
+func removeRenditionFiles(outputFilename string) {
+	dir := filepath.Dir(outputFilename)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("解析 M3U8 文件失败: %v", err)
+		return
+	}
+	base := strings.TrimSuffix(filepath.Base(outputFilename), filepath.Ext(outputFilename))
+	for _, entry := range entries {
+		name := entry.Name()
+		for _, kind := range []string{renditionAudio, renditionSubtitles} {
+			if strings.HasPrefix(name, base+"."+strings.ToLower(kind)+".") {
+				os.Remove(filepath.Join(dir, name))
+			}
+		}
+	}
+}
+
+func downloadM3U8(ctx context.Context, m3u8URL, tmpDir, outputFilename string, opts Options, progressCallback func(ProgressInfo)) (*Result, error) {
+	client := opts.Client
+	pl, err := cachedPlaylist(tmpDir, "media", func() (*playlist, error) {
+		return parseM3U8(ctx, m3u8URL, opts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("解析 M3U8 文件失败: %v", err)
+	}
+
+	if !pl.EndList {
+		if len(pl.Renditions) > 0 {
+			fmt.Println("直播录制暂不支持独立音频/字幕轨道，仅录制档位流")
+		}
+		if opts.clipping() {
+			fmt.Println("直播录制不支持时间范围，忽略 start/end")
+		}
+		segments, err := recordLive(ctx, pl, tmpDir, opts, progressCallback)
+		if err != nil {
+			return nil, fmt.Errorf("录制直播失败: %v", err)
+		}
+		// 任务取消时录制已经停止，已录制的分片仍然合并
+		segments, gaps, origin := skipMissing(segments, opts.Report, "", 0)
+		outputFilename, err = finishDownload(context.WithoutCancel(ctx), segments, tmpDir, outputFilename)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{OutputFilename: outputFilename, Gaps: outputGaps(gaps, origin, opts), Stopped: ctx.Err() != nil}, nil
+	}
+
+	if len(pl.Segments) == 0 {
+		return nil, fmt.Errorf("M3U8 文件中未找到任何分片")
+	}
+	segments, err := filterAds(pl.Segments, opts.Ads)
+	if err != nil {
+		return nil, err
+	}
+	pl.Segments = segments
+
+	// fMP4 分片无法写成 TS，改为输出 MP4
+	if hasInitSegments(segments) && strings.EqualFold(filepath.Ext(outputFilename), ".ts") {
+		outputFilename = strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ".mp4"
+		fmt.Printf("fMP4 分片只能输出为 MP4: %s\n", outputFilename)
+	}
+
+	keys := newKeyCache(client)
+	if len(pl.Renditions) > 0 {
+		return downloadWithRenditions(ctx, client, pl, tmpDir, keys, opts, outputFilename, progressCallback)
+	}
+
+	var start float64
+	if opts.clipping() {
+		segments, start, err = clipSegments(segments, opts.ClipStart, opts.ClipEnd)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Printf("发现 %d 个分片\n", len(segments))
 
+	if err := downloadInitSegments(ctx, client, segments, tmpDir, keys, opts.Report); err != nil {
+		return nil, fmt.Errorf("下载初始化分片失败: %v", err)
+	}
+
 	progressChan := make(chan ProgressInfo, len(segments))
 	go displayProgress(progressChan, len(segments))
 
-	err = downloadSegments(segments, tmpDir, progressChan, progressCallback)
+	err = downloadSegments(ctx, client, segments, tmpDir, keys, opts.Pause, opts.Report, progressChan, progressCallback)
 	close(progressChan)
 	if err != nil {
-		return fmt.Errorf("下载分片失败: %v", err)
+		return nil, fmt.Errorf("下载分片失败: %v", err)
 	}
 
-	fmt.Println("\n开始合并分片...")
-	err = mergeSegments(segments, tmpDir, outputFilename)
+	segments, gaps, origin := skipMissing(segments, opts.Report, "", start)
+	outputFilename, err = finishDownload(ctx, segments, tmpDir, outputFilename)
 	if err != nil {
-		return fmt.Errorf("合并分片失败: %v", err)
+		return nil, err
 	}
-
-	fmt.Printf("下载完成: %s\n", outputFilename)
-	return nil
+	return &Result{OutputFilename: outputFilename, Gaps: outputGaps(gaps, origin, opts)}, trimClip(ctx, tmpDir, outputFilename, origin, opts)
 }
 
-func parseM3U8(m3u8URL string) ([]segment, error) {
-	resp, err := http.Get(m3u8URL)
+// finishDownload 合并分片，返回实际的输出文件名
+func finishDownload(ctx context.Context, segments []segment, tmpDir, outputFilename string) (string, error) {
+	fmt.Println("\n开始合并分片...")
+	outputFilename, err := mergeSegments(ctx, segments, tmpDir, outputFilename)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("合并分片失败: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
-	}
+	fmt.Printf("下载完成: %s\n", outputFilename)
+	return outputFilename, nil
+}
 
-	baseURL, err := url.Parse(m3u8URL)
+// parseM3U8 解析媒体播放列表；遇到主播放列表时按 opts 选择档位后再解析该档位
+func parseM3U8(ctx context.Context, m3u8URL string, opts Options) (*playlist, error) {
+	client := opts.Client
+	pl, err := fetchPlaylist(ctx, client, m3u8URL)
 	if err != nil {
 		return nil, err
 	}
 
-	var segments []segment
-	scanner := bufio.NewScanner(resp.Body)
-	index := 0
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	if pl.isMaster() {
+		variant, err := selectVariant(pl.Variants, opts)
+		if err != nil {
+			return nil, err
 		}
+		fmt.Printf("检测到主播放列表，共 %d 个档位，选择: %s (带宽 %d)\n",
+			len(pl.Variants), variant.Resolution, variant.Bandwidth)
 
-		segmentURL := line
-		if !strings.HasPrefix(line, "http") {
-			resolvedURL, err := baseURL.Parse(line)
-			if err != nil {
-				return nil, fmt.Errorf("解析分片URL失败: %v", err)
-			}
-			segmentURL = resolvedURL.String()
+		master := pl
+		pl, err = fetchPlaylist(ctx, client, variant.URL)
+		if err != nil {
+			return nil, fmt.Errorf("获取档位播放列表失败: %v", err)
+		}
+		if pl.isMaster() {
+			return nil, fmt.Errorf("档位播放列表仍然是主播放列表: %s", variant.URL)
 		}
 
-		filename := fmt.Sprintf("segment_%04d.ts", index)
-		segments = append(segments, segment{
-			URL:      segmentURL,
-			Index:    index,
-			Filename: filename,
-		})
-		index++
+		pl.Renditions = selectRenditions(master.Media, variant, opts)
+		for _, r := range pl.Renditions {
+			fmt.Printf("选择轨道: %s %s\n", r.Type, renditionLabel(r))
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
+	return pl, nil
+}
 
-	if len(segments) == 0 {
-		return nil, fmt.Errorf("M3U8 文件中未找到任何分片")
+// downloadSegments 并发下载分片，清单中已记录且校验通过的分片直接计为完成；
+// ctx 取消后不再发起新的请求，gate 暂停期间等待继续。
+// progressCallback 在每个分片完成时和下载过程中定期调用，字节数随响应体读取实时累计
+func downloadSegments(ctx context.Context, client *httpclient.Client, segments []segment, tmpDir string, keys *keyCache, gate *PauseGate, report *IntegrityReport, progressChan chan<- ProgressInfo, progressCallback func(ProgressInfo)) error {
+	m, err := loadManifest(tmpDir)
+	if err != nil {
+		return err
 	}
 
-	return segments, nil
-}
+	// 已完成的分片先计入字节数，速度不会因续传开始时的跳过而虚高
+	stats := newByteStats(segments)
+	done := make(map[string]bool)
+	for _, seg := range segments {
+		if m.complete(seg) {
+			done[seg.Filename] = true
+			size := m.size(seg)
+			stats.sample(seg, size)
+			stats.add(size)
+		}
+	}
 
-func downloadSegments(segments []segment, tmpDir string, progressChan chan<- ProgressInfo, progressCallback func(int, int)) error {
 	const maxConcurrency = 10
 	semaphore := make(chan struct{}, maxConcurrency)
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var downloadError error
-	downloaded := 0
+	downloaded, skipped := 0, 0
+	current := ""
+
+	stop := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		if progressCallback == nil {
+			return
+		}
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mu.Lock()
+				progressCallback(stats.progress(ProgressInfo{
+					Downloaded: downloaded,
+					Total:      len(segments),
+					Current:    current,
+				}))
+				mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
 
 	for _, seg := range segments {
 		wg.Add(1)
 		go func(s segment) {
 			defer wg.Done()
-			semaphore <- struct{}{}
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 			defer func() { <-semaphore }()
 
-			var err error
-			for retries := 0; retries < 3; retries++ {
-				err = downloadSegment(s, tmpDir)
-				if err == nil {
-					break
-				}
-				if retries < 2 {
-					time.Sleep(time.Duration(retries+1) * time.Second)
+			if gate.wait(ctx) != nil {
+				return
+			}
+
+			if done[s.Filename] {
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+			} else if err := downloadWithRetry(ctx, client, s, tmpDir, keys, m, stats, report); err != nil {
+				if ctx.Err() != nil || !report.tolerate(s) {
+					mu.Lock()
+					if downloadError == nil {
+						downloadError = fmt.Errorf("下载分片 %s 失败: %v", s.Filename, err)
+					}
+					mu.Unlock()
+					return
 				}
+				fmt.Printf("\n分片 %s 下载失败，在允许缺失的范围内跳过: %v\n", s.Filename, err)
 			}
-			
+
 			mu.Lock()
-			if err != nil {
-				if downloadError == nil {
-					downloadError = fmt.Errorf("下载分片 %s 失败: %v", s.Filename, err)
-				}
-			} else {
-				downloaded++
-				progressInfo := ProgressInfo{
-					Downloaded: downloaded,
-					Total:      len(segments),
-					Current:    s.Filename,
-				}
+			downloaded++
+			current = s.Filename
+			progressInfo := stats.progress(ProgressInfo{
+				Downloaded: downloaded,
+				Total:      len(segments),
+				Current:    s.Filename,
+			})
+			if progressChan != nil {
 				progressChan <- progressInfo
-				
-				// 调用进度回调函数
-				if progressCallback != nil {
-					progressCallback(downloaded, len(segments))
-				}
+			}
+
+			// 调用进度回调函数
+			if progressCallback != nil {
+				progressCallback(progressInfo)
 			}
 			mu.Unlock()
 		}(seg)
 	}
 
 	wg.Wait()
+	close(stop)
+	<-reporterDone
+	if skipped > 0 {
+		fmt.Printf("\n跳过 %d 个已完成的分片\n", skipped)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return downloadError
 }
 
-func downloadSegment(seg segment, tmpDir string) error {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// downloadWithRetry 下载单个分片，失败或未通过校验时最多重试 3 次，重试过的分片记入 report。
+// stats 和 report 可以为 nil
+func downloadWithRetry(ctx context.Context, client *httpclient.Client, seg segment, tmpDir string, keys *keyCache, m *manifest, stats *byteStats, report *IntegrityReport) error {
+	var err, firstErr error
+	for retries := 0; retries < 3; retries++ {
+		err = downloadSegment(ctx, client, seg, tmpDir, keys, m, stats)
+		if err == nil {
+			if firstErr != nil {
+				report.record(seg, retries+1, firstErr, true)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if retries < 2 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(retries+1) * time.Second):
+			}
+		}
+	}
+	report.record(seg, 3, err, false)
+	return err
+}
+
+// downloadSegment 下载并写入单个分片，读取响应体时把字节计入 stats，失败时扣除本次已计入的字节
+func downloadSegment(ctx context.Context, client *httpclient.Client, seg segment, tmpDir string, keys *keyCache, m *manifest, stats *byteStats) (err error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, seg.URL)
+	if err != nil {
+		return fmt.Errorf("创建请求 %s 失败: %v", seg.Filename, err)
+	}
+
+	expectedStatus := http.StatusOK
+	if seg.Length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.Offset, seg.Offset+seg.Length-1))
+		expectedStatus = http.StatusPartialContent
 	}
 
-	resp, err := client.Get(seg.URL)
+	resp, err := client.Do(req, 30*time.Second)
 	if err != nil {
 		return fmt.Errorf("下载分片 %s 失败: %v", seg.Filename, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if seg.Length > 0 && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("分片 %s 请求字节范围但服务器返回了完整资源，服务器可能不支持 Range 请求", seg.Filename)
+	}
+
+	if resp.StatusCode != expectedStatus {
 		return fmt.Errorf("分片 %s HTTP 错误: %d", seg.Filename, resp.StatusCode)
 	}
 
+	if seg.Length > 0 {
+		if err := checkContentRange(resp.Header.Get("Content-Range"), seg.Offset); err != nil {
+			return fmt.Errorf("分片 %s %v", seg.Filename, err)
+		}
+	}
+
+	stats.sample(seg, resp.ContentLength)
+	counter := &countingReader{r: resp.Body, stats: stats}
+	check := newSegmentCheck(seg, resp.ContentLength, counter)
+	defer func() {
+		if err != nil {
+			stats.add(-counter.read)
+		}
+	}()
+
+	var body io.Reader = counter
+	if seg.Key != nil {
+		plain, err := decryptSegment(ctx, seg, counter, keys)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(plain)
+	}
+
+	// 部分站点在分片前拼接图片文件头，伪装成图片
+	body, err = unwrapSegment(seg, body)
+	if err != nil {
+		return err
+	}
+
+	return writeSegmentFile(seg, body, tmpDir, m, check)
+}
+
+// decryptSegment 读取完整的加密分片并解密
+func decryptSegment(ctx context.Context, seg segment, body io.Reader, keys *keyCache) ([]byte, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("读取分片 %s 失败: %v", seg.Filename, err)
+	}
+
+	key, err := keys.get(ctx, seg.Key.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := decryptAES128(data, key, segmentIV(seg))
+	if err != nil {
+		return nil, fmt.Errorf("解密分片 %s 失败: %v", seg.Filename, err)
+	}
+	return plain, nil
+}
+
+// writeSegmentFile 先写入 .part 文件，完整写入并通过 check 校验后再改名并记入清单，
+// 中断时不会留下被当作完成的半截分片。check 为 nil 时不校验内容
+func writeSegmentFile(seg segment, r io.Reader, tmpDir string, m *manifest, check *segmentCheck) error {
 	filePath := filepath.Join(tmpDir, seg.Filename)
-	file, err := os.Create(filePath)
+	partPath := filePath + ".part"
+
+	file, err := os.Create(partPath)
 	if err != nil {
 		return fmt.Errorf("创建文件 %s 失败: %v", seg.Filename, err)
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	h := sha256.New()
+	writers := []io.Writer{file, h}
+	if check != nil {
+		writers = append(writers, check)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), r)
 	if err != nil {
 		return fmt.Errorf("写入文件 %s 失败: %v", seg.Filename, err)
 	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("写入文件 %s 失败: %v", seg.Filename, err)
+	}
+	if check != nil {
+		if err := check.finish(); err != nil {
+			os.Remove(partPath)
+			return err
+		}
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return fmt.Errorf("写入文件 %s 失败: %v", seg.Filename, err)
+	}
+
+	return m.record(seg, size, h.Sum(nil))
+}
+
+// checkContentRange 确认 206 响应从请求的 offset 开始
+func checkContentRange(contentRange string, offset int64) error {
+	if contentRange == "" {
+		return nil
+	}
 
+	var start, end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d", &start, &end); err != nil {
+		return fmt.Errorf("无法解析 Content-Range: %s", contentRange)
+	}
+	if start != offset {
+		return fmt.Errorf("Content-Range 起点 %d 与请求的 %d 不一致", start, offset)
+	}
 	return nil
 }
 
@@ -209,40 +608,38 @@ func displayProgress(progressChan <-chan ProgressInfo, total int) {
 	}
 }
 
-func mergeSegments(segments []segment, tmpDir, outputFilename string) error {
-	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		return fmt.Errorf("未找到 ffmpeg，请先安装 ffmpeg")
+// mergeSegments 按序号合并分片，返回实际的输出文件名（只能拼接为 TS 时扩展名改为 .ts）
+func mergeSegments(ctx context.Context, segments []segment, tmpDir, outputFilename string) (string, error) {
+	if len(segments) == 0 {
+		return "", fmt.Errorf("没有可合并的分片")
 	}
-
 	sort.Slice(segments, func(i, j int) bool {
 		return segments[i].Index < segments[j].Index
 	})
 
-	listFilePath := filepath.Join(tmpDir, "filelist.txt")
-	listFile, err := os.Create(listFilePath)
-	if err != nil {
-		return fmt.Errorf("创建文件列表失败: %v", err)
+	if hasInitSegments(segments) {
+		return outputFilename, mergeFMP4(ctx, segments, tmpDir, outputFilename)
 	}
-	defer listFile.Close()
 
-	for _, seg := range segments {
+	var paths []string
+	var durations []float64
+	var discontinuities []remux.Discontinuity
+	for i, seg := range segments {
 		segmentPath := filepath.Join(tmpDir, seg.Filename)
 		if _, err := os.Stat(segmentPath); err != nil {
-			return fmt.Errorf("分片文件 %s 不存在", seg.Filename)
+			return "", fmt.Errorf("分片文件 %s 不存在", seg.Filename)
 		}
-		fmt.Fprintf(listFile, "file '%s'\n", segmentPath)
+		if i > 0 && seg.Discontinuity != segments[i-1].Discontinuity {
+			discontinuities = append(discontinuities, remux.Discontinuity{Input: i, Gap: seg.gap()})
+		}
+		paths = append(paths, segmentPath)
+		durations = append(durations, seg.Duration)
+	}
+	if len(discontinuities) > 0 {
+		fmt.Printf("播放列表包含 %d 个不连续点，合并时重新计算时间戳\n", len(discontinuities))
 	}
 
-	cmd := exec.Command("ffmpeg", 
-		"-f", "concat", 
-		"-safe", "0", 
-		"-i", listFilePath, 
-		"-c", "copy", 
-		"-y", 
-		outputFilename)
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
-}
\ No newline at end of file
+	merger, outputFilename := selectMerger(paths, outputFilename, tmpDir, discontinuities, durations)
+	fmt.Printf("使用 %s 合并 %d 个分片\n", merger.Name(), len(paths))
+	return outputFilename, merger.Merge(ctx, paths, outputFilename)
+}
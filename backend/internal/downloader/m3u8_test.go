@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+func TestCheckContentRange(t *testing.T) {
+	tests := []struct {
+		contentRange string
+		offset       int64
+		wantErr      bool
+	}{
+		{"", 100, false},
+		{"bytes 100-199/1000", 100, false},
+		{"bytes 0-99/1000", 100, true},
+		{"items 1-2", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentRange, func(t *testing.T) {
+			if err := checkContentRange(tt.contentRange, tt.offset); (err != nil) != tt.wantErr {
+				t.Errorf("checkContentRange = %v, 期望出错 %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadByteRangeSegment(t *testing.T) {
+	var file []byte
+	for i := 0; i < 5; i++ {
+		file = append(file, tsPacket(uint16(0x100+i), 0, true)...)
+	}
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "media.ts", time.Time{}, bytes.NewReader(file))
+	}))
+	defer ranged.Close()
+	// 忽略 Range 头、总是返回完整资源的服务器
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(file)
+	}))
+	defer full.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"range honoured", ranged.URL, false},
+		{"range ignored", full.URL, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			seg := segment{URL: tt.url + "/media.ts", Filename: "segment_0001.ts", Offset: 376, Length: 376}
+			m, err := loadManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = downloadSegment(context.Background(), httpclient.Default, seg, dir, newKeyCache(httpclient.Default), m, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadSegment: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, seg.Filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, file[376:752]) {
+				t.Errorf("分片内容 = %d 字节, 期望字节范围 376-751", len(data))
+			}
+		})
+	}
+}
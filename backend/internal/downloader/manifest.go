@@ -0,0 +1,242 @@
+package downloader
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// manifestFilename 工作目录中记录已完成分片的清单，每行一条 JSON，后写入的记录覆盖先前的
+const manifestFilename = "manifest.jsonl"
+
+// manifestEntry 记录一个已完整写入工作目录的分片
+type manifestEntry struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	Offset   int64  `json:"offset,omitempty"`
+	Length   int64  `json:"length,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// manifest 是一个工作目录中已完成分片的清单，用于进程重启或任务重试后跳过这些分片
+type manifest struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]manifestEntry
+}
+
+// loadManifest 读取 dir 中的清单，文件不存在时返回空清单，无法解析的行会被忽略
+func loadManifest(dir string) (*manifest, error) {
+	m := &manifest{dir: dir, entries: make(map[string]manifestEntry)}
+
+	f, err := os.Open(filepath.Join(dir, manifestFilename))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取分片清单失败: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Filename == "" {
+			// 进程中途退出时最后一行可能只写了一半
+			continue
+		}
+		m.entries[entry.Filename] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取分片清单失败: %v", err)
+	}
+	return m, nil
+}
+
+// complete 判断分片是否已下载：清单中的来源与当前分片一致，且磁盘上的文件大小和 SHA-256 都与记录相符
+func (m *manifest) complete(seg segment) bool {
+	m.mu.Lock()
+	entry, ok := m.entries[seg.Filename]
+	m.mu.Unlock()
+	if !ok || entry.URL != seg.URL || entry.Offset != seg.Offset || entry.Length != seg.Length {
+		return false
+	}
+
+	f, err := os.Open(filepath.Join(m.dir, seg.Filename))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	return err == nil && size == entry.Size && hex.EncodeToString(h.Sum(nil)) == entry.SHA256
+}
+
+// size 返回清单中记录的分片文件大小，未记录时为 0
+func (m *manifest) size(seg segment) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[seg.Filename].Size
+}
+
+// record 把完成的分片追加到清单
+func (m *manifest) record(seg segment, size int64, sum []byte) error {
+	entry := manifestEntry{
+		Filename: seg.Filename,
+		URL:      seg.URL,
+		Offset:   seg.Offset,
+		Length:   seg.Length,
+		Size:     size,
+		SHA256:   hex.EncodeToString(sum),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(m.dir, manifestFilename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("写入分片清单失败: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("写入分片清单失败: %v", err)
+	}
+	m.entries[seg.Filename] = entry
+	return f.Close()
+}
+
+// savePlaylist 把点播播放列表的解析结果保存到工作目录，重试时据此只下载失败或缺失的分片，
+// 分片的编号和文件名不受重新获取的播放列表影响
+func savePlaylist(dir, name string, pl *playlist) error {
+	data, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(playlistPath(dir, name), data, 0644); err != nil {
+		return fmt.Errorf("保存播放列表失败: %v", err)
+	}
+	return nil
+}
+
+func playlistPath(dir, name string) string {
+	return filepath.Join(dir, "playlist_"+name+".json")
+}
+
+// loadPlaylist 读取 savePlaylist 保存的播放列表，不存在或无法解析时返回 nil。
+// JSON 中每个分片的初始化分片都是独立的副本，按地址和字节范围恢复为共享的同一个对象，
+// 合并和下载时按指针区分初始化分片
+func loadPlaylist(dir, name string) *playlist {
+	data, err := os.ReadFile(playlistPath(dir, name))
+	if err != nil {
+		return nil
+	}
+	var pl playlist
+	if json.Unmarshal(data, &pl) != nil {
+		return nil
+	}
+
+	inits := make(map[string]*segment)
+	for i, seg := range pl.Segments {
+		if seg.Init == nil {
+			continue
+		}
+		key := missingKey(*seg.Init)
+		if existing, ok := inits[key]; ok {
+			pl.Segments[i].Init = existing
+		} else {
+			inits[key] = seg.Init
+		}
+	}
+	return &pl
+}
+
+// cachedPlaylist 优先使用工作目录中保存的播放列表，没有时调用 fetch 获取，点播播放列表获取后随即保存。
+// 有保存的播放列表时仍然调用 fetch，用新的分片、密钥地址替换保存的地址（带签名的地址可能已经过期），
+// 分片的编号和文件名保持不变；获取失败时直接使用保存的播放列表
+func cachedPlaylist(dir, name string, fetch func() (*playlist, error)) (*playlist, error) {
+	if pl := loadPlaylist(dir, name); pl != nil {
+		fmt.Printf("使用工作目录中保存的播放列表 %s，只下载失败或缺失的分片\n", name)
+		fresh, err := fetch()
+		if err != nil {
+			fmt.Printf("重新获取播放列表 %s 失败，沿用保存的分片地址: %v\n", name, err)
+			return pl, nil
+		}
+		if refreshed := refreshPlaylist(pl, fresh); refreshed > 0 {
+			fmt.Printf("已按重新获取的播放列表更新 %d 个分片的地址\n", refreshed)
+			if err := savePlaylist(dir, name, pl); err != nil {
+				return nil, err
+			}
+		}
+		return pl, nil
+	}
+	pl, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if pl.EndList {
+		if err := savePlaylist(dir, name, pl); err != nil {
+			return nil, err
+		}
+	}
+	return pl, nil
+}
+
+// refreshPlaylist 把 fresh 中的地址映射到保存的播放列表 pl 上，返回更新的分片数。
+// 分片按媒体序列号对应，序列号对不上但分片数相同时按位置对应；字节范围不同的分片视为不同内容，不更新
+func refreshPlaylist(pl, fresh *playlist) int {
+	bySequence := make(map[int64]segment, len(fresh.Segments))
+	for _, seg := range fresh.Segments {
+		bySequence[seg.Sequence] = seg
+	}
+
+	refreshed := 0
+	for i := range pl.Segments {
+		seg := &pl.Segments[i]
+		f, ok := bySequence[seg.Sequence]
+		if !ok && len(fresh.Segments) == len(pl.Segments) {
+			f, ok = fresh.Segments[i], true
+		}
+		if !ok || f.Offset != seg.Offset || f.Length != seg.Length || (f.Init == nil) != (seg.Init == nil) {
+			continue
+		}
+		if seg.URL != f.URL || keyURI(seg.Key) != keyURI(f.Key) || (seg.Init != nil && seg.Init.URL != f.Init.URL) {
+			refreshed++
+		}
+		seg.URL = f.URL
+		seg.Key = f.Key
+		// 初始化分片由多个分片共享，直接更新共享对象的地址
+		if seg.Init != nil {
+			seg.Init.URL = f.Init.URL
+		}
+	}
+
+	// 独立音频、字幕轨道的播放列表地址同样可能带签名
+	if len(fresh.Renditions) == len(pl.Renditions) {
+		for i, r := range fresh.Renditions {
+			if r.Type == pl.Renditions[i].Type && r.GroupID == pl.Renditions[i].GroupID && r.Name == pl.Renditions[i].Name {
+				pl.Renditions[i].URL = r.URL
+			}
+		}
+	}
+	return refreshed
+}
+
+func keyURI(k *segmentKey) string {
+	if k == nil {
+		return ""
+	}
+	return k.URI
+}
@@ -0,0 +1,277 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/remux"
+)
+
+// writeRecorded 写入分片文件并记入清单
+func writeRecorded(t *testing.T, m *manifest, seg segment, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(m.dir, seg.Filename), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if err := m.record(seg, int64(len(data)), sum[:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestComplete(t *testing.T) {
+	seg := segment{URL: "https://cdn.example.com/a.ts", Filename: "segment_0000.ts", Offset: 100, Length: 376}
+	data := bytes.Repeat([]byte{remux.SyncByte}, 376)
+
+	tests := []struct {
+		name   string
+		modify func(dir string, seg *segment)
+		want   bool
+	}{
+		{"unchanged", func(string, *segment) {}, true},
+		{"url changed", func(_ string, s *segment) { s.URL = "https://cdn.example.com/b.ts" }, false},
+		{"byte range changed", func(_ string, s *segment) { s.Offset = 476 }, false},
+		{"file removed", func(dir string, s *segment) { os.Remove(filepath.Join(dir, s.Filename)) }, false},
+		{"file truncated", func(dir string, s *segment) { os.WriteFile(filepath.Join(dir, s.Filename), data[:188], 0644) }, false},
+		{"file corrupted", func(dir string, s *segment) {
+			corrupted := append([]byte{}, data...)
+			corrupted[200] = 0
+			os.WriteFile(filepath.Join(dir, s.Filename), corrupted, 0644)
+		}, false},
+		{"half written line", func(dir string, _ *segment) {
+			f, _ := os.OpenFile(filepath.Join(dir, manifestFilename), os.O_APPEND|os.O_WRONLY, 0644)
+			f.WriteString(`{"filename":"segment_0001.ts","url":`)
+			f.Close()
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			m, err := loadManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeRecorded(t, m, seg, data)
+
+			s := seg
+			tt.modify(dir, &s)
+			// 重新读取清单，模拟进程重启后的续传
+			reloaded, err := loadManifest(dir)
+			if err != nil {
+				t.Fatalf("loadManifest: %v", err)
+			}
+			if got := reloaded.complete(s); got != tt.want {
+				t.Errorf("complete = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadSegmentsResume(t *testing.T) {
+	packet := make([]byte, remux.PacketSize)
+	packet[0] = remux.SyncByte
+	body := bytes.Repeat(packet, 2)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	segments := []segment{
+		{URL: server.URL + "/0.ts", Filename: "segment_0000.ts", Duration: 4},
+		{URL: server.URL + "/1.ts", Filename: "segment_0001.ts", Duration: 4, Index: 1},
+		{URL: server.URL + "/2.ts", Filename: "segment_0002.ts", Duration: 4, Index: 2},
+	}
+
+	tests := []struct {
+		name  string
+		setup func(dir string)
+		want  map[string]int // 续传时各分片的请求次数
+	}{
+		{"all complete", func(string) {}, map[string]int{}},
+		{"one file missing", func(dir string) { os.Remove(filepath.Join(dir, "segment_0001.ts")) }, map[string]int{"/1.ts": 1}},
+		{"manifest lost", func(dir string) { os.Remove(filepath.Join(dir, manifestFilename)) }, map[string]int{"/0.ts": 1, "/1.ts": 1, "/2.ts": 1}},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keys := newKeyCache(httpclient.Default)
+			if err := downloadSegments(ctx, httpclient.Default, segments, dir, keys, nil, nil, nil, nil); err != nil {
+				t.Fatalf("首次下载: %v", err)
+			}
+
+			tt.setup(dir)
+			mu.Lock()
+			clear(requests)
+			mu.Unlock()
+			if err := downloadSegments(ctx, httpclient.Default, segments, dir, keys, nil, nil, nil, nil); err != nil {
+				t.Fatalf("续传: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(requests) != len(tt.want) {
+				t.Errorf("续传请求 = %v, 期望 %v", requests, tt.want)
+			}
+			for path, n := range tt.want {
+				if requests[path] != n {
+					t.Errorf("%s 请求 %d 次, 期望 %d 次", path, requests[path], n)
+				}
+			}
+			for _, seg := range segments {
+				if data, err := os.ReadFile(filepath.Join(dir, seg.Filename)); err != nil || !bytes.Equal(data, body) {
+					t.Errorf("分片 %s 内容不完整", seg.Filename)
+				}
+			}
+		})
+	}
+}
+
+func TestCachedPlaylist(t *testing.T) {
+	vod := &playlist{EndList: true, Segments: []segment{{URL: "https://cdn.example.com/0.ts?sig=1", Filename: "segment_0000.ts", Duration: 4}}}
+	// 签名过期后重新获取的同一个播放列表
+	resigned := &playlist{EndList: true, Segments: []segment{{URL: "https://cdn.example.com/0.ts?sig=2", Filename: "segment_0000.ts", Duration: 4}}}
+	live := &playlist{Segments: vod.Segments}
+
+	tests := []struct {
+		name       string
+		fetched    []*playlist // 依次获取到的播放列表，nil 表示获取失败
+		wantFetch  int         // 两次调用共获取播放列表的次数
+		wantURL    string      // 第二次调用得到的分片地址
+		wantCached bool
+	}{
+		{"vod refreshed", []*playlist{vod, resigned}, 2, resigned.Segments[0].URL, true},
+		{"vod fetch failed", []*playlist{vod, nil}, 2, vod.Segments[0].URL, true},
+		{"live not saved", []*playlist{live, live}, 2, live.Segments[0].URL, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fetches := 0
+			fetch := func() (*playlist, error) {
+				pl := tt.fetched[fetches]
+				fetches++
+				if pl == nil {
+					return nil, errors.New("HTTP 错误: 403")
+				}
+				return pl, nil
+			}
+			var pl *playlist
+			for i := 0; i < 2; i++ {
+				var err error
+				if pl, err = cachedPlaylist(dir, "media", fetch); err != nil {
+					t.Fatalf("cachedPlaylist: %v", err)
+				}
+				if len(pl.Segments) != 1 || pl.Segments[0].Filename != vod.Segments[0].Filename {
+					t.Fatalf("播放列表 = %+v", pl)
+				}
+			}
+			if fetches != tt.wantFetch {
+				t.Errorf("获取次数 = %d, 期望 %d", fetches, tt.wantFetch)
+			}
+			if pl.Segments[0].URL != tt.wantURL {
+				t.Errorf("分片地址 = %s, 期望 %s", pl.Segments[0].URL, tt.wantURL)
+			}
+			saved := loadPlaylist(dir, "media")
+			if cached := saved != nil; cached != tt.wantCached {
+				t.Fatalf("已保存 = %v, 期望 %v", cached, tt.wantCached)
+			}
+			if saved != nil && saved.Segments[0].URL != tt.wantURL {
+				t.Errorf("保存的分片地址 = %s, 期望 %s", saved.Segments[0].URL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestRefreshPlaylist(t *testing.T) {
+	initSeg := &segment{URL: "https://cdn.example.com/initSeg.mp4?sig=1", Filename: "init_00.mp4"}
+	saved := &playlist{Segments: []segment{
+		{URL: "https://cdn.example.com/5.m4s?sig=1", Filename: "segment_0000.m4s", Sequence: 5, Init: initSeg},
+		{URL: "https://cdn.example.com/6.m4s?sig=1", Filename: "segment_0001.m4s", Sequence: 6, Init: initSeg},
+		{URL: "https://cdn.example.com/7.m4s?sig=1", Filename: "segment_0002.m4s", Sequence: 7, Init: initSeg},
+	}}
+	freshInit := &segment{URL: "https://cdn.example.com/initSeg.mp4?sig=2"}
+	key := &segmentKey{URI: "https://keys.example.com/k?sig=2"}
+	// 重新获取的播放列表少了第一个分片，按媒体序列号对应
+	fresh := &playlist{Segments: []segment{
+		{URL: "https://cdn.example.com/6.m4s?sig=2", Sequence: 6, Init: freshInit, Key: key},
+		{URL: "https://cdn.example.com/7.m4s?sig=2", Sequence: 7, Init: freshInit, Key: key},
+	}}
+
+	if got := refreshPlaylist(saved, fresh); got != 2 {
+		t.Errorf("更新的分片数 = %d, 期望 2", got)
+	}
+	want := []string{"https://cdn.example.com/5.m4s?sig=1", "https://cdn.example.com/6.m4s?sig=2", "https://cdn.example.com/7.m4s?sig=2"}
+	for i, seg := range saved.Segments {
+		if seg.URL != want[i] || seg.Filename != fmt.Sprintf("segment_%04d.m4s", i) {
+			t.Errorf("分片 %d = %s (%s), 期望 %s", i, seg.URL, seg.Filename, want[i])
+		}
+	}
+	if saved.Segments[2].Key != key || initSeg.URL != freshInit.URL || saved.Segments[0].Init != initSeg {
+		t.Errorf("密钥 = %+v, 初始化分片 = %+v", saved.Segments[2].Key, saved.Segments[0].Init)
+	}
+
+	// 序列号对不上但分片数相同时按位置对应，字节范围不同的分片不更新
+	saved = &playlist{Segments: []segment{
+		{URL: "https://cdn.example.com/a.ts?sig=1", Sequence: 0},
+		{URL: "https://cdn.example.com/b.ts?sig=1", Sequence: 1, Length: 100},
+	}}
+	fresh = &playlist{Segments: []segment{
+		{URL: "https://cdn.example.com/a.ts?sig=2", Sequence: 10},
+		{URL: "https://cdn.example.com/b.ts?sig=2", Sequence: 11, Length: 200},
+	}}
+	if got := refreshPlaylist(saved, fresh); got != 1 {
+		t.Errorf("按位置更新的分片数 = %d, 期望 1", got)
+	}
+	if saved.Segments[0].URL != fresh.Segments[0].URL || saved.Segments[1].URL != "https://cdn.example.com/b.ts?sig=1" {
+		t.Errorf("按位置更新后 = %+v", saved.Segments)
+	}
+}
+
+func TestLoadPlaylistSharesInit(t *testing.T) {
+	dir := t.TempDir()
+	first := &segment{URL: "https://cdn.example.com/initSeg.mp4", Filename: "init_00.mp4"}
+	second := &segment{URL: "https://cdn.example.com/initSeg.mp4", Filename: "init_01.mp4", Offset: 0, Length: 720}
+	pl := &playlist{EndList: true, Segments: []segment{
+		{URL: "https://cdn.example.com/1.m4s", Filename: "segment_0000.m4s", Init: first},
+		{URL: "https://cdn.example.com/2.m4s", Filename: "segment_0001.m4s", Init: first},
+		{URL: "https://cdn.example.com/3.m4s", Filename: "segment_0002.m4s", Init: second},
+	}}
+	if err := savePlaylist(dir, "media", pl); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := loadPlaylist(dir, "media")
+	if loaded == nil || len(loaded.Segments) != 3 {
+		t.Fatalf("loadPlaylist = %+v", loaded)
+	}
+	segs := loaded.Segments
+	if segs[0].Init != segs[1].Init {
+		t.Error("相同的初始化分片重新读取后应指向同一个对象")
+	}
+	if segs[1].Init == segs[2].Init {
+		t.Error("字节范围不同的初始化分片不应合并")
+	}
+	if segs[2].Init.Filename != "init_01.mp4" {
+		t.Errorf("初始化分片文件名 = %s", segs[2].Init.Filename)
+	}
+}
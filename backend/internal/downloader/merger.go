@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"videoDownload/internal/remux"
+)
+
+// Merger 把按播放顺序排列的分片文件合并为一个输出文件
+type Merger interface {
+	Name() string
+	Merge(ctx context.Context, inputs []string, outputFilename string) error
+}
+
+// FFmpegAvailable 报告 PATH 中是否能找到 ffmpeg
+func FFmpegAvailable() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// selectMerger 输出 .ts 时使用纯 Go 的 TS 拼接，输出 .mp4/.m4a 且分片是 TS 时使用纯 Go 的 MP4 封装，
+// 其他情况交给 ffmpeg。未安装 ffmpeg 时 TS 分片退回 TS 拼接、ADTS 音频分片直接拼接为 .aac，
+// 输出文件随之改用对应的扩展名，返回实际的输出文件名。
+// discontinuities 是开始新的不连续段的输入及其之前要留出的空白，durations 是各输入的时长（秒），
+// ffmpeg concat 本身会按文件接续时间戳，空白通过加长前一个文件的时长留出
+func selectMerger(inputs []string, outputFilename, tmpDir string, discontinuities []remux.Discontinuity, durations []float64) (Merger, string) {
+	ext := strings.ToLower(filepath.Ext(outputFilename))
+	format := sniffSegment(inputs[0])
+	switch {
+	case ext == ".ts":
+		return &tsMerger{discontinuities: discontinuities}, outputFilename
+	case (ext == ".mp4" || ext == ".m4a") && format == "ts":
+		return &mp4Merger{tmpDir: tmpDir, discontinuities: discontinuities, durations: durations}, outputFilename
+	case FFmpegAvailable():
+		return &ffmpegMerger{listDir: tmpDir, discontinuities: discontinuities, durations: durations}, outputFilename
+	case format == "ts":
+		return &tsMerger{discontinuities: discontinuities}, withExtension(outputFilename, ".ts")
+	case format == "aac":
+		return concatMerger{}, withExtension(outputFilename, ".aac")
+	}
+	return &ffmpegMerger{listDir: tmpDir, discontinuities: discontinuities, durations: durations}, outputFilename
+}
+
+// withExtension 把文件名的扩展名换成 ext 并提示
+func withExtension(outputFilename, ext string) string {
+	name := strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ext
+	fmt.Printf("未找到 ffmpeg，只能直接拼接分片: %s\n", name)
+	return name
+}
+
+// sniffSegment 按开头的数据识别分片格式："ts"、"aac"（ADTS，可带 ID3 标签）或空字符串
+func sniffSegment(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 2*remux.PacketSize)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	switch {
+	case n > 0 && head[0] == remux.SyncByte && (n <= remux.PacketSize || head[remux.PacketSize] == remux.SyncByte):
+		return "ts"
+	case bytes.HasPrefix(head, []byte("ID3")), n >= 2 && head[0] == 0xFF && head[1]&0xF6 == 0xF0:
+		return "aac"
+	}
+	return ""
+}
+
+// concatMerger 按顺序直接拼接分片文件，用于没有 ffmpeg 时的 ADTS 音频
+type concatMerger struct{}
+
+func (concatMerger) Name() string {
+	return "直接拼接"
+}
+
+func (concatMerger) Merge(ctx context.Context, inputs []string, outputFilename string) error {
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+
+	for _, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := appendFile(out, input); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// ffmpegMerger 使用 ffmpeg concat demuxer 无损拼接文件
+type ffmpegMerger struct {
+	listDir string // 存放 concat 文件列表的目录
+
+	// 需要留出空白的不连续点和各输入的时长（秒），空白之前的文件按 时长+空白 声明 duration
+	discontinuities []remux.Discontinuity
+	durations       []float64
+}
+
+func (m *ffmpegMerger) Name() string {
+	return "ffmpeg"
+}
+
+func (m *ffmpegMerger) Merge(ctx context.Context, inputs []string, outputFilename string) error {
+	if !FFmpegAvailable() {
+		return fmt.Errorf("未找到 ffmpeg，请先安装 ffmpeg")
+	}
+
+	listFilePath := filepath.Join(m.listDir, "filelist.txt")
+	listFile, err := os.Create(listFilePath)
+	if err != nil {
+		return fmt.Errorf("创建文件列表失败: %v", err)
+	}
+	defer listFile.Close()
+
+	for i, path := range inputs {
+		fmt.Fprintf(listFile, "file '%s'\n", path)
+		if gap := m.gapAfter(i); gap > 0 && i < len(m.durations) && m.durations[i] > 0 {
+			fmt.Fprintf(listFile, "duration %.3f\n", m.durations[i]+gap.Seconds())
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listFilePath,
+		"-c", "copy",
+		"-y",
+		outputFilename)
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// gapAfter 返回第 i 个输入之后要留出的空白
+func (m *ffmpegMerger) gapAfter(i int) time.Duration {
+	for _, d := range m.discontinuities {
+		if d.Input == i+1 {
+			return d.Gap
+		}
+	}
+	return 0
+}
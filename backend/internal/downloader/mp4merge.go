@@ -0,0 +1,30 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"videoDownload/internal/remux"
+)
+
+// mp4Merger 以纯 Go 方式把 TS 分片解复用后封装为 faststart MP4，
+// 遇到不支持的编码且安装了 ffmpeg 时交给 ffmpeg 处理
+type mp4Merger struct {
+	tmpDir          string
+	discontinuities []remux.Discontinuity
+	durations       []float64 // 各输入的时长（秒），改用 ffmpeg 时用于留出空白
+}
+
+func (m *mp4Merger) Name() string {
+	return "原生 MP4 封装"
+}
+
+func (m *mp4Merger) Merge(ctx context.Context, inputs []string, outputFilename string) error {
+	err := remux.TSToMP4(ctx, inputs, m.discontinuities, outputFilename, m.tmpDir)
+	if errors.Is(err, remux.ErrUnsupportedCodec) && FFmpegAvailable() {
+		fmt.Printf("%v，改用 ffmpeg 合并\n", err)
+		return (&ffmpegMerger{listDir: m.tmpDir, discontinuities: m.discontinuities, durations: m.durations}).Merge(ctx, inputs, outputFilename)
+	}
+	return err
+}
@@ -0,0 +1,616 @@
+package downloader
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+// mpd 是 DASH 清单中下载用到的部分
+type mpd struct {
+	Type                      string      `xml:"type,attr"` // "static" 为点播，"dynamic" 为直播
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+// mpdSegmentInfo 是 Period、AdaptationSet、Representation 上都可以出现的分片描述，下层覆盖上层
+type mpdSegmentInfo struct {
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdPeriod struct {
+	ID       string `xml:"id,attr"`
+	Start    string `xml:"start,attr"`
+	Duration string `xml:"duration,attr"`
+	mpdSegmentInfo
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType       string          `xml:"contentType,attr"` // "video"、"audio"、"text"
+	MimeType          string          `xml:"mimeType,attr"`
+	Lang              string          `xml:"lang,attr"`
+	Label             string          `xml:"Label"`
+	Roles             []mpdDescriptor `xml:"Role"`
+	ContentProtection []mpdDescriptor `xml:"ContentProtection"`
+	mpdSegmentInfo
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string          `xml:"id,attr"`
+	Bandwidth         int             `xml:"bandwidth,attr"`
+	Width             int             `xml:"width,attr"`
+	Height            int             `xml:"height,attr"`
+	MimeType          string          `xml:"mimeType,attr"`
+	Codecs            string          `xml:"codecs,attr"`
+	ContentProtection []mpdDescriptor `xml:"ContentProtection"`
+	mpdSegmentInfo
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string              `xml:"media,attr"`
+	Initialization         string              `xml:"initialization,attr"`
+	StartNumber            *int64              `xml:"startNumber,attr"`
+	Timescale              *int64              `xml:"timescale,attr"`
+	Duration               *int64              `xml:"duration,attr"`
+	PresentationTimeOffset *int64              `xml:"presentationTimeOffset,attr"`
+	Timeline               *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []mpdTimelineEntry `xml:"S"`
+}
+
+// mpdTimelineEntry 描述 R+1 个时长为 D 的连续分片，T 缺省时紧接上一个分片，R 为 -1 时重复到下一个条目或 Period 结束
+type mpdTimelineEntry struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type mpdSegmentList struct {
+	Timescale      *int64          `xml:"timescale,attr"`
+	Duration       *int64          `xml:"duration,attr"`
+	Initialization *mpdURL         `xml:"Initialization"`
+	SegmentURLs    []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+// mpdSegmentBase 描述单个文件内按 SIDX 索引划分的分片
+type mpdSegmentBase struct {
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *mpdURL `xml:"Initialization"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// dashRepresentation 是一个可供选择的表示，分片描述和 BaseURL 已按层级合并
+type dashRepresentation struct {
+	set      *mpdAdaptationSet
+	rep      *mpdRepresentation
+	baseURL  *url.URL
+	segments mpdSegmentInfo
+}
+
+func (r dashRepresentation) mimeType() string {
+	if r.rep.MimeType != "" {
+		return r.rep.MimeType
+	}
+	return r.set.MimeType
+}
+
+// kind 返回 "video"、"audio"，字幕等其他类型返回空串
+func (r dashRepresentation) kind() string {
+	mimeType := r.mimeType()
+	switch {
+	case r.set.ContentType == "video" || strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case r.set.ContentType == "audio" || strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return ""
+}
+
+func (r dashRepresentation) protected() bool {
+	return len(r.set.ContentProtection) > 0 || len(r.rep.ContentProtection) > 0
+}
+
+// fetchMPD 下载并解析 DASH 清单，返回重定向后的清单地址作为相对地址的基准
+func fetchMPD(ctx context.Context, client *httpclient.Client, mpdURL string) (*mpd, *url.URL, error) {
+	resp, err := client.Get(ctx, mpdURL, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+
+	var m mpd
+	if err := xml.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("无法解析 MPD: %v", err)
+	}
+	if len(m.Periods) == 0 {
+		return nil, nil, fmt.Errorf("MPD 中没有 Period")
+	}
+	return &m, resp.Request.URL, nil
+}
+
+// representations 列出 Period 中的全部表示
+func (p *mpdPeriod) representations(periodBase *url.URL) ([]dashRepresentation, error) {
+	var reps []dashRepresentation
+	for i := range p.AdaptationSets {
+		set := &p.AdaptationSets[i]
+		setBase, err := resolveBaseURL(periodBase, set.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		for j := range set.Representations {
+			rep := &set.Representations[j]
+			repBase, err := resolveBaseURL(setBase, rep.BaseURL)
+			if err != nil {
+				return nil, err
+			}
+			reps = append(reps, dashRepresentation{
+				set:      set,
+				rep:      rep,
+				baseURL:  repBase,
+				segments: inheritSegmentInfo(p.mpdSegmentInfo, set.mpdSegmentInfo, rep.mpdSegmentInfo),
+			})
+		}
+	}
+	return reps, nil
+}
+
+func resolveBaseURL(base *url.URL, ref string) (*url.URL, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return base, nil
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 BaseURL %q: %v", ref, err)
+	}
+	return u, nil
+}
+
+// inheritSegmentInfo 从上到下合并各层的分片描述：下层出现任一种分片描述时覆盖上层，
+// SegmentTemplate 的属性逐项继承
+func inheritSegmentInfo(levels ...mpdSegmentInfo) mpdSegmentInfo {
+	var info mpdSegmentInfo
+	for _, l := range levels {
+		if l.SegmentTemplate == nil && l.SegmentList == nil && l.SegmentBase == nil {
+			continue
+		}
+		info.SegmentList, info.SegmentBase = l.SegmentList, l.SegmentBase
+		if l.SegmentTemplate != nil {
+			info.SegmentTemplate = mergeTemplate(info.SegmentTemplate, l.SegmentTemplate)
+		} else {
+			info.SegmentTemplate = nil
+		}
+	}
+	return info
+}
+
+func mergeTemplate(parent, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if parent == nil {
+		return child
+	}
+	merged := *parent
+	if child.Media != "" {
+		merged.Media = child.Media
+	}
+	if child.Initialization != "" {
+		merged.Initialization = child.Initialization
+	}
+	if child.StartNumber != nil {
+		merged.StartNumber = child.StartNumber
+	}
+	if child.Timescale != nil {
+		merged.Timescale = child.Timescale
+	}
+	if child.Duration != nil {
+		merged.Duration = child.Duration
+	}
+	if child.PresentationTimeOffset != nil {
+		merged.PresentationTimeOffset = child.PresentationTimeOffset
+	}
+	if child.Timeline != nil {
+		merged.Timeline = child.Timeline
+	}
+	return &merged
+}
+
+// periodDurations 返回各 Period 的时长（秒），无法确定时为 0
+func periodDurations(m *mpd) []float64 {
+	total, _ := parseISODuration(m.MediaPresentationDuration)
+	durations := make([]float64, len(m.Periods))
+
+	start := 0.0
+	for i, p := range m.Periods {
+		if s, err := parseISODuration(p.Start); err == nil && p.Start != "" {
+			start = s
+		}
+		d, err := parseISODuration(p.Duration)
+		if err != nil || p.Duration == "" {
+			d = 0
+			if i+1 < len(m.Periods) && m.Periods[i+1].Start != "" {
+				if next, err := parseISODuration(m.Periods[i+1].Start); err == nil {
+					d = next - start
+				}
+			} else if i == len(m.Periods)-1 && total > 0 {
+				d = total - start
+			}
+		}
+		durations[i] = max(d, 0)
+		start += d
+	}
+	return durations
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:([\d.]+)D)?(?:T(?:([\d.]+)H)?(?:([\d.]+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseISODuration 解析 ISO 8601 时长，例如 PT1H2M3.5S，返回秒数；不支持年和月
+func parseISODuration(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	match := isoDurationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("无法解析时长: %s", s)
+	}
+
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if match[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("无法解析时长: %s", s)
+		}
+		seconds += v * unit
+	}
+	return seconds, nil
+}
+
+// representationSegments 生成表示的初始化分片和媒体分片，Filename 和 Index 由调用方填写。
+// 没有分片描述或 SegmentBase 没有 indexRange 时，BaseURL 指向的整个文件作为唯一的分片
+func representationSegments(ctx context.Context, client *httpclient.Client, r dashRepresentation, periodDuration float64) (*segment, []segment, error) {
+	switch info := r.segments; {
+	case info.SegmentTemplate != nil:
+		return templateSegments(info.SegmentTemplate, r, periodDuration)
+	case info.SegmentList != nil:
+		return listSegments(info.SegmentList, r.baseURL)
+	case info.SegmentBase != nil && info.SegmentBase.IndexRange != "":
+		return indexedSegments(ctx, client, info.SegmentBase, r.baseURL)
+	}
+	return nil, []segment{{URL: r.baseURL.String(), Duration: periodDuration}}, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|)(?:%0(\d+)d)?\$`)
+
+// expandTemplate 替换 SegmentTemplate 中的 $RepresentationID$、$Number$、$Time$、$Bandwidth$ 和 $$
+func expandTemplate(tmpl string, rep *mpdRepresentation, number, time int64) string {
+	return templateIdentifier.ReplaceAllStringFunc(tmpl, func(m string) string {
+		match := templateIdentifier.FindStringSubmatch(m)
+		var v int64
+		switch match[1] {
+		case "":
+			return "$"
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			v = number
+		case "Time":
+			v = time
+		case "Bandwidth":
+			v = int64(rep.Bandwidth)
+		}
+		if match[2] != "" {
+			width, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", width, v)
+		}
+		return strconv.FormatInt(v, 10)
+	})
+}
+
+func templateSegments(t *mpdSegmentTemplate, r dashRepresentation, periodDuration float64) (*segment, []segment, error) {
+	if t.Media == "" {
+		return nil, nil, fmt.Errorf("SegmentTemplate 缺少 media")
+	}
+	timescale, startNumber, pto := int64(1), int64(1), int64(0)
+	if t.Timescale != nil && *t.Timescale > 0 {
+		timescale = *t.Timescale
+	}
+	if t.StartNumber != nil {
+		startNumber = *t.StartNumber
+	}
+	if t.PresentationTimeOffset != nil {
+		pto = *t.PresentationTimeOffset
+	}
+
+	var init *segment
+	if t.Initialization != "" {
+		u, err := r.baseURL.Parse(expandTemplate(t.Initialization, r.rep, 0, 0))
+		if err != nil {
+			return nil, nil, fmt.Errorf("无效的初始化分片地址: %v", err)
+		}
+		init = &segment{URL: u.String()}
+	}
+
+	var segments []segment
+	add := func(number, time, duration int64) error {
+		u, err := r.baseURL.Parse(expandTemplate(t.Media, r.rep, number, time))
+		if err != nil {
+			return fmt.Errorf("无效的分片地址: %v", err)
+		}
+		segments = append(segments, segment{
+			URL:      u.String(),
+			Sequence: number,
+			Duration: float64(duration) / float64(timescale),
+		})
+		return nil
+	}
+
+	number := startNumber
+	if t.Timeline != nil {
+		var time int64
+		entries := t.Timeline.S
+		for i, s := range entries {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, nil, fmt.Errorf("SegmentTimeline 中的分片时长无效: %d", s.D)
+			}
+
+			repeat := s.R
+			if repeat < 0 {
+				// 重复到下一个条目的起点或 Period 结束
+				var end int64
+				switch {
+				case i+1 < len(entries) && entries[i+1].T != nil:
+					end = *entries[i+1].T
+				case periodDuration > 0:
+					end = pto + int64(periodDuration*float64(timescale))
+				default:
+					return nil, nil, fmt.Errorf("无法确定 SegmentTimeline 的重复次数")
+				}
+				repeat = int64(math.Ceil(float64(end-time)/float64(s.D))) - 1
+			}
+
+			for k := int64(0); k <= repeat; k++ {
+				if err := add(number, time, s.D); err != nil {
+					return nil, nil, err
+				}
+				number++
+				time += s.D
+			}
+		}
+		return init, segments, nil
+	}
+
+	if t.Duration == nil || *t.Duration <= 0 {
+		return nil, nil, fmt.Errorf("SegmentTemplate 既没有 SegmentTimeline 也没有 duration")
+	}
+	if periodDuration <= 0 {
+		return nil, nil, fmt.Errorf("无法确定 Period 时长，无法计算分片数量")
+	}
+	count := int64(math.Ceil(periodDuration * float64(timescale) / float64(*t.Duration)))
+	for i := int64(0); i < count; i++ {
+		if err := add(number+i, pto+i**t.Duration, *t.Duration); err != nil {
+			return nil, nil, err
+		}
+	}
+	return init, segments, nil
+}
+
+func listSegments(l *mpdSegmentList, baseURL *url.URL) (*segment, []segment, error) {
+	var init *segment
+	if l.Initialization != nil {
+		var err error
+		if init, err = initializationSegment(l.Initialization, baseURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 每个分片的时长，没有 duration 属性时为 0
+	var duration float64
+	if l.Duration != nil {
+		timescale := int64(1)
+		if l.Timescale != nil && *l.Timescale > 0 {
+			timescale = *l.Timescale
+		}
+		duration = float64(*l.Duration) / float64(timescale)
+	}
+
+	var segments []segment
+	for _, s := range l.SegmentURLs {
+		u, err := baseURL.Parse(s.Media)
+		if err != nil {
+			return nil, nil, fmt.Errorf("无效的分片地址: %v", err)
+		}
+		seg := segment{URL: u.String(), Duration: duration}
+		if s.MediaRange != "" {
+			if seg.Offset, seg.Length, err = parseMPDRange(s.MediaRange); err != nil {
+				return nil, nil, err
+			}
+		}
+		segments = append(segments, seg)
+	}
+	if len(segments) == 0 {
+		return nil, nil, fmt.Errorf("SegmentList 中没有分片")
+	}
+	return init, segments, nil
+}
+
+func initializationSegment(u *mpdURL, baseURL *url.URL) (*segment, error) {
+	resolved, err := baseURL.Parse(u.SourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的初始化分片地址: %v", err)
+	}
+	init := &segment{URL: resolved.String()}
+	if u.Range != "" {
+		if init.Offset, init.Length, err = parseMPDRange(u.Range); err != nil {
+			return nil, err
+		}
+	}
+	return init, nil
+}
+
+// indexedSegments 读取 indexRange 处的 SIDX，按其中的引用把文件划分为分片；
+// 未给出初始化分片时取 SIDX 之前的全部字节
+func indexedSegments(ctx context.Context, client *httpclient.Client, b *mpdSegmentBase, baseURL *url.URL) (*segment, []segment, error) {
+	indexOffset, indexLength, err := parseMPDRange(b.IndexRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := fetchRange(ctx, client, baseURL.String(), indexOffset, indexLength)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取 SIDX 失败: %v", err)
+	}
+	refs, anchor, err := parseSIDX(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var init *segment
+	switch {
+	case b.Initialization != nil:
+		if init, err = initializationSegment(b.Initialization, baseURL); err != nil {
+			return nil, nil, err
+		}
+	case indexOffset > 0:
+		init = &segment{URL: baseURL.String(), Offset: 0, Length: indexOffset}
+	}
+
+	segments := make([]segment, 0, len(refs))
+	offset := indexOffset + anchor
+	for _, ref := range refs {
+		segments = append(segments, segment{URL: baseURL.String(), Offset: offset, Length: ref.size, Duration: ref.duration})
+		offset += ref.size
+	}
+	return init, segments, nil
+}
+
+// sidxReference 是 sidx 中的一个引用，对应一个媒体分片
+type sidxReference struct {
+	size     int64
+	duration float64 // 秒
+}
+
+// parseSIDX 解析 data 中的第一个 sidx box，返回各引用的字节数和时长，以及第一个引用相对 data 起点的位置
+func parseSIDX(data []byte) ([]sidxReference, int64, error) {
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 8 || pos+size > len(data) {
+			break
+		}
+		if string(data[pos+4:pos+8]) != "sidx" {
+			pos += size
+			continue
+		}
+
+		p := data[pos+8 : pos+size]
+		if len(p) < 12 {
+			break
+		}
+		version, rest := p[0], p[12:]
+		timescale := float64(binary.BigEndian.Uint32(p[8:]))
+		if timescale == 0 {
+			timescale = 1
+		}
+		var firstOffset int64
+		if version == 0 {
+			if len(rest) < 8 {
+				break
+			}
+			firstOffset, rest = int64(binary.BigEndian.Uint32(rest[4:])), rest[8:]
+		} else {
+			if len(rest) < 16 {
+				break
+			}
+			firstOffset, rest = int64(binary.BigEndian.Uint64(rest[8:])), rest[16:]
+		}
+		if len(rest) < 4 {
+			break
+		}
+		count := int(binary.BigEndian.Uint16(rest[2:]))
+		rest = rest[4:]
+		if len(rest) < count*12 {
+			break
+		}
+
+		refs := make([]sidxReference, count)
+		for i := range refs {
+			ref := binary.BigEndian.Uint32(rest[i*12:])
+			if ref&0x80000000 != 0 {
+				return nil, 0, fmt.Errorf("不支持多级 SIDX 索引")
+			}
+			refs[i] = sidxReference{
+				size:     int64(ref & 0x7FFFFFFF),
+				duration: float64(binary.BigEndian.Uint32(rest[i*12+4:])) / timescale,
+			}
+		}
+		return refs, int64(pos+size) + firstOffset, nil
+	}
+	return nil, 0, fmt.Errorf("indexRange 中没有有效的 sidx")
+}
+
+// parseMPDRange 解析 "起点-终点" 形式的闭区间字节范围
+func parseMPDRange(s string) (offset, length int64, err error) {
+	var end int64
+	if _, err := fmt.Sscanf(s, "%d-%d", &offset, &end); err != nil || end < offset {
+		return 0, 0, fmt.Errorf("无效的字节范围: %s", s)
+	}
+	return offset, end - offset + 1, nil
+}
+
+func fetchRange(ctx context.Context, client *httpclient.Client, rawURL string, offset, length int64) ([]byte, error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := client.Do(req, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("HTTP 错误: %d，服务器可能不支持 Range 请求", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, length))
+}
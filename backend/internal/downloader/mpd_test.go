@@ -0,0 +1,237 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+func int64p(v int64) *int64 { return &v }
+
+func TestTemplateSegments(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/dash/")
+	rep := &mpdRepresentation{ID: "v1", Bandwidth: 500000}
+	r := dashRepresentation{set: &mpdAdaptationSet{}, rep: rep, baseURL: base}
+
+	tests := []struct {
+		name           string
+		tmpl           mpdSegmentTemplate
+		periodDuration float64
+		wantURLs       []string
+		wantDurations  []float64
+		wantErr        bool
+	}{
+		{
+			name: "number with duration",
+			tmpl: mpdSegmentTemplate{
+				Media:          "$RepresentationID$/seg_$Number%05d$.m4s",
+				Initialization: "$RepresentationID$/init.mp4",
+				StartNumber:    int64p(3),
+				Timescale:      int64p(1000),
+				Duration:       int64p(4000),
+			},
+			periodDuration: 10,
+			wantURLs: []string{
+				"https://cdn.example.com/dash/v1/seg_00003.m4s",
+				"https://cdn.example.com/dash/v1/seg_00004.m4s",
+				"https://cdn.example.com/dash/v1/seg_00005.m4s",
+			},
+			wantDurations: []float64{4, 4, 4},
+		},
+		{
+			name: "timeline with repeat",
+			tmpl: mpdSegmentTemplate{
+				Media:     "t_$Time$_$Bandwidth$.m4s",
+				Timescale: int64p(90000),
+				Timeline: &mpdSegmentTimeline{S: []mpdTimelineEntry{
+					{T: int64p(0), D: 180000, R: 1},
+					{D: 90000},
+				}},
+			},
+			wantURLs: []string{
+				"https://cdn.example.com/dash/t_0_500000.m4s",
+				"https://cdn.example.com/dash/t_180000_500000.m4s",
+				"https://cdn.example.com/dash/t_360000_500000.m4s",
+			},
+			wantDurations: []float64{2, 2, 1},
+		},
+		{
+			name: "timeline repeat until period end",
+			tmpl: mpdSegmentTemplate{
+				Media:    "$Number$.m4s",
+				Timeline: &mpdSegmentTimeline{S: []mpdTimelineEntry{{T: int64p(0), D: 4, R: -1}}},
+			},
+			periodDuration: 12,
+			wantURLs: []string{
+				"https://cdn.example.com/dash/1.m4s",
+				"https://cdn.example.com/dash/2.m4s",
+				"https://cdn.example.com/dash/3.m4s",
+			},
+			wantDurations: []float64{4, 4, 4},
+		},
+		{
+			name:    "no duration and no timeline",
+			tmpl:    mpdSegmentTemplate{Media: "$Number$.m4s"},
+			wantErr: true,
+		},
+		{
+			name:    "duration without period length",
+			tmpl:    mpdSegmentTemplate{Media: "$Number$.m4s", Duration: int64p(4)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			init, segments, err := templateSegments(&tt.tmpl, r, tt.periodDuration)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("templateSegments: %v", err)
+			}
+			if tt.tmpl.Initialization != "" && (init == nil || init.URL != "https://cdn.example.com/dash/v1/init.mp4") {
+				t.Errorf("初始化分片 = %+v", init)
+			}
+			if len(segments) != len(tt.wantURLs) {
+				t.Fatalf("分片数 = %d, 期望 %d", len(segments), len(tt.wantURLs))
+			}
+			for i, seg := range segments {
+				if seg.URL != tt.wantURLs[i] || seg.Duration != tt.wantDurations[i] {
+					t.Errorf("分片 %d = %s (%.1f 秒), 期望 %s (%.1f 秒)", i, seg.URL, seg.Duration, tt.wantURLs[i], tt.wantDurations[i])
+				}
+			}
+		})
+	}
+}
+
+// sidxBox 构造一个版本 0 的 sidx box，每个引用为 (字节数, 时长)
+func sidxBox(timescale uint32, firstOffset uint32, refs [][2]uint32) []byte {
+	var b bytes.Buffer
+	body := make([]byte, 0, 24+12*len(refs))
+	body = append(body, 0, 0, 0, 0)                         // version, flags
+	body = binary.BigEndian.AppendUint32(body, 1)           // reference_ID
+	body = binary.BigEndian.AppendUint32(body, timescale)   // timescale
+	body = binary.BigEndian.AppendUint32(body, 0)           // earliest_presentation_time
+	body = binary.BigEndian.AppendUint32(body, firstOffset) // first_offset
+	body = binary.BigEndian.AppendUint16(body, 0)           // reserved
+	body = binary.BigEndian.AppendUint16(body, uint16(len(refs)))
+	for _, ref := range refs {
+		body = binary.BigEndian.AppendUint32(body, ref[0])
+		body = binary.BigEndian.AppendUint32(body, ref[1])
+		body = binary.BigEndian.AppendUint32(body, 0x90000000) // starts_with_SAP
+	}
+	binary.Write(&b, binary.BigEndian, uint32(8+len(body)))
+	b.WriteString("sidx")
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestParseSIDX(t *testing.T) {
+	box := sidxBox(1000, 16, [][2]uint32{{5000, 2000}, {6000, 2500}})
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantRefs   []sidxReference
+		wantAnchor int64
+		wantErr    bool
+	}{
+		{
+			name:       "single sidx",
+			data:       box,
+			wantRefs:   []sidxReference{{5000, 2}, {6000, 2.5}},
+			wantAnchor: int64(len(box)) + 16,
+		},
+		{
+			name:       "skips boxes before sidx",
+			data:       append([]byte{0, 0, 0, 8, 'f', 'r', 'e', 'e'}, box...),
+			wantRefs:   []sidxReference{{5000, 2}, {6000, 2.5}},
+			wantAnchor: 8 + int64(len(box)) + 16,
+		},
+		{
+			name:    "hierarchical index",
+			data:    sidxBox(1000, 0, [][2]uint32{{0x80000000 | 100, 1000}}),
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			data:    box[:30],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs, anchor, err := parseSIDX(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSIDX: %v", err)
+			}
+			if anchor != tt.wantAnchor {
+				t.Errorf("第一个引用位置 = %d, 期望 %d", anchor, tt.wantAnchor)
+			}
+			if len(refs) != len(tt.wantRefs) {
+				t.Fatalf("引用数 = %d, 期望 %d", len(refs), len(tt.wantRefs))
+			}
+			for i := range refs {
+				if refs[i] != tt.wantRefs[i] {
+					t.Errorf("引用 %d = %+v, 期望 %+v", i, refs[i], tt.wantRefs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIndexedSegments(t *testing.T) {
+	// 文件布局: 初始化数据 | sidx | 两个媒体分片
+	initData := bytes.Repeat([]byte{1}, 100)
+	box := sidxBox(1000, 0, [][2]uint32{{300, 4000}, {200, 3000}})
+	file := append(append(append([]byte{}, initData...), box...), make([]byte, 500)...)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(file))
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL + "/video.mp4")
+	indexRange := fmt.Sprintf("100-%d", 100+len(box)-1)
+	init, segments, err := indexedSegments(context.Background(), httpclient.Default, &mpdSegmentBase{IndexRange: indexRange}, base)
+	if err != nil {
+		t.Fatalf("indexedSegments: %v", err)
+	}
+	if init == nil || init.Offset != 0 || init.Length != 100 {
+		t.Errorf("初始化分片 = %+v, 期望 sidx 之前的 100 字节", init)
+	}
+
+	mediaStart := int64(100 + len(box))
+	want := []segment{
+		{URL: base.String(), Offset: mediaStart, Length: 300, Duration: 4},
+		{URL: base.String(), Offset: mediaStart + 300, Length: 200, Duration: 3},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("分片数 = %d, 期望 %d", len(segments), len(want))
+	}
+	for i := range want {
+		got := segments[i]
+		if got.URL != want[i].URL || got.Offset != want[i].Offset || got.Length != want[i].Length || got.Duration != want[i].Duration {
+			t.Errorf("分片 %d = %+v, 期望 %+v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+)
+
+// PauseGate 控制下载的暂停与继续：暂停后不再发起新的分片请求，进行中的请求照常完成。
+// nil 的 PauseGate 表示不可暂停。
+type PauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{} // 暂停期间有效，继续时关闭
+}
+
+func NewPauseGate() *PauseGate {
+	return &PauseGate{}
+}
+
+func (g *PauseGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		g.paused = true
+		g.resume = make(chan struct{})
+	}
+}
+
+func (g *PauseGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resume)
+	}
+}
+
+func (g *PauseGate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait 在暂停期间阻塞，直到继续或 ctx 被取消
+func (g *PauseGate) wait(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+
+	g.mu.Lock()
+	paused, resume := g.paused, g.resume
+	g.mu.Unlock()
+	if !paused {
+		return ctx.Err()
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	ctx := context.Background()
+
+	var nilGate *PauseGate
+	if err := nilGate.wait(ctx); err != nil {
+		t.Fatalf("nil 的 PauseGate 不应阻塞: %v", err)
+	}
+
+	g := NewPauseGate()
+	if err := g.wait(ctx); err != nil {
+		t.Fatalf("未暂停时 wait = %v", err)
+	}
+
+	g.Pause()
+	g.Pause() // 重复暂停不影响继续
+	done := make(chan error, 1)
+	go func() { done <- g.wait(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("暂停期间 wait 提前返回: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	g.Resume()
+	g.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("继续后 wait = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("继续后 wait 未返回")
+	}
+
+	g.Pause()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := g.wait(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("暂停期间取消 wait = %v, 期望 context.Canceled", err)
+	}
+}
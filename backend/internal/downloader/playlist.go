@@ -0,0 +1,346 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/types"
+)
+
+// playlist 是一次 M3U8 解析的结果，主播放列表只填充 Variants 和 Media，媒体播放列表只填充 Segments
+type playlist struct {
+	URL            string
+	Variants       []types.StreamVariant
+	Media          []types.MediaRendition
+	Segments       []segment
+	Renditions     []types.MediaRendition // 由主播放列表为所选档位挑出的独立音频、字幕轨道
+	TargetDuration time.Duration
+	EndList        bool // 出现 #EXT-X-ENDLIST 或 PLAYLIST-TYPE 为 VOD，播放列表不会再增长
+}
+
+func (p *playlist) isMaster() bool {
+	return len(p.Variants) > 0
+}
+
+func fetchPlaylist(ctx context.Context, client *httpclient.Client, playlistURL string) (*playlist, error) {
+	resp, err := client.Get(ctx, playlistURL, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+
+	baseURL, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pl, err := parsePlaylist(resp.Body, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	pl.URL = playlistURL
+	return pl, nil
+}
+
+func parsePlaylist(r io.Reader, baseURL *url.URL) (*playlist, error) {
+	pl := &playlist{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var pendingVariant *types.StreamVariant
+	var currentKey *segmentKey
+	var currentInit *segment
+	var sequence, discontinuity int64
+	var duration float64
+	var pendingRange string
+	// 每个资源上一个字节范围的结束位置，用于推导省略的 offset
+	rangeEnds := make(map[string]int64)
+	index, initIndex := 0, 0
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			if attrs, ok := strings.CutPrefix(line, "#EXT-X-STREAM-INF:"); ok {
+				pendingVariant = parseStreamInf(attrs)
+			} else if attrs, ok := strings.CutPrefix(line, "#EXT-X-MEDIA:"); ok {
+				media, err := parseMedia(attrs, baseURL)
+				if err != nil {
+					return nil, err
+				}
+				pl.Media = append(pl.Media, media)
+			} else if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+				value, _, _ = strings.Cut(value, ",")
+				duration, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			} else if value, ok := strings.CutPrefix(line, "#EXT-X-TARGETDURATION:"); ok {
+				seconds, _ := strconv.Atoi(strings.TrimSpace(value))
+				pl.TargetDuration = time.Duration(seconds) * time.Second
+			} else if value, ok := strings.CutPrefix(line, "#EXT-X-BYTERANGE:"); ok {
+				pendingRange = value
+			} else if line == "#EXT-X-ENDLIST" || line == "#EXT-X-PLAYLIST-TYPE:VOD" {
+				pl.EndList = true
+			} else if value, ok := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); ok {
+				sequence, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			} else if value, ok := strings.CutPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"); ok {
+				discontinuity, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			} else if line == "#EXT-X-DISCONTINUITY" {
+				discontinuity++
+			} else if attrs, ok := strings.CutPrefix(line, "#EXT-X-KEY:"); ok {
+				key, err := parseKey(attrs, baseURL)
+				if err != nil {
+					return nil, err
+				}
+				currentKey = key
+			} else if attrs, ok := strings.CutPrefix(line, "#EXT-X-MAP:"); ok {
+				init, err := parseMap(attrs, baseURL, initIndex)
+				if err != nil {
+					return nil, err
+				}
+				init.Key = currentKey
+				init.Sequence = sequence
+				currentInit = init
+				initIndex++
+			}
+			continue
+		}
+
+		resolvedURL, err := resolveURI(baseURL, line)
+		if err != nil {
+			return nil, fmt.Errorf("解析分片URL失败: %v", err)
+		}
+
+		// #EXT-X-STREAM-INF 之后的第一个 URI 是档位地址而不是分片
+		if pendingVariant != nil {
+			pendingVariant.URL = resolvedURL
+			pl.Variants = append(pl.Variants, *pendingVariant)
+			pendingVariant = nil
+			continue
+		}
+
+		// 存在 #EXT-X-MAP 时分片为 fMP4 片段
+		filename := fmt.Sprintf("segment_%04d.ts", index)
+		if currentInit != nil {
+			filename = fmt.Sprintf("segment_%04d.m4s", index)
+		}
+
+		seg := segment{
+			URL:      resolvedURL,
+			Index:    index,
+			Filename: filename,
+			Sequence: sequence,
+			Key:      currentKey,
+			Init:     currentInit,
+			Duration: duration,
+
+			Discontinuity: discontinuity,
+		}
+
+		if pendingRange != "" {
+			length, offset, hasOffset, err := parseByteRange(pendingRange)
+			if err != nil {
+				return nil, err
+			}
+			if !hasOffset {
+				prevEnd, ok := rangeEnds[resolvedURL]
+				if !ok {
+					return nil, fmt.Errorf("#EXT-X-BYTERANGE 省略了 offset，但 %s 之前没有字节范围", line)
+				}
+				offset = prevEnd
+			}
+			seg.Offset, seg.Length = offset, length
+			rangeEnds[resolvedURL] = offset + length
+		}
+
+		pl.Segments = append(pl.Segments, seg)
+		index++
+		sequence++
+		duration = 0
+		pendingRange = ""
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+func parseStreamInf(attrList string) *types.StreamVariant {
+	attrs := parseAttributeList(attrList)
+	variant := &types.StreamVariant{
+		Codecs:     attrs["CODECS"],
+		Resolution: attrs["RESOLUTION"],
+		Audio:      attrs["AUDIO"],
+		Subtitles:  attrs["SUBTITLES"],
+	}
+
+	variant.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+
+	if w, h, ok := strings.Cut(variant.Resolution, "x"); ok {
+		variant.Width, _ = strconv.Atoi(w)
+		variant.Height, _ = strconv.Atoi(h)
+	}
+
+	return variant
+}
+
+func parseMedia(attrList string, baseURL *url.URL) (types.MediaRendition, error) {
+	attrs := parseAttributeList(attrList)
+	media := types.MediaRendition{
+		Type:     attrs["TYPE"],
+		GroupID:  attrs["GROUP-ID"],
+		Language: attrs["LANGUAGE"],
+		Name:     attrs["NAME"],
+		Default:  attrs["DEFAULT"] == "YES",
+	}
+
+	if attrs["URI"] != "" {
+		mediaURL, err := resolveURI(baseURL, attrs["URI"])
+		if err != nil {
+			return media, fmt.Errorf("解析轨道URL失败: %v", err)
+		}
+		media.URL = mediaURL
+	}
+
+	return media, nil
+}
+
+// parseKey 解析 #EXT-X-KEY，METHOD=NONE 时返回 nil 表示后续分片不加密
+func parseKey(attrList string, baseURL *url.URL) (*segmentKey, error) {
+	attrs := parseAttributeList(attrList)
+
+	switch attrs["METHOD"] {
+	case "NONE":
+		return nil, nil
+	case encryptionAES128:
+	default:
+		return nil, fmt.Errorf("不支持的加密方式: %s", attrs["METHOD"])
+	}
+
+	if format := attrs["KEYFORMAT"]; format != "" && format != "identity" {
+		return nil, fmt.Errorf("不支持的密钥格式: %s", format)
+	}
+	if attrs["URI"] == "" {
+		return nil, fmt.Errorf("#EXT-X-KEY 缺少 URI")
+	}
+
+	keyURI, err := resolveURI(baseURL, attrs["URI"])
+	if err != nil {
+		return nil, fmt.Errorf("解析密钥URL失败: %v", err)
+	}
+
+	key := &segmentKey{Method: attrs["METHOD"], URI: keyURI}
+	if iv := attrs["IV"]; iv != "" {
+		if key.IV, err = parseIV(iv); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// parseMap 解析 #EXT-X-MAP 指定的 fMP4 初始化分片
+func parseMap(attrList string, baseURL *url.URL, initIndex int) (*segment, error) {
+	attrs := parseAttributeList(attrList)
+	if attrs["URI"] == "" {
+		return nil, fmt.Errorf("#EXT-X-MAP 缺少 URI")
+	}
+
+	initURL, err := resolveURI(baseURL, attrs["URI"])
+	if err != nil {
+		return nil, fmt.Errorf("解析初始化分片URL失败: %v", err)
+	}
+
+	init := &segment{
+		URL:      initURL,
+		Index:    initIndex,
+		Filename: fmt.Sprintf("init_%02d.mp4", initIndex),
+	}
+
+	if byteRange := attrs["BYTERANGE"]; byteRange != "" {
+		length, offset, _, err := parseByteRange(byteRange)
+		if err != nil {
+			return nil, err
+		}
+		init.Length, init.Offset = length, offset
+	}
+
+	return init, nil
+}
+
+// parseByteRange 解析 "<length>[@<offset>]" 形式的字节范围
+func parseByteRange(value string) (length, offset int64, hasOffset bool, err error) {
+	lengthStr, offsetStr, hasOffset := strings.Cut(strings.TrimSpace(value), "@")
+
+	length, err = strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || length <= 0 {
+		return 0, 0, false, fmt.Errorf("无效的字节范围: %s", value)
+	}
+
+	if hasOffset {
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("无效的字节范围: %s", value)
+		}
+	}
+
+	return length, offset, hasOffset, nil
+}
+
+// parseAttributeList 解析 M3U8 标签的属性列表，例如 BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributeList(s string) map[string]string {
+	attrs := make(map[string]string)
+
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+
+		attrs[strings.ToUpper(key)] = strings.TrimSpace(value)
+		s = strings.TrimPrefix(strings.TrimLeft(s, " "), ",")
+	}
+
+	return attrs
+}
+
+func resolveURI(baseURL *url.URL, ref string) (string, error) {
+	if strings.HasPrefix(ref, "http") {
+		return ref, nil
+	}
+	resolvedURL, err := baseURL.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return resolvedURL.String(), nil
+}
@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/live/index.m3u8")
+
+	tests := []struct {
+		name     string
+		playlist string
+		check    func(t *testing.T, pl *playlist)
+	}{
+		{
+			name: "media",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+https://other.example.com/b.ts
+`,
+			check: func(t *testing.T, pl *playlist) {
+				if pl.isMaster() || len(pl.Segments) != 2 {
+					t.Fatalf("档位 %d 个，分片 %d 个", len(pl.Variants), len(pl.Segments))
+				}
+				want := []string{"https://cdn.example.com/live/a.ts", "https://other.example.com/b.ts"}
+				for i, seg := range pl.Segments {
+					if seg.URL != want[i] || seg.Index != i {
+						t.Errorf("分片 %d = %s (序号 %d), 期望 %s", i, seg.URL, seg.Index, want[i])
+					}
+				}
+			},
+		},
+		{
+			name: "byterange",
+			playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@0
+media.ts
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:500
+media.ts
+#EXTINF:2.5,
+#EXT-X-BYTERANGE:300@2000
+media.ts
+#EXT-X-ENDLIST
+`,
+			check: func(t *testing.T, pl *playlist) {
+				want := []struct{ offset, length int64 }{{0, 1000}, {1000, 500}, {2000, 300}}
+				if len(pl.Segments) != len(want) {
+					t.Fatalf("分片数 = %d, 期望 %d", len(pl.Segments), len(want))
+				}
+				for i, w := range want {
+					seg := pl.Segments[i]
+					if seg.Offset != w.offset || seg.Length != w.length {
+						t.Errorf("分片 %d 字节范围 = %d@%d, 期望 %d@%d", i, seg.Length, seg.Offset, w.length, w.offset)
+					}
+					if seg.URL != "https://cdn.example.com/live/media.ts" {
+						t.Errorf("分片 %d URL = %s", i, seg.URL)
+					}
+				}
+				if !pl.EndList || pl.TargetDuration.Seconds() != 4 {
+					t.Errorf("EndList = %v, TargetDuration = %v", pl.EndList, pl.TargetDuration)
+				}
+			},
+		},
+		{
+			name: "key and iv",
+			playlist: `#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/key2",IV=0x0102
+#EXTINF:4,
+b.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+c.ts
+`,
+			check: func(t *testing.T, pl *playlist) {
+				segs := pl.Segments
+				if len(segs) != 3 {
+					t.Fatalf("分片数 = %d, 期望 3", len(segs))
+				}
+				if segs[0].Sequence != 7 || segs[2].Sequence != 9 {
+					t.Errorf("媒体序列号 = %d..%d, 期望 7..9", segs[0].Sequence, segs[2].Sequence)
+				}
+				if k := segs[0].Key; k == nil || k.URI != "https://cdn.example.com/live/key1.bin" || k.IV != nil {
+					t.Errorf("分片 0 密钥 = %+v", k)
+				}
+				wantIV := append(make([]byte, 14), 0x01, 0x02)
+				if k := segs[1].Key; k == nil || k.URI != "https://keys.example.com/key2" || !bytes.Equal(k.IV, wantIV) {
+					t.Errorf("分片 1 密钥 = %+v", k)
+				}
+				if segs[2].Key != nil {
+					t.Errorf("METHOD=NONE 之后的分片仍有密钥 %+v", segs[2].Key)
+				}
+			},
+		},
+		{
+			name: "map and discontinuity",
+			playlist: `#EXTM3U
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:6,
+seg1.m4s
+#EXTINF:6,
+seg2.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:5,
+seg3.m4s
+`,
+			check: func(t *testing.T, pl *playlist) {
+				segs := pl.Segments
+				if len(segs) != 3 {
+					t.Fatalf("分片数 = %d, 期望 3", len(segs))
+				}
+				first := segs[0].Init
+				if first == nil || first.URL != "https://cdn.example.com/live/init.mp4" || first.Length != 720 || first.Offset != 0 {
+					t.Fatalf("初始化分片 = %+v", first)
+				}
+				if segs[1].Init != first {
+					t.Error("同一个 #EXT-X-MAP 之后的分片应共享初始化分片")
+				}
+				if segs[2].Init == first || segs[2].Init.Filename != "init_01.mp4" {
+					t.Errorf("切换后的初始化分片 = %+v", segs[2].Init)
+				}
+				for i, want := range []int64{2, 2, 3} {
+					if segs[i].Discontinuity != want {
+						t.Errorf("分片 %d 不连续序号 = %d, 期望 %d", i, segs[i].Discontinuity, want)
+					}
+				}
+				if !strings.HasSuffix(segs[0].Filename, ".m4s") {
+					t.Errorf("fMP4 分片文件名 = %s", segs[0].Filename)
+				}
+			},
+		},
+		{
+			name: "master",
+			playlist: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud"
+360p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,AUDIO="aud"
+720p.m3u8
+`,
+			check: func(t *testing.T, pl *playlist) {
+				if !pl.isMaster() || len(pl.Variants) != 2 || len(pl.Segments) != 0 {
+					t.Fatalf("档位 %d 个，分片 %d 个", len(pl.Variants), len(pl.Segments))
+				}
+				v := pl.Variants[0]
+				if v.Bandwidth != 800000 || v.Width != 640 || v.Height != 360 || v.Codecs != "avc1.4d401e,mp4a.40.2" {
+					t.Errorf("档位 0 = %+v", v)
+				}
+				if pl.Variants[1].URL != "https://cdn.example.com/live/720p.m3u8" || pl.Variants[1].Audio != "aud" {
+					t.Errorf("档位 1 = %+v", pl.Variants[1])
+				}
+				if len(pl.Media) != 1 || pl.Media[0].Language != "en" || !pl.Media[0].Default || pl.Media[0].URL != "https://cdn.example.com/live/audio/en.m3u8" {
+					t.Errorf("独立轨道 = %+v", pl.Media)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl, err := parsePlaylist(strings.NewReader(tt.playlist), base)
+			if err != nil {
+				t.Fatalf("parsePlaylist: %v", err)
+			}
+			tt.check(t, pl)
+		})
+	}
+}
+
+func TestParsePlaylistErrors(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/index.m3u8")
+
+	tests := []struct {
+		name     string
+		playlist string
+	}{
+		{"byterange without previous range", "#EXTM3U\n#EXTINF:4,\n#EXT-X-BYTERANGE:500\na.ts\n"},
+		{"invalid byterange", "#EXTM3U\n#EXTINF:4,\n#EXT-X-BYTERANGE:abc@0\na.ts\n"},
+		{"unsupported key method", "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\n#EXTINF:4,\na.ts\n"},
+		{"unsupported key format", "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",KEYFORMAT=\"com.apple.streamingkeydelivery\"\n#EXTINF:4,\na.ts\n"},
+		{"key without uri", "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128\n#EXTINF:4,\na.ts\n"},
+		{"map without uri", "#EXTM3U\n#EXT-X-MAP:BYTERANGE=\"10@0\"\n#EXTINF:4,\na.m4s\n"},
+		{"invalid map byterange", "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"abc\"\n#EXTINF:4,\na.m4s\n"},
+		{"invalid iv", "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0xZZ\n#EXTINF:4,\na.ts\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePlaylist(strings.NewReader(tt.playlist), base); err == nil {
+				t.Error("期望返回错误")
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package downloader
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// byteStats 统计一组分片实际接收的字节数，并根据已知大小的分片估算总大小
+type byteStats struct {
+	received atomic.Int64 // 含进行中的分片，失败的请求会扣除已计入的字节
+
+	mu            sync.Mutex
+	sizes         map[string]int64 // 已知大小的分片：响应的 Content-Length、字节范围长度或已完成的文件大小
+	durations     map[string]float64
+	count         int
+	totalDuration float64 // 全部分片都有时长时为 #EXTINF 时长之和，否则为 0
+}
+
+func newByteStats(segments []segment) *byteStats {
+	s := &byteStats{
+		sizes:     make(map[string]int64),
+		durations: make(map[string]float64, len(segments)),
+		count:     len(segments),
+	}
+	timed := true
+	for _, seg := range segments {
+		s.durations[seg.Filename] = seg.Duration
+		s.totalDuration += seg.Duration
+		timed = timed && seg.Duration > 0
+		if seg.Length > 0 {
+			s.sizes[seg.Filename] = seg.Length
+		}
+	}
+	if !timed {
+		s.totalDuration = 0
+	}
+	return s
+}
+
+// sample 记录分片的大小，size 不大于 0 时忽略
+func (s *byteStats) sample(seg segment, size int64) {
+	if s == nil || size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.sizes[seg.Filename] = size
+	s.mu.Unlock()
+}
+
+// add 累加接收的字节数，失败时以负数扣除
+func (s *byteStats) add(n int64) {
+	if s != nil {
+		s.received.Add(n)
+	}
+}
+
+// estimate 估算全部分片的总字节数：分片都有 #EXTINF 时长时按已知分片的码率乘以总时长推算，
+// 否则按已知分片的平均大小推算；还没有已知大小的分片时返回 0
+func (s *byteStats) estimate() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sizes) == 0 {
+		return 0
+	}
+	var known int64
+	var knownDuration float64
+	for filename, size := range s.sizes {
+		known += size
+		knownDuration += s.durations[filename]
+	}
+	if len(s.sizes) >= s.count {
+		return known
+	}
+	if s.totalDuration > 0 && knownDuration > 0 {
+		return known + int64(float64(known)/knownDuration*(s.totalDuration-knownDuration))
+	}
+	return known * int64(s.count) / int64(len(s.sizes))
+}
+
+// progress 在 info 中填写已接收字节数和估算的总大小，接收的字节超过估算时以接收的为准
+func (s *byteStats) progress(info ProgressInfo) ProgressInfo {
+	info.DownloadedBytes = s.received.Load()
+	info.TotalBytes = s.estimate()
+	if info.TotalBytes > 0 && info.DownloadedBytes > info.TotalBytes {
+		info.TotalBytes = info.DownloadedBytes
+	}
+	return info
+}
+
+// countingReader 在读取响应体时累计进度
+type countingReader struct {
+	r     io.Reader
+	read  int64
+	stats *byteStats
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read += int64(n)
+	cr.stats.add(int64(n))
+	return n, err
+}
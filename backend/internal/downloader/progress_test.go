@@ -0,0 +1,59 @@
+package downloader
+
+import "testing"
+
+func TestByteStatsEstimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []segment
+		samples  map[int]int64
+		want     int64
+	}{
+		{
+			name:     "no samples",
+			segments: []segment{{Filename: "a"}, {Filename: "b"}},
+			want:     0,
+		},
+		{
+			name:     "by duration",
+			segments: []segment{{Filename: "a", Duration: 2}, {Filename: "b", Duration: 4}, {Filename: "c", Duration: 4}},
+			samples:  map[int]int64{0: 1000},
+			want:     5000,
+		},
+		{
+			name:     "by average size",
+			segments: []segment{{Filename: "a"}, {Filename: "b", Duration: 4}, {Filename: "c"}, {Filename: "d"}},
+			samples:  map[int]int64{0: 100, 1: 300},
+			want:     800,
+		},
+		{
+			name:     "byte ranges known",
+			segments: []segment{{Filename: "a", Length: 10}, {Filename: "b", Length: 20}},
+			want:     30,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newByteStats(tt.segments)
+			for i, size := range tt.samples {
+				s.sample(tt.segments[i], size)
+			}
+			if got := s.estimate(); got != tt.want {
+				t.Errorf("估算总大小 = %d, 期望 %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestByteStatsProgress(t *testing.T) {
+	s := newByteStats([]segment{{Filename: "a", Length: 100}})
+	s.add(150)
+	if info := s.progress(ProgressInfo{}); info.DownloadedBytes != 150 || info.TotalBytes != 150 {
+		t.Errorf("进度 = %d/%d, 期望接收的字节超过估算时以接收的为准", info.DownloadedBytes, info.TotalBytes)
+	}
+	s.add(-100)
+	if info := s.progress(ProgressInfo{}); info.DownloadedBytes != 50 || info.TotalBytes != 100 {
+		t.Errorf("进度 = %d/%d, 期望 50/100", info.DownloadedBytes, info.TotalBytes)
+	}
+}
@@ -0,0 +1,213 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"videoDownload/internal/httpclient"
+)
+
+// Downloader 是一种下载协议的实现，通过 Registry 按 URL 选择
+type Downloader interface {
+	Name() string
+
+	// Probe 在 URL 的协议、扩展名和 Content-Type 都没有匹配到下载器时调用，判断能否处理该 URL。
+	// client 附加了任务的请求头和 Cookie，为 nil 时使用 httpclient.Default
+	Probe(ctx context.Context, client *httpclient.Client, url string) (bool, error)
+
+	// Download 把 url 下载为 outputFilename，实际输出文件可能调整扩展名，见 Result。
+	// emit 可以为 nil，不会被并发调用；ctx 取消时应停止全部请求并返回 ctx.Err()
+	Download(ctx context.Context, url, outputFilename string, opts Options, emit func(Event)) (*Result, error)
+}
+
+// Event 是下载器上报的事件，具体类型为 ProgressEvent 或 RecordingEvent
+type Event interface {
+	event()
+}
+
+// ProgressEvent 报告有总量的下载进度
+type ProgressEvent struct {
+	Downloaded int    // 已完成的分片或分块数
+	Total      int    // 分片或分块总数
+	Current    string // 最近完成的分片
+
+	// 下载器能统计实际字节时填写，否则为 0。TotalBytes 可以是估算值，随下载进行逐渐准确
+	DownloadedBytes int64
+	TotalBytes      int64 // 总大小未知时为 0
+}
+
+// RecordingEvent 报告直播录制的已录制时长，录制任务没有总量
+type RecordingEvent struct {
+	Recorded time.Duration
+}
+
+func (ProgressEvent) event()  {}
+func (RecordingEvent) event() {}
+
+// progressEvents 把内部使用的 ProgressInfo 回调转换为 Event
+func progressEvents(emit func(Event)) func(ProgressInfo) {
+	if emit == nil {
+		return nil
+	}
+	return func(info ProgressInfo) {
+		if info.Live {
+			emit(RecordingEvent{Recorded: info.Recorded})
+			return
+		}
+		emit(ProgressEvent{
+			Downloaded:      info.Downloaded,
+			Total:           info.Total,
+			Current:         info.Current,
+			DownloadedBytes: info.DownloadedBytes,
+			TotalBytes:      info.TotalBytes,
+		})
+	}
+}
+
+// Registry 按 URL 协议、扩展名或 Content-Type 选择下载器。注册的下载器需要是可比较的类型，通常为指针
+type Registry struct {
+	mu          sync.RWMutex
+	schemes     map[string]Downloader
+	extensions  map[string]Downloader
+	mimeTypes   map[string]Downloader
+	downloaders []Downloader // 按注册顺序，用于 Probe
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		schemes:    make(map[string]Downloader),
+		extensions: make(map[string]Downloader),
+		mimeTypes:  make(map[string]Downloader),
+	}
+}
+
+// DefaultRegistry 注册了内置的 HLS、DASH 和直接下载，其他协议可以在服务启动前注册到这里
+var DefaultRegistry = newDefaultRegistry()
+
+func newDefaultRegistry() *Registry {
+	r := NewRegistry()
+
+	hls := hlsDownloader{}
+	r.RegisterExtension(".m3u8", hls)
+	for _, mt := range hlsContentTypes {
+		r.RegisterMIME(mt, hls)
+	}
+
+	dash := dashDownloader{}
+	r.RegisterExtension(".mpd", dash)
+	for _, mt := range dashContentTypes {
+		r.RegisterMIME(mt, dash)
+	}
+
+	file := fileDownloader{}
+	for _, ext := range directExtensions {
+		r.RegisterExtension(ext, file)
+	}
+	for mt := range directContentTypes {
+		r.RegisterMIME(mt, file)
+	}
+	return r
+}
+
+// RegisterScheme 注册处理 URL 协议（如 "rtmp"）的下载器，优先于扩展名和 Content-Type
+func (r *Registry) RegisterScheme(scheme string, d Downloader) {
+	r.register(r.schemes, strings.ToLower(strings.TrimSuffix(scheme, "://")), d)
+}
+
+// RegisterExtension 注册处理 URL 路径扩展名（如 ".mpd"）的下载器
+func (r *Registry) RegisterExtension(ext string, d Downloader) {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	r.register(r.extensions, strings.ToLower(ext), d)
+}
+
+// RegisterMIME 注册处理 Content-Type（如 "video/mp4"）的下载器，参数部分被忽略
+func (r *Registry) RegisterMIME(contentType string, d Downloader) {
+	mt := mediaType(contentType)
+	if mt == "" {
+		mt = strings.ToLower(contentType)
+	}
+	r.register(r.mimeTypes, mt, d)
+}
+
+// register 记录下载器，同一个键后注册的覆盖先注册的
+func (r *Registry) register(m map[string]Downloader, key string, d Downloader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m[key] = d
+	for _, existing := range r.downloaders {
+		if existing == d {
+			return
+		}
+	}
+	r.downloaders = append(r.downloaders, d)
+}
+
+// Lookup 依次按 URL 协议、路径扩展名、HTTP 响应的 Content-Type 查找下载器，
+// 都没有匹配时按注册顺序调用各下载器的 Probe。探测请求通过 client 发送
+func (r *Registry) Lookup(ctx context.Context, client *httpclient.Client, rawURL string) (Downloader, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 URL: %v", err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+
+	r.mu.RLock()
+	d, ok := r.schemes[scheme]
+	if !ok {
+		d, ok = r.extensions[urlExtension(rawURL)]
+	}
+	downloaders := append([]Downloader(nil), r.downloaders...)
+	r.mu.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	if scheme == "http" || scheme == "https" {
+		if contentType, err := fetchContentType(ctx, client, rawURL); err == nil {
+			r.mu.RLock()
+			d, ok = r.mimeTypes[mediaType(contentType)]
+			r.mu.RUnlock()
+			if ok {
+				return d, nil
+			}
+		}
+	}
+
+	for _, d := range downloaders {
+		if ok, err := d.Probe(ctx, client, rawURL); err == nil && ok {
+			return d, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("没有可以处理该地址的下载器: %s", rawURL)
+}
+
+// fetchContentType 请求资源的第一个字节以获取 Content-Type，不读取响应体
+func fetchContentType(ctx context.Context, client *httpclient.Client, rawURL string) (string, error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req, 0)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("HTTP 错误: %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,496 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/types"
+)
+
+const (
+	renditionAudio     = "AUDIO"
+	renditionSubtitles = "SUBTITLES"
+)
+
+// Result 汇总一次下载实际产生的文件
+type Result struct {
+	OutputFilename string                // 实际的输出文件，可能因分片格式调整扩展名
+	Renditions     []types.RenditionFile // 单独保存的音频、字幕轨道
+	Gaps           []types.TimeRange     // 在允许范围内缺失的分片在输出文件中的时间范围
+	Stopped        bool                  // 直播录制因 ctx 取消提前停止，输出文件仍然有效
+}
+
+// track 是需要单独下载的一条媒体播放列表，视频轨道的 rendition 为零值
+type track struct {
+	rendition types.MediaRendition
+	segments  []segment
+	dir       string
+	output    string
+	start     float64 // 第一个分片在源时间轴上的起始时间（秒），按时间范围裁剪后不为 0
+}
+
+// selectRenditions 按 opts 为档位挑选独立的音频、字幕轨道。
+// 未指定音频语言时使用音频组的默认轨道，未指定字幕语言时不下载字幕。
+func selectRenditions(media []types.MediaRendition, variant types.StreamVariant, opts Options) []types.MediaRendition {
+	var selected []types.MediaRendition
+	selected = append(selected, pickRenditions(media, renditionAudio, variant.Audio, opts.AudioLanguages, true)...)
+	selected = append(selected, pickRenditions(media, renditionSubtitles, variant.Subtitles, opts.SubtitleLanguages, false)...)
+	return selected
+}
+
+func pickRenditions(media []types.MediaRendition, mediaType, groupID string, languages []string, useDefault bool) []types.MediaRendition {
+	if groupID == "" {
+		return nil
+	}
+
+	var candidates []types.MediaRendition
+	for _, m := range media {
+		if m.Type == mediaType && m.GroupID == groupID {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if len(languages) == 0 {
+		if !useDefault {
+			return nil
+		}
+		pick := candidates[0]
+		for _, m := range candidates {
+			if m.Default {
+				pick = m
+				break
+			}
+		}
+		// 没有 URI 的默认轨道已经包含在档位流中
+		if pick.URL == "" {
+			return nil
+		}
+		return []types.MediaRendition{pick}
+	}
+
+	var picked []types.MediaRendition
+	seen := make(map[string]bool)
+	for _, lang := range languages {
+		for _, m := range candidates {
+			if m.URL == "" || seen[m.URL] || !matchRendition(m, lang) {
+				continue
+			}
+			picked = append(picked, m)
+			seen[m.URL] = true
+			if !strings.EqualFold(lang, "all") {
+				break
+			}
+		}
+	}
+	return picked
+}
+
+func matchRendition(m types.MediaRendition, lang string) bool {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	language := strings.ToLower(m.Language)
+	return lang == "all" ||
+		language == lang ||
+		strings.HasPrefix(language, lang+"-") ||
+		strings.EqualFold(m.Name, lang)
+}
+
+// downloadWithRenditions 并行下载视频和选中的音频、字幕轨道，各轨道单独保存后再封装为一个输出文件
+func downloadWithRenditions(ctx context.Context, client *httpclient.Client, video *playlist, tmpDir string, keys *keyCache, opts Options, outputFilename string, progressCallback func(ProgressInfo)) (*Result, error) {
+	tracks := []*track{{
+		segments: video.Segments,
+		dir:      filepath.Join(tmpDir, "video"),
+		output:   filepath.Join(tmpDir, "video"+filepath.Ext(outputFilename)),
+	}}
+
+	for i, r := range video.Renditions {
+		name := fmt.Sprintf("%s_%d", strings.ToLower(r.Type), i)
+		pl, err := cachedPlaylist(tmpDir, name, func() (*playlist, error) {
+			return fetchPlaylist(ctx, client, r.URL)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("获取轨道 %s 播放列表失败: %v", renditionLabel(r), err)
+		}
+		if len(pl.Segments) == 0 {
+			return nil, fmt.Errorf("轨道 %s 中未找到任何分片", renditionLabel(r))
+		}
+		segments, err := filterAds(pl.Segments, opts.Ads)
+		if err != nil {
+			return nil, fmt.Errorf("轨道 %s: %v", renditionLabel(r), err)
+		}
+		tracks = append(tracks, &track{
+			rendition: r,
+			segments:  segments,
+			dir:       filepath.Join(tmpDir, name),
+			output:    renditionPath(outputFilename, r, ""),
+		})
+	}
+
+	if opts.clipping() {
+		if err := clipTracks(tracks, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := downloadTracks(ctx, client, tracks, keys, opts.Pause, opts.Report, progressCallback); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("\n开始合并分片...")
+	gaps, origin := skipMissingTracks(tracks, opts.Report)
+	result := &Result{OutputFilename: outputFilename, Gaps: outputGaps(gaps, origin, opts)}
+	for _, t := range tracks {
+		var err error
+		if t.rendition.Type == renditionSubtitles {
+			err = mergeSubtitles(t.segments, t.dir, t.output)
+		} else {
+			if t.rendition.Type != "" {
+				// 下载完成后才能按分片的实际格式确定音频轨道的扩展名
+				t.output = renditionPath(outputFilename, t.rendition, trackFormat(t))
+			}
+			t.output, err = mergeSegments(ctx, t.segments, t.dir, t.output)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("合并轨道 %s 失败: %v", trackLabel(t), err)
+		}
+
+		if t.rendition.Type != "" {
+			result.Renditions = append(result.Renditions, types.RenditionFile{
+				Type:     t.rendition.Type,
+				Language: t.rendition.Language,
+				Name:     t.rendition.Name,
+				Path:     t.output,
+			})
+		}
+	}
+
+	// 没有 ffmpeg 时视频轨道直接作为输出文件，扩展名随视频轨道的实际格式
+	if ext := filepath.Ext(tracks[0].output); !FFmpegAvailable() && !strings.EqualFold(ext, filepath.Ext(outputFilename)) {
+		outputFilename = strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ext
+		result.OutputFilename = outputFilename
+	}
+	if err := muxRenditions(ctx, tracks[0].output, result.Renditions, outputFilename); err != nil {
+		return nil, fmt.Errorf("封装音频/字幕轨道失败: %v", err)
+	}
+	if err := trimClip(ctx, tmpDir, outputFilename, origin, opts); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("下载完成: %s\n", outputFilename)
+	return result, nil
+}
+
+// skipMissingTracks 从每个轨道去掉允许缺失的分片，返回各轨道缺失的源时间范围，
+// 以及合并后输出文件开头对应的源时间，即各轨道第一个剩余分片中最早的起始时间
+func skipMissingTracks(tracks []*track, report *IntegrityReport) ([]types.TimeRange, float64) {
+	var gaps []types.TimeRange
+	origin := -1.0
+	for i, t := range tracks {
+		label := ""
+		if i > 0 {
+			label = trackLabel(t)
+		}
+		var trackGaps []types.TimeRange
+		var first float64
+		t.segments, trackGaps, first = skipMissing(t.segments, report, label, t.start)
+		gaps = append(gaps, trackGaps...)
+		if origin < 0 || first < origin {
+			origin = first
+		}
+	}
+	return gaps, max(origin, 0)
+}
+
+// downloadTracks 并行下载各轨道的分片，进度按全部轨道的分片总数合并上报
+func downloadTracks(ctx context.Context, client *httpclient.Client, tracks []*track, keys *keyCache, gate *PauseGate, report *IntegrityReport, progressCallback func(ProgressInfo)) error {
+	total := 0
+	for _, t := range tracks {
+		total += len(t.segments)
+	}
+	fmt.Printf("发现 %d 个分片（含 %d 条独立音频/字幕轨道）\n", total, len(tracks)-1)
+
+	progressChan := make(chan ProgressInfo, total)
+	go displayProgress(progressChan, total)
+	aggregator := &progressAggregator{
+		tracks:       make([]ProgressInfo, len(tracks)),
+		total:        total,
+		progressChan: progressChan,
+		callback:     progressCallback,
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(tracks))
+	for i, t := range tracks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = downloadTrack(ctx, client, t, keys, gate, report, aggregator.track(i))
+		}()
+	}
+	wg.Wait()
+	close(progressChan)
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("下载轨道 %s 失败: %v", trackLabel(tracks[i]), err)
+		}
+	}
+	return nil
+}
+
+func downloadTrack(ctx context.Context, client *httpclient.Client, t *track, keys *keyCache, gate *PauseGate, report *IntegrityReport, progressCallback func(ProgressInfo)) error {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	if err := downloadInitSegments(ctx, client, t.segments, t.dir, keys, report); err != nil {
+		return fmt.Errorf("下载初始化分片失败: %v", err)
+	}
+	return downloadSegments(ctx, client, t.segments, t.dir, keys, gate, report, nil, progressCallback)
+}
+
+// progressAggregator 把各轨道的分片进度合并为整个任务的进度。
+// 任一轨道还没有估算出总大小时，合并后的总字节数为 0
+type progressAggregator struct {
+	mu           sync.Mutex
+	tracks       []ProgressInfo
+	total        int
+	progressChan chan<- ProgressInfo
+	callback     func(ProgressInfo)
+}
+
+func (a *progressAggregator) track(i int) func(ProgressInfo) {
+	return func(info ProgressInfo) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		advanced := info.Downloaded != a.tracks[i].Downloaded
+		a.tracks[i] = info
+		combined := ProgressInfo{Total: a.total, Current: info.Current}
+		estimated := true
+		for _, t := range a.tracks {
+			combined.Downloaded += t.Downloaded
+			combined.DownloadedBytes += t.DownloadedBytes
+			combined.TotalBytes += t.TotalBytes
+			estimated = estimated && t.TotalBytes > 0
+		}
+		if !estimated {
+			combined.TotalBytes = 0
+		}
+
+		// 控制台只在分片完成时刷新
+		if advanced {
+			a.progressChan <- combined
+		}
+		if a.callback != nil {
+			a.callback(combined)
+		}
+	}
+}
+
+// mergeSubtitles 拼接 WebVTT 字幕分片，只保留第一个文件头
+func mergeSubtitles(segments []segment, tmpDir, outputFilename string) error {
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建字幕文件失败: %v", err)
+	}
+	defer out.Close()
+
+	if _, err := io.WriteString(out, "WEBVTT\n\n"); err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		data, err := os.ReadFile(filepath.Join(tmpDir, seg.Filename))
+		if err != nil {
+			return fmt.Errorf("分片文件 %s 不存在", seg.Filename)
+		}
+
+		text := strings.ReplaceAll(strings.TrimPrefix(string(data), "\ufeff"), "\r\n", "\n")
+		if strings.HasPrefix(text, "WEBVTT") {
+			// 文件头到第一个空行为止
+			if end := strings.Index(text, "\n\n"); end >= 0 {
+				text = text[end+2:]
+			} else {
+				text = ""
+			}
+		}
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if _, err := io.WriteString(out, text+"\n\n"); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// muxRenditions 用 ffmpeg 把视频和独立轨道封装到输出文件，并写入语言标签。
+// 未安装 ffmpeg 时只输出视频，独立轨道仍以单独文件保留。
+func muxRenditions(ctx context.Context, videoPath string, renditions []types.RenditionFile, outputFilename string) error {
+	if !FFmpegAvailable() {
+		fmt.Println("未找到 ffmpeg，音频/字幕轨道仅以单独文件保存")
+		return moveFile(videoPath, outputFilename)
+	}
+
+	args := []string{"-i", videoPath}
+	for _, r := range renditions {
+		args = append(args, "-i", r.Path)
+	}
+
+	// 选择了独立音轨时不再保留档位流中可能存在的音频
+	hasAudio := false
+	for _, r := range renditions {
+		if r.Type == renditionAudio {
+			hasAudio = true
+		}
+	}
+	args = append(args, "-map", "0:v")
+	if !hasAudio {
+		args = append(args, "-map", "0:a?")
+	}
+
+	// mov_text 字幕只能封装进 MP4，其他容器保留单独的字幕文件
+	embedSubtitles := strings.EqualFold(filepath.Ext(outputFilename), ".mp4")
+
+	audioIndex, subtitleIndex := 0, 0
+	var metadata []string
+	for i, r := range renditions {
+		if r.Type == renditionSubtitles && !embedSubtitles {
+			continue
+		}
+		var spec string
+		if r.Type == renditionAudio {
+			args = append(args, "-map", fmt.Sprintf("%d:a", i+1))
+			spec = fmt.Sprintf("a:%d", audioIndex)
+			audioIndex++
+		} else {
+			args = append(args, "-map", fmt.Sprintf("%d:s", i+1))
+			spec = fmt.Sprintf("s:%d", subtitleIndex)
+			subtitleIndex++
+		}
+		if r.Language != "" {
+			metadata = append(metadata, "-metadata:s:"+spec, "language="+iso639Code(r.Language))
+		}
+		if r.Name != "" {
+			metadata = append(metadata, "-metadata:s:"+spec, "title="+r.Name)
+		}
+	}
+
+	args = append(args, "-c", "copy")
+	if subtitleIndex > 0 {
+		args = append(args, "-c:s", "mov_text")
+	}
+	args = append(args, metadata...)
+	args = append(args, "-y", outputFilename)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// renditionPath 返回独立轨道文件的保存路径，例如 video_1234.audio.en.m4a。
+// 音频轨道的扩展名与 selectMerger 一样按分片格式选择：TS 为 .ts，ADTS 为 .aac，其他为 .m4a
+func renditionPath(outputFilename string, r types.MediaRendition, format string) string {
+	base := strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename))
+	var ext string
+	switch {
+	case r.Type == renditionSubtitles:
+		ext = ".vtt"
+	case format == "ts":
+		ext = ".ts"
+	case format == "aac":
+		ext = ".aac"
+	default:
+		ext = ".m4a"
+	}
+	return fmt.Sprintf("%s.%s.%s%s", base, strings.ToLower(r.Type), safeFilenamePart(renditionLabel(r)), ext)
+}
+
+// trackFormat 按第一个分片识别轨道的格式，fMP4 分片返回空字符串
+func trackFormat(t *track) string {
+	if len(t.segments) == 0 || hasInitSegments(t.segments) {
+		return ""
+	}
+	return sniffSegment(filepath.Join(t.dir, t.segments[0].Filename))
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func safeFilenamePart(s string) string {
+	s = strings.Trim(unsafeFilenameChars.ReplaceAllString(s, "_"), "_")
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+func renditionLabel(r types.MediaRendition) string {
+	if r.Language != "" {
+		return r.Language
+	}
+	return r.Name
+}
+
+func trackLabel(t *track) string {
+	if t.rendition.Type == "" {
+		return "视频"
+	}
+	return fmt.Sprintf("%s(%s)", t.rendition.Type, renditionLabel(t.rendition))
+}
+
+// iso639Code 把常见的 ISO 639-1 双字母语言代码转换为 MP4 使用的 ISO 639-2 三字母代码
+func iso639Code(language string) string {
+	codes := map[string]string{
+		"en": "eng", "zh": "chi", "ja": "jpn", "ko": "kor", "fr": "fre",
+		"de": "ger", "es": "spa", "it": "ita", "pt": "por", "ru": "rus",
+		"ar": "ara", "hi": "hin", "th": "tha", "vi": "vie", "id": "ind",
+		"ms": "may", "tr": "tur", "nl": "dut", "pl": "pol", "sv": "swe",
+	}
+
+	primary, _, _ := strings.Cut(strings.ToLower(language), "-")
+	if code, ok := codes[primary]; ok {
+		return code
+	}
+	return primary
+}
+
+// moveFile 移动文件，跨文件系统时退回到复制
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"videoDownload/internal/types"
+)
+
+func TestSelectRenditions(t *testing.T) {
+	media := []types.MediaRendition{
+		{Type: renditionAudio, GroupID: "aud", Language: "en", Name: "English", URL: "en.m3u8"},
+		{Type: renditionAudio, GroupID: "aud", Language: "ja", Name: "日本語", Default: true, URL: "ja.m3u8"},
+		{Type: renditionAudio, GroupID: "aud", Language: "zh-Hans", Name: "中文", URL: "zh.m3u8"},
+		{Type: renditionAudio, GroupID: "muxed", Language: "en", Default: true},
+		{Type: renditionSubtitles, GroupID: "subs", Language: "en", URL: "sub_en.m3u8"},
+		{Type: renditionSubtitles, GroupID: "subs", Language: "zh", URL: "sub_zh.m3u8"},
+	}
+	variant := types.StreamVariant{Audio: "aud", Subtitles: "subs"}
+
+	tests := []struct {
+		name    string
+		variant types.StreamVariant
+		opts    Options
+		want    []string
+	}{
+		{"default audio only", variant, Options{}, []string{"ja.m3u8"}},
+		{"audio language prefix", variant, Options{AudioLanguages: []string{"zh"}}, []string{"zh.m3u8"}},
+		{"audio by name", variant, Options{AudioLanguages: []string{"english"}}, []string{"en.m3u8"}},
+		{"all audio", variant, Options{AudioLanguages: []string{"all"}}, []string{"en.m3u8", "ja.m3u8", "zh.m3u8"}},
+		{"subtitles", variant, Options{SubtitleLanguages: []string{"zh", "en"}}, []string{"ja.m3u8", "sub_zh.m3u8", "sub_en.m3u8"}},
+		{"unknown language", variant, Options{AudioLanguages: []string{"fr"}}, nil},
+		{"default audio muxed in variant", types.StreamVariant{Audio: "muxed"}, Options{}, nil},
+		{"no groups", types.StreamVariant{}, Options{AudioLanguages: []string{"all"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range selectRenditions(media, tt.variant, tt.opts) {
+				got = append(got, r.URL)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("选择了 %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	parts := []string{
+		"\ufeffWEBVTT\r\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\r\n\r\n00:00.000 --> 00:02.000\r\n第一句\r\n",
+		"WEBVTT\n\n",
+		"WEBVTT\n\n00:04.000 --> 00:06.000\n第二句\n",
+	}
+	var segments []segment
+	for i, part := range parts {
+		seg := segment{Filename: fmt.Sprintf("segment_%04d.vtt", i)}
+		if err := os.WriteFile(filepath.Join(dir, seg.Filename), []byte(part), 0644); err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, seg)
+	}
+
+	output := filepath.Join(dir, "out.vtt")
+	if err := mergeSubtitles(segments, dir, output); err != nil {
+		t.Fatalf("mergeSubtitles: %v", err)
+	}
+	data, _ := os.ReadFile(output)
+	want := "WEBVTT\n\n00:00.000 --> 00:02.000\n第一句\n\n00:04.000 --> 00:06.000\n第二句\n\n"
+	if string(data) != want {
+		t.Errorf("合并结果 = %q, 期望 %q", data, want)
+	}
+}
+
+func TestRenditionPath(t *testing.T) {
+	tests := []struct {
+		rendition types.MediaRendition
+		format    string
+		want      string
+	}{
+		{types.MediaRendition{Type: renditionAudio, Language: "en"}, "", "out/video_1.audio.en.m4a"},
+		{types.MediaRendition{Type: renditionAudio, Language: "en"}, "ts", "out/video_1.audio.en.ts"},
+		{types.MediaRendition{Type: renditionAudio, Language: "en"}, "aac", "out/video_1.audio.en.aac"},
+		{types.MediaRendition{Type: renditionSubtitles, Language: "zh-Hans"}, "", "out/video_1.subtitles.zh-Hans.vtt"},
+		{types.MediaRendition{Type: renditionAudio, Name: "Director's cut"}, "", "out/video_1.audio.Director_s_cut.m4a"},
+		{types.MediaRendition{Type: renditionAudio}, "", "out/video_1.audio.default.m4a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := renditionPath("out/video_1.mp4", tt.rendition, tt.format); got != tt.want {
+				t.Errorf("renditionPath = %s, 期望 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelledRemovesRenditionFiles(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "video_1.mp4")
+	removed := []string{"video_1.mp4", "video_1.audio.en.aac", "video_1.subtitles.zh.vtt"}
+	kept := []string{"video_12.audio.en.m4a", "video_1.m4a.part", "other.mp4"}
+	for _, name := range append(removed, kept...) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cancelled(ctx, output); err != context.Canceled {
+		t.Fatalf("cancelled = %v, 期望 %v", err, context.Canceled)
+	}
+	for _, name := range removed {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("取消后应删除 %s", name)
+		}
+	}
+	for _, name := range kept {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("不应删除 %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"videoDownload/internal/remux"
+)
+
+// tsMerger 以纯 Go 方式拼接 MPEG-TS 分片：逐包检查同步字节，
+// 并平移每个分片内各 PID 的连续计数器，使其在分片边界处保持连续。
+// 不连续段的 PCR、PTS、DTS 整体平移到上一段之后，并留出不连续点要求的空白。
+type tsMerger struct {
+	discontinuities []remux.Discontinuity
+}
+
+func (m *tsMerger) Name() string {
+	return "原生 TS 拼接"
+}
+
+func (m *tsMerger) Merge(ctx context.Context, inputs []string, outputFilename string) error {
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, 1<<20)
+	counters := newContinuityState()
+	var timestamps timestampState
+
+	for i, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return fmt.Errorf("分片文件 %s 不存在", filepath.Base(input))
+		}
+
+		packets, skipped := remux.SplitPackets(data)
+		if len(packets) == 0 {
+			return fmt.Errorf("分片 %s 不是有效的 MPEG-TS 数据", filepath.Base(input))
+		}
+		if skipped > 0 {
+			fmt.Printf("分片 %s 丢弃了 %d 字节无法同步的数据\n", filepath.Base(input), skipped)
+		}
+
+		counters.rebase(packets)
+		if j := slices.IndexFunc(m.discontinuities, func(d remux.Discontinuity) bool { return d.Input == i }); j >= 0 {
+			timestamps.discontinuity(packets, m.discontinuities[j].Gap)
+		}
+		timestamps.shift(packets)
+		for _, pkt := range packets {
+			if _, err := w.Write(pkt); err != nil {
+				return fmt.Errorf("写入输出文件失败: %v", err)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	return out.Close()
+}
+
+// continuityState 记录每个 PID 已写出的最后一个连续计数器
+type continuityState struct {
+	last map[uint16]byte
+}
+
+func newContinuityState() *continuityState {
+	return &continuityState{last: make(map[uint16]byte)}
+}
+
+// rebase 以分片内每个 PID 第一个带负载的包为基准，把整个分片该 PID 的计数器平移到接续上一分片的位置
+func (cs *continuityState) rebase(packets [][]byte) {
+	delta := make(map[uint16]byte)
+
+	for _, pkt := range packets {
+		pid := remux.PacketPID(pkt)
+		if pid == remux.NullPID {
+			continue
+		}
+
+		hasPayload := pkt[3]&0x10 != 0
+		cc := pkt[3] & 0x0F
+
+		d, known := delta[pid]
+		if !known {
+			last, seen := cs.last[pid]
+			switch {
+			case !seen:
+				d = 0
+			case hasPayload:
+				d = (last + 1 - cc) & 0x0F
+			default:
+				d = (last - cc) & 0x0F
+			}
+			delta[pid] = d
+		}
+
+		cc = (cc + d) & 0x0F
+		pkt[3] = pkt[3]&0xF0 | cc
+		cs.last[pid] = cc
+	}
+}
+
+const (
+	tsTimestampMask = int64(1)<<33 - 1
+	// tsFrameGap 是不连续段之间留出的间隔 (90kHz, 一帧 25fps)
+	tsFrameGap = 3600
+)
+
+// timestampState 平移不连续段的 PCR、PTS 和 DTS，使它们接在上一段的最大时间戳之后
+type timestampState struct {
+	offset int64 // 当前段的平移量
+	first  int64 // 当前段第一个时间戳（平移前）
+	latest int64 // 当前段最大时间戳相对 first 的距离
+	seen   bool
+}
+
+// discontinuity 以新一段第一个 PES 时间戳为基准，计算把它放到上一段之后再留出 gap 的平移量
+func (ts *timestampState) discontinuity(packets [][]byte, gap time.Duration) {
+	if !ts.seen {
+		return
+	}
+	for _, pkt := range packets {
+		if v, ok := firstPESTimestamp(pkt); ok {
+			start := (ts.first + ts.offset + ts.latest + tsFrameGap + int64(gap*90000/time.Second)) & tsTimestampMask
+			ts.offset = (start - v) & tsTimestampMask
+			ts.first, ts.latest = v, 0
+			return
+		}
+	}
+}
+
+func (ts *timestampState) shift(packets [][]byte) {
+	for _, pkt := range packets {
+		forEachTimestamp(pkt, func(v int64, pcr bool) int64 {
+			if !ts.seen && !pcr {
+				ts.first, ts.seen = v, true
+			}
+			// 按回绕计算相对距离，跳过早于段起点的时间戳（如 PCR 和 B 帧的 DTS）
+			if d := (v - ts.first) & tsTimestampMask; ts.seen && d < tsTimestampMask/2 && d > ts.latest {
+				ts.latest = d
+			}
+			return (v + ts.offset) & tsTimestampMask
+		})
+	}
+}
+
+func firstPESTimestamp(pkt []byte) (int64, bool) {
+	var first int64
+	found := false
+	forEachTimestamp(pkt, func(v int64, pcr bool) int64 {
+		if !found && !pcr {
+			first, found = v, true
+		}
+		return v
+	})
+	return first, found
+}
+
+// forEachTimestamp 用 fn 的返回值替换包中的 PCR 基准值和 PES 头中的 PTS、DTS
+func forEachTimestamp(pkt []byte, fn func(v int64, pcr bool) int64) {
+	payload := 4
+	if pkt[3]&0x20 != 0 {
+		afLen := int(pkt[4])
+		if afLen > 0 && 4+1+afLen <= len(pkt) && afLen >= 7 && pkt[5]&0x10 != 0 {
+			pcr := pkt[6:12]
+			base := int64(pcr[0])<<25 | int64(pcr[1])<<17 | int64(pcr[2])<<9 | int64(pcr[3])<<1 | int64(pcr[4])>>7
+			base = fn(base, true)
+			pcr[0], pcr[1], pcr[2], pcr[3] = byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1)
+			pcr[4] = byte(base<<7) | pcr[4]&0x7F
+		}
+		payload += 1 + afLen
+	}
+	if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 || payload+14 > len(pkt) {
+		return
+	}
+
+	pes := pkt[payload:]
+	if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[6]&0xC0 != 0x80 {
+		return
+	}
+	switch pes[3] {
+	case 0xBC, 0xBE, 0xBF, 0xF0, 0xF1, 0xF2, 0xF8, 0xFF:
+		// 没有可选 PES 头的流
+		return
+	}
+	flags := pes[7] >> 6
+	if flags&0x2 != 0 {
+		writePESTimestamp(pes[9:14], fn(readPESTimestamp(pes[9:14]), false))
+	}
+	if flags == 0x3 && payload+19 <= len(pkt) {
+		writePESTimestamp(pes[14:19], fn(readPESTimestamp(pes[14:19]), false))
+	}
+}
+
+func readPESTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// writePESTimestamp 写入 33 位时间戳，保留前缀和标记位
+func writePESTimestamp(b []byte, v int64) {
+	b[0] = b[0]&0xF1 | byte(v>>29)&0x0E
+	b[1] = byte(v >> 22)
+	b[2] = byte(v>>14) | 0x01
+	b[3] = byte(v >> 7)
+	b[4] = byte(v<<1) | 0x01
+}
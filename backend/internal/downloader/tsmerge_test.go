@@ -0,0 +1,194 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"videoDownload/internal/remux"
+)
+
+// tsPacket 构造一个指定 PID、连续计数器和负载标志的 TS 包
+func tsPacket(pid uint16, cc byte, payload bool) []byte {
+	pkt := make([]byte, remux.PacketSize)
+	pkt[0] = remux.SyncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	pkt[2] = byte(pid)
+	pkt[3] = 0x20 | cc // 只有适配字段
+	if payload {
+		pkt[3] = 0x10 | cc
+	}
+	return pkt
+}
+
+func packetCC(pkt []byte) byte {
+	return pkt[3] & 0x0F
+}
+
+func TestContinuityRebase(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments [][][]byte
+		want     [][]byte // 每个分片平移后的计数器
+	}{
+		{
+			name: "counters restart in each segment",
+			segments: [][][]byte{
+				{tsPacket(0x100, 0, true), tsPacket(0x100, 1, true), tsPacket(0x101, 5, true)},
+				{tsPacket(0x100, 0, true), tsPacket(0x101, 0, true), tsPacket(0x100, 1, true)},
+			},
+			want: [][]byte{{0, 1, 5}, {2, 6, 3}},
+		},
+		{
+			name: "counter wraps",
+			segments: [][][]byte{
+				{tsPacket(0x100, 14, true), tsPacket(0x100, 15, true)},
+				{tsPacket(0x100, 7, true), tsPacket(0x100, 8, true)},
+			},
+			want: [][]byte{{14, 15}, {0, 1}},
+		},
+		{
+			name: "packet without payload keeps counter",
+			segments: [][][]byte{
+				{tsPacket(0x100, 3, true)},
+				{tsPacket(0x100, 9, false), tsPacket(0x100, 10, true)},
+			},
+			want: [][]byte{{3}, {3, 4}},
+		},
+		{
+			name: "null packets untouched",
+			segments: [][][]byte{
+				{tsPacket(remux.NullPID, 0, true)},
+				{tsPacket(remux.NullPID, 9, true)},
+			},
+			want: [][]byte{{0}, {9}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newContinuityState()
+			for i, packets := range tt.segments {
+				cs.rebase(packets)
+				for j, pkt := range packets {
+					if got := packetCC(pkt); got != tt.want[i][j] {
+						t.Errorf("分片 %d 包 %d 计数器 = %d, 期望 %d", i, j, got, tt.want[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTSMerger(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, "segment_"+string(rune('0'+i))+".ts")
+		data := bytes.Join([][]byte{tsPacket(0x100, 0, true), tsPacket(0x100, 1, true)}, nil)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+	}
+
+	output := filepath.Join(dir, "out.ts")
+	if err := (&tsMerger{}).Merge(context.Background(), inputs, output); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	data, _ := os.ReadFile(output)
+	packets, skipped := remux.SplitPackets(data)
+	if len(packets) != 6 || skipped != 0 {
+		t.Fatalf("输出 %d 个包，丢弃 %d 字节", len(packets), skipped)
+	}
+	for i, pkt := range packets {
+		if got := packetCC(pkt); got != byte(i) {
+			t.Errorf("包 %d 计数器 = %d, 期望 %d", i, got, i)
+		}
+	}
+
+	if err := (&tsMerger{}).Merge(context.Background(), []string{filepath.Join(dir, "missing.ts")}, output); err == nil {
+		t.Error("分片缺失时期望返回错误")
+	}
+}
+
+// pesPacket 构造一个以 PES 头开始的视频包，带 PTS 和 DTS；pcr 不小于 0 时在适配字段中写入 PCR
+func pesPacket(pcr, pts, dts int64) []byte {
+	pkt := tsPacket(0x100, 0, true)
+	pkt[1] |= 0x40 // payload_unit_start_indicator
+	payload := 4
+	if pcr >= 0 {
+		pkt[3] |= 0x20
+		pkt[4], pkt[5] = 7, 0x10
+		pkt[6], pkt[7], pkt[8], pkt[9], pkt[10] = byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7E
+		payload += 1 + 7
+	}
+	pes := pkt[payload:]
+	copy(pes, []byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0xC0, 10, 0x31, 0, 0, 0, 0, 0x11})
+	writePESTimestamp(pes[9:14], pts)
+	writePESTimestamp(pes[14:19], dts)
+	return pkt
+}
+
+// packetTimestamps 返回包中的 PCR、PTS、DTS，没有 PCR 时第一项为 -1
+func packetTimestamps(pkt []byte) []int64 {
+	var pcr int64 = -1
+	var pes []int64
+	forEachTimestamp(pkt, func(v int64, isPCR bool) int64 {
+		if isPCR {
+			pcr = v
+		} else {
+			pes = append(pes, v)
+		}
+		return v
+	})
+	return append([]int64{pcr}, pes...)
+}
+
+func TestTSMergerTimestamps(t *testing.T) {
+	segments := [][][]byte{
+		{pesPacket(9000, 9000, 9000), pesPacket(-1, 16200, 12600)},
+		// 不连续段从 500 重新开始
+		{pesPacket(500, 500, 500), pesPacket(-1, 4100, 4100)},
+		{pesPacket(7700, 7700, 7700)},
+		// 跨越 33 位回绕、前面缺失 1 秒的不连续段
+		{pesPacket(tsTimestampMask-1000, tsTimestampMask-1000, tsTimestampMask-1000), pesPacket(-1, 2600, 2600)},
+	}
+	// 第一段最大时间戳为 16200，下一段从 16200 + 3600 开始，平移 19300
+	want := [][]int64{
+		{9000, 9000, 9000}, {-1, 16200, 12600},
+		{19800, 19800, 19800}, {-1, 23400, 23400},
+		{27000, 27000, 27000},
+		{120600, 120600, 120600}, {-1, 124201, 124201},
+	}
+
+	dir := t.TempDir()
+	var inputs []string
+	for i, packets := range segments {
+		path := filepath.Join(dir, "segment_"+string(rune('0'+i))+".ts")
+		if err := os.WriteFile(path, bytes.Join(packets, nil), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+	}
+
+	output := filepath.Join(dir, "out.ts")
+	merger := &tsMerger{discontinuities: []remux.Discontinuity{{Input: 1}, {Input: 3, Gap: time.Second}}}
+	if err := merger.Merge(context.Background(), inputs, output); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	data, _ := os.ReadFile(output)
+	packets, _ := remux.SplitPackets(data)
+	if len(packets) != len(want) {
+		t.Fatalf("输出 %d 个包, 期望 %d", len(packets), len(want))
+	}
+	for i, pkt := range packets {
+		if got := packetTimestamps(pkt); !slices.Equal(got, want[i]) {
+			t.Errorf("包 %d 时间戳 = %v, 期望 %v", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"videoDownload/internal/httpclient"
+	"videoDownload/internal/types"
+)
+
+// 主播放列表的档位选择策略
+const (
+	VariantHighest      = "highest"
+	VariantLowest       = "lowest"
+	Variant720p         = "720p"
+	VariantMaxBandwidth = "max_bandwidth"
+)
+
+func IsValidVariantPolicy(policy string) bool {
+	switch policy {
+	case "", VariantHighest, VariantLowest, Variant720p, VariantMaxBandwidth:
+		return true
+	}
+	return false
+}
+
+// ListVariants 返回主播放列表中的全部档位（按带宽从高到低排序）和 #EXT-X-MEDIA 轨道；媒体播放列表返回空列表
+func ListVariants(ctx context.Context, client *httpclient.Client, m3u8URL string) ([]types.StreamVariant, []types.MediaRendition, error) {
+	pl, err := fetchPlaylist(ctx, client, m3u8URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	variants := append([]types.StreamVariant(nil), pl.Variants...)
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].Bandwidth > variants[j].Bandwidth
+	})
+	return variants, pl.Media, nil
+}
+
+func selectVariant(variants []types.StreamVariant, opts Options) (types.StreamVariant, error) {
+	i, err := selectVariantIndex(variants, opts)
+	if err != nil {
+		return types.StreamVariant{}, err
+	}
+	return variants[i], nil
+}
+
+// selectVariantIndex 按 opts 的档位选择策略返回选中档位在 variants 中的下标
+func selectVariantIndex(variants []types.StreamVariant, opts Options) (int, error) {
+	if len(variants) == 0 {
+		return 0, fmt.Errorf("主播放列表中没有可用的档位")
+	}
+
+	best := 0
+	switch opts.VariantPolicy {
+	case "", VariantHighest:
+		for i, v := range variants {
+			if v.Height > variants[best].Height || (v.Height == variants[best].Height && v.Bandwidth > variants[best].Bandwidth) {
+				best = i
+			}
+		}
+	case VariantLowest:
+		for i, v := range variants {
+			if v.Bandwidth < variants[best].Bandwidth {
+				best = i
+			}
+		}
+	case Variant720p:
+		for i, v := range variants {
+			d, bestD := abs(v.Height-720), abs(variants[best].Height-720)
+			if d < bestD || (d == bestD && v.Bandwidth > variants[best].Bandwidth) {
+				best = i
+			}
+		}
+	case VariantMaxBandwidth:
+		// 选择不超过上限的最高带宽档位，全部超出时退回到最低带宽
+		found := false
+		for i, v := range variants {
+			if opts.MaxBandwidth > 0 && v.Bandwidth > opts.MaxBandwidth {
+				continue
+			}
+			if !found || v.Bandwidth > variants[best].Bandwidth {
+				best, found = i, true
+			}
+		}
+		if !found {
+			return selectVariantIndex(variants, Options{VariantPolicy: VariantLowest})
+		}
+	default:
+		return 0, fmt.Errorf("未知的档位选择策略: %s", opts.VariantPolicy)
+	}
+
+	return best, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"testing"
+
+	"videoDownload/internal/types"
+)
+
+func TestSelectVariant(t *testing.T) {
+	variants := []types.StreamVariant{
+		{URL: "480p", Height: 480, Bandwidth: 1200000},
+		{URL: "1080p", Height: 1080, Bandwidth: 5000000},
+		{URL: "720p-low", Height: 720, Bandwidth: 2000000},
+		{URL: "720p-high", Height: 720, Bandwidth: 3000000},
+		{URL: "360p", Height: 360, Bandwidth: 600000},
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    string
+		wantErr bool
+	}{
+		{"default is highest", Options{}, "1080p", false},
+		{"highest", Options{VariantPolicy: VariantHighest}, "1080p", false},
+		{"lowest", Options{VariantPolicy: VariantLowest}, "360p", false},
+		{"closest to 720p", Options{VariantPolicy: Variant720p}, "720p-high", false},
+		{"max bandwidth", Options{VariantPolicy: VariantMaxBandwidth, MaxBandwidth: 2500000}, "720p-low", false},
+		{"max bandwidth below all", Options{VariantPolicy: VariantMaxBandwidth, MaxBandwidth: 100}, "360p", false},
+		{"unknown policy", Options{VariantPolicy: "best"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectVariant(variants, tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectVariant: %v", err)
+			}
+			if got.URL != tt.want {
+				t.Errorf("选择了 %s, 期望 %s", got.URL, tt.want)
+			}
+		})
+	}
+
+	if _, err := selectVariant(nil, Options{}); err == nil {
+		t.Error("没有档位时期望返回错误")
+	}
+}
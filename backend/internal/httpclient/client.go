@@ -0,0 +1,216 @@
+// Package httpclient 提供下载器和网页分析共用的 HTTP 客户端，为每个请求附加任务指定的请求头、Cookie 和代理
+package httpclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"videoDownload/internal/types"
+)
+
+// DefaultUserAgent 在任务没有指定 User-Agent 时使用，不少 CDN 会拒绝 Go 默认的 User-Agent
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+
+// Client 发送一个任务的全部 HTTP 请求。nil 的 *Client 等同于 Default
+type Client struct {
+	proxy   string        // 规范化的代理地址，为空时使用服务器默认代理
+	header  http.Header   // 附加到每个请求的请求头，含 User-Agent、Referer 和 Cookie 字符串
+	cookies []*fileCookie // cookies.txt 中的 Cookie，按请求地址匹配
+	close   sync.Once
+}
+
+// Default 不附加任务设置，只使用默认的 User-Agent 和服务器默认代理
+var Default = &Client{
+	header: http.Header{"User-Agent": {DefaultUserAgent}},
+}
+
+// New 按 opts 创建客户端，请求头或 Cookie 格式无效时返回错误。
+// 指定了代理的客户端引用该代理的连接池，用完后需调用 Close
+func New(opts types.HTTPOptions) (*Client, error) {
+	c := &Client{header: make(http.Header)}
+	if opts.Proxy != "" {
+		proxy, err := normalizeProxy(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		c.proxy = proxy
+	}
+
+	for name, value := range opts.Headers {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("无效的请求头: %q", name)
+		}
+		c.header.Set(name, value)
+	}
+
+	if opts.UserAgent != "" {
+		c.header.Set("User-Agent", opts.UserAgent)
+	} else if c.header.Get("User-Agent") == "" {
+		c.header.Set("User-Agent", DefaultUserAgent)
+	}
+	if opts.Referer != "" {
+		c.header.Set("Referer", opts.Referer)
+	}
+
+	if cookies := strings.TrimSpace(opts.Cookies); cookies != "" {
+		if _, err := http.ParseCookie(cookies); err != nil {
+			return nil, fmt.Errorf("无效的 Cookie: %v", err)
+		}
+		c.header.Set("Cookie", cookies)
+	}
+	if opts.CookiesTxt != "" {
+		cookies, err := parseCookiesTxt(opts.CookiesTxt)
+		if err != nil {
+			return nil, err
+		}
+		c.cookies = cookies
+	}
+	if c.proxy != "" {
+		acquireTransport(c.proxy)
+	}
+	return c, nil
+}
+
+// Close 释放客户端对代理连接池的引用，最后一个使用该代理的客户端关闭时关闭空闲连接。
+// 重复调用和对 Default 调用都是安全的
+func (c *Client) Close() {
+	if c == nil || c.proxy == "" {
+		return
+	}
+	c.close.Do(func() {
+		releaseTransport(c.proxy)
+	})
+}
+
+// NewRequest 创建附加了请求头和 Cookie 的请求
+func (c *Client) NewRequest(ctx context.Context, method, rawURL string) (*http.Request, error) {
+	if c == nil {
+		c = Default
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	var matched []string
+	for _, cookie := range c.cookies {
+		if cookie.matches(req.URL) {
+			matched = append(matched, cookie.name+"="+cookie.value)
+		}
+	}
+	if len(matched) > 0 {
+		if existing := req.Header.Get("Cookie"); existing != "" {
+			matched = append([]string{existing}, matched...)
+		}
+		req.Header.Set("Cookie", strings.Join(matched, "; "))
+	}
+	return req, nil
+}
+
+// Do 发送请求，timeout 限制包括读取响应体在内的整个请求，为 0 时只受 ctx 控制
+func (c *Client) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if c == nil {
+		c = Default
+	}
+	proxy := c.proxy
+	if proxy == "" {
+		proxy = DefaultProxy()
+	}
+	client := &http.Client{Transport: transport(proxy), Timeout: timeout}
+	return client.Do(req)
+}
+
+// Get 发送附加了请求头和 Cookie 的 GET 请求
+func (c *Client) Get(ctx context.Context, rawURL string, timeout time.Duration) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req, timeout)
+}
+
+// fileCookie 是 cookies.txt 中的一行
+type fileCookie struct {
+	domain            string
+	includeSubdomains bool
+	path              string
+	secure            bool
+	expires           time.Time // 零值表示会话 Cookie
+	name, value       string
+}
+
+func (fc *fileCookie) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	domainMatch := host == fc.domain || (fc.includeSubdomains && strings.HasSuffix(host, "."+fc.domain))
+	if !domainMatch || (fc.secure && u.Scheme != "https") {
+		return false
+	}
+	if !fc.expires.IsZero() && time.Now().After(fc.expires) {
+		return false
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.HasPrefix(path, fc.path) &&
+		(len(path) == len(fc.path) || strings.HasSuffix(fc.path, "/") || path[len(fc.path)] == '/')
+}
+
+// parseCookiesTxt 解析 Netscape 格式的 cookies.txt：每行以制表符分隔域名、是否包含子域名、路径、
+// 是否仅 HTTPS、过期时间、名称和值，# 开头的行为注释（#HttpOnly_ 前缀除外）
+func parseCookiesTxt(content string) ([]*fileCookie, error) {
+	var cookies []*fileCookie
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// 值为空时部分导出工具会省略最后一列
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("cookies.txt 第 %d 行格式错误", lineNo)
+		}
+
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cookies.txt 第 %d 行的过期时间无效: %s", lineNo, fields[4])
+		}
+		cookie := &fileCookie{
+			domain:            strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			includeSubdomains: strings.EqualFold(fields[1], "TRUE"),
+			path:              fields[2],
+			secure:            strings.EqualFold(fields[3], "TRUE"),
+			name:              fields[5],
+			value:             fields[6],
+		}
+		if expiry > 0 {
+			cookie.expires = time.Unix(expiry, 0)
+		}
+		if cookie.path == "" {
+			cookie.path = "/"
+		}
+		cookies = append(cookies, cookie)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取 cookies.txt 失败: %v", err)
+	}
+	return cookies, nil
+}
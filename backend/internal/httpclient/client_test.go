@@ -0,0 +1,135 @@
+package httpclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"videoDownload/internal/types"
+)
+
+func TestParseCookiesTxt(t *testing.T) {
+	content := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tsession\tabc\n" +
+		"#HttpOnly_video.example.com\tFALSE\t/media\tTRUE\t4102444800\ttoken\txyz\n" +
+		"cdn.example.com\tFALSE\t/\tFALSE\t0\tempty\n"
+
+	cookies, err := parseCookiesTxt(content)
+	if err != nil {
+		t.Fatalf("parseCookiesTxt: %v", err)
+	}
+	want := []fileCookie{
+		{domain: "example.com", includeSubdomains: true, path: "/", name: "session", value: "abc"},
+		{domain: "video.example.com", path: "/media", secure: true, expires: time.Unix(4102444800, 0), name: "token", value: "xyz"},
+		{domain: "cdn.example.com", path: "/", name: "empty"},
+	}
+	if len(cookies) != len(want) {
+		t.Fatalf("Cookie 数 = %d, 期望 %d", len(cookies), len(want))
+	}
+	for i, c := range cookies {
+		if *c != want[i] {
+			t.Errorf("Cookie %d = %+v, 期望 %+v", i, *c, want[i])
+		}
+	}
+
+	for _, bad := range []string{"example.com\tTRUE\t/\n", "example.com\tTRUE\t/\tFALSE\tsoon\tname\tvalue\n"} {
+		if _, err := parseCookiesTxt(bad); err == nil {
+			t.Errorf("parseCookiesTxt(%q) 期望返回错误", bad)
+		}
+	}
+}
+
+func TestFileCookieMatches(t *testing.T) {
+	cookies, err := parseCookiesTxt(".example.com\tTRUE\t/media\tTRUE\t0\ta\t1\n" +
+		"exact.org\tFALSE\t/\tFALSE\t1\texpired\t1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, expired := cookies[0], cookies[1]
+
+	tests := []struct {
+		cookie *fileCookie
+		url    string
+		want   bool
+	}{
+		{sub, "https://example.com/media/1.ts", true},
+		{sub, "https://cdn.example.com/media", true},
+		{sub, "http://cdn.example.com/media/1.ts", false},
+		{sub, "https://example.com/mediax/1.ts", false},
+		{sub, "https://badexample.com/media/1.ts", false},
+		{expired, "http://exact.org/", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		if got := tt.cookie.matches(req.URL); got != tt.want {
+			t.Errorf("%s 匹配 %s = %v, 期望 %v", tt.cookie.name, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	client, err := New(types.HTTPOptions{
+		Headers:    map[string]string{"X-Token": "t1", "User-Agent": "ignored"},
+		UserAgent:  "agent/1.0",
+		Referer:    "https://example.com/page",
+		Cookies:    "a=1",
+		CookiesTxt: "127.0.0.1\tFALSE\t/\tFALSE\t0\tb\t2\n",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	resp, err := client.Get(context.Background(), server.URL+"/video.m3u8", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := map[string]string{
+		"X-Token":    "t1",
+		"User-Agent": "agent/1.0",
+		"Referer":    "https://example.com/page",
+		"Cookie":     "a=1; b=2",
+	}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("%s = %q, 期望 %q", name, got.Get(name), value)
+		}
+	}
+
+	resp, err = Default.Get(context.Background(), server.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got.Get("User-Agent") != DefaultUserAgent || got.Get("Cookie") != "" {
+		t.Errorf("默认客户端的请求头 = %v", got)
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts types.HTTPOptions
+	}{
+		{"header name with colon", types.HTTPOptions{Headers: map[string]string{"X-A:": "1"}}},
+		{"header value with newline", types.HTTPOptions{Headers: map[string]string{"X-A": "1\r\nX-B: 2"}}},
+		{"invalid cookie", types.HTTPOptions{Cookies: "no-equals-sign"}},
+		{"invalid cookies.txt", types.HTTPOptions{CookiesTxt: "example.com\tTRUE\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opts); err == nil {
+				t.Fatal("期望返回错误")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// NoProxy 作为代理地址时直接连接，不使用服务器默认代理和环境变量中的代理
+const NoProxy = "direct"
+
+var (
+	proxyMu      sync.Mutex
+	defaultProxy string                          // 为空时使用环境变量 HTTP_PROXY、HTTPS_PROXY
+	transports   = map[string]*sharedTransport{} // 按代理地址复用连接
+)
+
+// sharedTransport 是按引用计数共享的 Transport。使用任务代理的客户端各持有一个引用，
+// 服务器默认代理、环境变量代理和直连各持有一个常驻引用；引用归零时关闭空闲连接并移出 transports
+type sharedTransport struct {
+	*http.Transport
+	refs int
+}
+
+// SetDefaultProxy 设置没有指定代理的请求使用的服务器默认代理，空串恢复为环境变量中的代理
+func SetDefaultProxy(raw string) error {
+	proxy := ""
+	if raw != "" {
+		var err error
+		if proxy, err = normalizeProxy(raw); err != nil {
+			return err
+		}
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	if proxy != defaultProxy {
+		// 默认代理在被替换前一直保留一个引用
+		if proxy != "" {
+			acquireLocked(proxy)
+		}
+		if defaultProxy != "" {
+			releaseLocked(defaultProxy)
+		}
+		defaultProxy = proxy
+	}
+	return nil
+}
+
+// DefaultProxy 返回服务器默认代理，未设置时为空串
+func DefaultProxy() string {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	return defaultProxy
+}
+
+// RedactProxy 隐藏代理地址中的用户名和密码，用于日志和错误信息；无法解析的地址整体隐藏
+func RedactProxy(raw string) string {
+	if raw == "" || raw == NoProxy {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(无法解析的地址)"
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
+
+// normalizeProxy 校验代理地址，支持 http://、https:// 和 socks5://，用户名和密码写在地址中
+func normalizeProxy(raw string) (string, error) {
+	if raw == NoProxy {
+		return NoProxy, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Error 中带有完整的地址，只保留解析失败的原因
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("无效的代理地址: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return "", fmt.Errorf("不支持的代理协议 %q，可用 http、https、socks5", u.Scheme)
+	}
+	if u.Host == "" || u.Port() == "" {
+		return "", fmt.Errorf("代理地址缺少主机或端口: %s", RedactProxy(raw))
+	}
+	return u.String(), nil
+}
+
+// transport 返回使用指定代理的 Transport：空串使用环境变量中的代理，NoProxy 直接连接。
+// 已被引用的 Transport 直接复用；空串和 NoProxy 首次使用时创建并常驻，
+// 其他没有引用的代理（例如客户端关闭后仍在发送请求）使用不缓存的 Transport
+func transport(proxy string) *http.Transport {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if s, ok := transports[proxy]; ok {
+		return s.Transport
+	}
+	if proxy == "" || proxy == NoProxy {
+		return acquireLocked(proxy)
+	}
+	return newTransport(proxy)
+}
+
+// acquireTransport 为使用 proxy 的客户端增加一个引用，与 releaseTransport 成对调用
+func acquireTransport(proxy string) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	acquireLocked(proxy)
+}
+
+// releaseTransport 释放 acquireTransport 增加的引用
+func releaseTransport(proxy string) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	releaseLocked(proxy)
+}
+
+func acquireLocked(proxy string) *http.Transport {
+	s, ok := transports[proxy]
+	if !ok {
+		s = &sharedTransport{Transport: newTransport(proxy)}
+		transports[proxy] = s
+	}
+	s.refs++
+	return s.Transport
+}
+
+func releaseLocked(proxy string) {
+	s, ok := transports[proxy]
+	if !ok {
+		return
+	}
+	if s.refs--; s.refs <= 0 {
+		s.CloseIdleConnections()
+		delete(transports, proxy)
+	}
+}
+
+// newTransport 创建使用 proxy 的 Transport，等待响应头最多 30 秒，响应体的读取时长由调用方控制
+func newTransport(proxy string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	switch proxy {
+	case "":
+		t.Proxy = http.ProxyFromEnvironment
+	case NoProxy:
+		t.Proxy = nil
+	default:
+		// 已由 normalizeProxy 校验
+		u, _ := url.Parse(proxy)
+		t.Proxy = http.ProxyURL(u)
+	}
+	return t
+}
@@ -0,0 +1,61 @@
+package remux
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacSamplesPerFrame 每个 AAC 帧包含的采样数
+const aacSamplesPerFrame = 1024
+
+type adtsHeader struct {
+	objectType    byte
+	sampleRateIdx byte
+	channels      byte
+	headerLength  int
+	frameLength   int
+}
+
+// parseADTSHeader 解析 ADTS 帧头，buf 至少需要 7 字节
+func parseADTSHeader(buf []byte) (*adtsHeader, bool) {
+	if len(buf) < 7 || buf[0] != 0xFF || buf[1]&0xF6 != 0xF0 {
+		return nil, false
+	}
+
+	h := &adtsHeader{
+		objectType:    (buf[2] >> 6) + 1,
+		sampleRateIdx: (buf[2] >> 2) & 0x0F,
+		channels:      (buf[2]&0x01)<<2 | buf[3]>>6,
+		headerLength:  7,
+		frameLength:   int(buf[3]&0x03)<<11 | int(buf[4])<<3 | int(buf[5])>>5,
+	}
+	if buf[1]&0x01 == 0 {
+		h.headerLength = 9 // 带 CRC
+	}
+	if int(h.sampleRateIdx) >= len(aacSampleRates) || h.frameLength <= h.headerLength {
+		return nil, false
+	}
+	return h, true
+}
+
+func (h *adtsHeader) sampleRate() int {
+	return aacSampleRates[h.sampleRateIdx]
+}
+
+// audioSpecificConfig 生成 esds 中的 AudioSpecificConfig
+func (h *adtsHeader) audioSpecificConfig() []byte {
+	return []byte{
+		h.objectType<<3 | h.sampleRateIdx>>1,
+		h.sampleRateIdx<<7 | h.channels<<3,
+	}
+}
+
+// findADTSSync 查找下一个 ADTS 同步字，找不到时返回 -1
+func findADTSSync(buf []byte) int {
+	for i := 1; i+1 < len(buf); i++ {
+		if buf[i] == 0xFF && buf[i+1]&0xF6 == 0xF0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,104 @@
+package remux
+
+// bitReader 按位读取 RBSP 数据，支持 Exp-Golomb 编码，越界时返回 0 并记录错误
+type bitReader struct {
+	data []byte
+	pos  int // 以位为单位
+	err  bool
+}
+
+func (br *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if br.pos >= len(br.data)*8 {
+			br.err = true
+			return 0
+		}
+		bit := (br.data[br.pos/8] >> (7 - br.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+func (br *bitReader) skip(n int) {
+	br.pos += n
+	if br.pos > len(br.data)*8 {
+		br.err = true
+	}
+}
+
+func (br *bitReader) ue() uint32 {
+	zeros := 0
+	for br.u(1) == 0 {
+		if br.err || zeros > 31 {
+			br.err = true
+			return 0
+		}
+		zeros++
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return (1<<zeros - 1) + br.u(zeros)
+}
+
+func (br *bitReader) se() int32 {
+	v := br.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// unescapeRBSP 去除 NAL 单元中的防竞争字节 (00 00 03)
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// splitNALUnits 按 Annex B 起始码切分 NAL 单元
+func splitNALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				nalus = appendNAL(nalus, data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nalus = appendNAL(nalus, data[start:])
+	}
+	return nalus
+}
+
+func appendNAL(nalus [][]byte, nal []byte) [][]byte {
+	// 四字节起始码的前导 0 属于上一个 NAL 的尾部
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) == 0 {
+		return nalus
+	}
+	return append(nalus, nal)
+}
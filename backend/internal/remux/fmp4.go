@@ -0,0 +1,406 @@
+package remux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// ErrUnsupportedLayout 表示输入不是 MuxFragmented 能处理的单轨道分片 MP4
+var ErrUnsupportedLayout = errors.New("不支持的 MP4 结构")
+
+// rawBox 是内存中的一个 box，data 含头部，与解析的源数据共享内存，可以原地修改
+type rawBox struct {
+	typ    string
+	data   []byte
+	header int
+}
+
+func (b rawBox) payload() []byte {
+	return b.data[b.header:]
+}
+
+// parseBoxes 解析连续排列的 box
+func parseBoxes(data []byte) ([]rawBox, error) {
+	var boxes []rawBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: box 头不完整", ErrUnsupportedLayout)
+		}
+		size, header := uint64(binary.BigEndian.Uint32(data)), 8
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: box 头不完整", ErrUnsupportedLayout)
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: box %q 长度无效", ErrUnsupportedLayout, data[4:8])
+		}
+		boxes = append(boxes, rawBox{typ: string(data[4:8]), data: data[:size], header: header})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// boxPayload 返回 data 中第一个 box 的负载
+func boxPayload(data []byte) []byte {
+	boxes, err := parseBoxes(data)
+	if err != nil || len(boxes) == 0 {
+		return nil
+	}
+	return boxes[0].payload()
+}
+
+// findBox 按路径查找第一个匹配的子 box，例如 findBox(trak, "mdia", "mdhd")
+func findBox(data []byte, path ...string) (rawBox, bool) {
+	var found rawBox
+	for _, typ := range path {
+		boxes, err := parseBoxes(data)
+		if err != nil {
+			return rawBox{}, false
+		}
+		i := slices.IndexFunc(boxes, func(b rawBox) bool { return b.typ == typ })
+		if i < 0 {
+			return rawBox{}, false
+		}
+		found = boxes[i]
+		data = found.payload()
+	}
+	return found, true
+}
+
+// fragmentedInput 是一个只含一条轨道的分片 MP4
+type fragmentedInput struct {
+	file      *os.File
+	ftyp      []byte
+	mvhd      []byte
+	trak      []byte
+	trex      []byte
+	timescale uint32
+	fragments []fragment
+}
+
+// fragment 是 moof 和其后的 mdat，复制时保持二者的相对位置，trun 中相对 moof 的数据偏移因此不变
+type fragment struct {
+	offset   int64
+	size     int64 // 从 moof 起点到最后一个 mdat 的末尾
+	moofSize int64
+	time     float64 // tfdt 换算成的秒数
+}
+
+// MuxFragmented 把多个各含一条轨道的分片 MP4 合并为一个多轨道的分片 MP4，各轨道的片段按解码时间交错排列。
+// 输入的 moov 中必须含有 mvex，每个 moof 必须带 tfdt，否则返回 ErrUnsupportedLayout
+func MuxFragmented(ctx context.Context, inputs []string, outputFilename string) error {
+	tracks := make([]*fragmentedInput, 0, len(inputs))
+	defer func() {
+		for _, t := range tracks {
+			t.file.Close()
+		}
+	}()
+	for _, path := range inputs {
+		t, err := openFragmented(path)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("没有需要封装的轨道")
+	}
+
+	moov, err := buildFragmentedMoov(tracks)
+	if err != nil {
+		return err
+	}
+	ftyp := tracks[0].ftyp
+	if ftyp == nil {
+		ftyp = ftypBox()
+	}
+
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	if _, err := w.Write(ftyp); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	if _, err := w.Write(moov); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	offset := int64(len(ftyp) + len(moov))
+
+	next := make([]int, len(tracks))
+	for sequence := uint32(1); ; sequence++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// 取解码时间最早的下一个片段，同一轨道内保持原有顺序
+		pick := -1
+		for i, t := range tracks {
+			if next[i] < len(t.fragments) && (pick < 0 || t.fragments[next[i]].time < tracks[pick].fragments[next[pick]].time) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		t, fr := tracks[pick], tracks[pick].fragments[next[pick]]
+		next[pick]++
+
+		moof := make([]byte, fr.moofSize)
+		if _, err := t.file.ReadAt(moof, fr.offset); err != nil {
+			return fmt.Errorf("读取片段失败: %v", err)
+		}
+		if err := patchMoof(moof, uint32(pick+1), sequence, offset-fr.offset); err != nil {
+			return err
+		}
+		if _, err := w.Write(moof); err != nil {
+			return fmt.Errorf("写入输出文件失败: %v", err)
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(t.file, fr.offset+fr.moofSize, fr.size-fr.moofSize)); err != nil {
+			return fmt.Errorf("写入输出文件失败: %v", err)
+		}
+		offset += fr.size
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	return out.Close()
+}
+
+// openFragmented 读取输入的 ftyp、moov 和各片段的位置，styp、sidx 等 box 不会复制到输出
+func openFragmented(path string) (*fragmentedInput, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开轨道文件失败: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("打开轨道文件失败: %v", err)
+	}
+
+	t := &fragmentedInput{file: f}
+	fileSize := info.Size()
+	for offset := int64(0); offset < fileSize; {
+		typ, size, err := readBoxHeader(f, offset, fileSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		switch typ {
+		case "ftyp", "moov", "moof":
+			data := make([]byte, size)
+			if _, err := f.ReadAt(data, offset); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("读取轨道文件失败: %v", err)
+			}
+			switch typ {
+			case "ftyp":
+				t.ftyp = data
+			case "moov":
+				err = t.parseMoov(data)
+			case "moof":
+				var fr fragment
+				fr, err = t.parseMoof(data)
+				fr.offset, fr.size, fr.moofSize = offset, size, size
+				t.fragments = append(t.fragments, fr)
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		case "mdat":
+			if len(t.fragments) == 0 {
+				f.Close()
+				return nil, fmt.Errorf("%w: mdat 之前没有 moof", ErrUnsupportedLayout)
+			}
+			fr := &t.fragments[len(t.fragments)-1]
+			fr.size = offset + size - fr.offset
+		}
+		offset += size
+	}
+
+	if t.trak == nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: 缺少 moov", ErrUnsupportedLayout)
+	}
+	return t, nil
+}
+
+// readBoxHeader 读取 offset 处 box 的类型和含头部的长度
+func readBoxHeader(r io.ReaderAt, offset, fileSize int64) (string, int64, error) {
+	var buf [16]byte
+	if _, err := r.ReadAt(buf[:8], offset); err != nil {
+		return "", 0, fmt.Errorf("%w: box 头不完整", ErrUnsupportedLayout)
+	}
+	typ, size, header := string(buf[4:8]), int64(binary.BigEndian.Uint32(buf[:4])), int64(8)
+	switch size {
+	case 0:
+		size = fileSize - offset
+	case 1:
+		if _, err := r.ReadAt(buf[8:16], offset+8); err != nil {
+			return "", 0, fmt.Errorf("%w: box 头不完整", ErrUnsupportedLayout)
+		}
+		size, header = int64(binary.BigEndian.Uint64(buf[8:16])), 16
+	}
+	if size < header || offset+size > fileSize {
+		return "", 0, fmt.Errorf("%w: box %q 长度无效", ErrUnsupportedLayout, typ)
+	}
+	return typ, size, nil
+}
+
+func (t *fragmentedInput) parseMoov(data []byte) error {
+	children, err := parseBoxes(boxPayload(data))
+	if err != nil {
+		return err
+	}
+
+	var traks int
+	for _, c := range children {
+		switch c.typ {
+		case "mvhd":
+			t.mvhd = c.data
+		case "trak":
+			t.trak = c.data
+			traks++
+		case "mvex":
+			if trex, ok := findBox(c.payload(), "trex"); ok {
+				t.trex = trex.data
+			}
+		}
+	}
+	if traks != 1 {
+		return fmt.Errorf("%w: 每个输入只能包含一条轨道，实际为 %d 条", ErrUnsupportedLayout, traks)
+	}
+	if t.mvhd == nil || t.trex == nil {
+		return fmt.Errorf("%w: 不是分片 MP4", ErrUnsupportedLayout)
+	}
+
+	mdhd, ok := findBox(boxPayload(t.trak), "mdia", "mdhd")
+	if !ok {
+		return fmt.Errorf("%w: 缺少 mdhd", ErrUnsupportedLayout)
+	}
+	p := mdhd.payload()
+	timescaleAt := 12
+	if len(p) > 0 && p[0] == 1 {
+		timescaleAt = 20
+	}
+	if len(p) < timescaleAt+4 {
+		return fmt.Errorf("%w: mdhd 长度无效", ErrUnsupportedLayout)
+	}
+	t.timescale = binary.BigEndian.Uint32(p[timescaleAt:])
+	if t.timescale == 0 {
+		return fmt.Errorf("%w: mdhd 时间刻度为 0", ErrUnsupportedLayout)
+	}
+	return nil
+}
+
+// parseMoof 读取片段的 tfdt 解码时间
+func (t *fragmentedInput) parseMoof(data []byte) (fragment, error) {
+	tfdt, ok := findBox(boxPayload(data), "traf", "tfdt")
+	if !ok {
+		return fragment{}, fmt.Errorf("%w: 片段缺少 tfdt", ErrUnsupportedLayout)
+	}
+	p := tfdt.payload()
+	var decodeTime uint64
+	switch {
+	case len(p) >= 12 && p[0] == 1:
+		decodeTime = binary.BigEndian.Uint64(p[4:])
+	case len(p) >= 8:
+		decodeTime = uint64(binary.BigEndian.Uint32(p[4:]))
+	default:
+		return fragment{}, fmt.Errorf("%w: tfdt 长度无效", ErrUnsupportedLayout)
+	}
+	return fragment{time: float64(decodeTime) / float64(t.timescale)}, nil
+}
+
+// buildFragmentedMoov 合并各输入的轨道，轨道 ID 按输入顺序重新编号为 1..n
+func buildFragmentedMoov(tracks []*fragmentedInput) ([]byte, error) {
+	mvhd := slices.Clone(tracks[0].mvhd)
+	if len(mvhd) < 12 {
+		return nil, fmt.Errorf("%w: mvhd 长度无效", ErrUnsupportedLayout)
+	}
+	binary.BigEndian.PutUint32(mvhd[len(mvhd)-4:], uint32(len(tracks)+1))
+
+	parts := [][]byte{mvhd}
+	var trexes [][]byte
+	for i, t := range tracks {
+		id := uint32(i + 1)
+
+		trak := slices.Clone(t.trak)
+		tkhd, ok := findBox(boxPayload(trak), "tkhd")
+		if !ok {
+			return nil, fmt.Errorf("%w: 缺少 tkhd", ErrUnsupportedLayout)
+		}
+		p := tkhd.payload()
+		idAt := 12
+		if len(p) > 0 && p[0] == 1 {
+			idAt = 20
+		}
+		if len(p) < idAt+4 {
+			return nil, fmt.Errorf("%w: tkhd 长度无效", ErrUnsupportedLayout)
+		}
+		binary.BigEndian.PutUint32(p[idAt:], id)
+		parts = append(parts, trak)
+
+		trex := slices.Clone(t.trex)
+		if len(trex) < 16 {
+			return nil, fmt.Errorf("%w: trex 长度无效", ErrUnsupportedLayout)
+		}
+		binary.BigEndian.PutUint32(trex[12:], id)
+		trexes = append(trexes, trex)
+	}
+
+	parts = append(parts, box("mvex", trexes...))
+	return box("moov", parts...), nil
+}
+
+// patchMoof 改写片段的序号和轨道 ID；tfhd 带绝对的 base_data_offset 时按片段在输出中的位移修正
+func patchMoof(moof []byte, trackID, sequence uint32, shift int64) error {
+	children, err := parseBoxes(boxPayload(moof))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		switch c.typ {
+		case "mfhd":
+			if p := c.payload(); len(p) >= 8 {
+				binary.BigEndian.PutUint32(p[4:], sequence)
+			}
+		case "traf":
+			tfhd, ok := findBox(c.payload(), "tfhd")
+			if !ok || len(tfhd.payload()) < 8 {
+				return fmt.Errorf("%w: 片段缺少 tfhd", ErrUnsupportedLayout)
+			}
+			p := tfhd.payload()
+			binary.BigEndian.PutUint32(p[4:], trackID)
+
+			const baseDataOffsetPresent = 0x000001
+			if flags := uint32(p[1])<<16 | uint32(p[2])<<8 | uint32(p[3]); flags&baseDataOffsetPresent != 0 {
+				if len(p) < 16 {
+					return fmt.Errorf("%w: tfhd 长度无效", ErrUnsupportedLayout)
+				}
+				base := int64(binary.BigEndian.Uint64(p[8:]))
+				binary.BigEndian.PutUint64(p[8:], uint64(base+shift))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package remux
+
+import "fmt"
+
+// H.264 NAL 单元类型
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+func h264NALType(nal []byte) byte {
+	return nal[0] & 0x1F
+}
+
+type h264SPS struct {
+	profileIdc    byte
+	compatibility byte
+	levelIdc      byte
+	width         int
+	height        int
+}
+
+func parseH264SPS(nal []byte) (*h264SPS, error) {
+	if len(nal) < 4 {
+		return nil, fmt.Errorf("H.264 SPS 过短")
+	}
+
+	rbsp := unescapeRBSP(nal[1:])
+	sps := &h264SPS{
+		profileIdc:    rbsp[0],
+		compatibility: rbsp[1],
+		levelIdc:      rbsp[2],
+	}
+	br := &bitReader{data: rbsp, pos: 24}
+
+	br.ue() // seq_parameter_set_id
+	chromaFormatIdc := uint32(1)
+	switch sps.profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = br.ue()
+		if chromaFormatIdc == 3 {
+			br.skip(1) // separate_colour_plane_flag
+		}
+		br.ue()    // bit_depth_luma_minus8
+		br.ue()    // bit_depth_chroma_minus8
+		br.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if br.u(1) == 1 {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if br.u(1) == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(br, size)
+				}
+			}
+		}
+	}
+
+	br.ue() // log2_max_frame_num_minus4
+	switch br.ue() {
+	case 0:
+		br.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.skip(1) // delta_pic_order_always_zero_flag
+		br.se()    // offset_for_non_ref_pic
+		br.se()    // offset_for_top_to_bottom_field
+		cycle := br.ue()
+		for i := uint32(0); i < cycle && !br.err; i++ {
+			br.se()
+		}
+	}
+	br.ue()    // max_num_ref_frames
+	br.skip(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := int(br.ue()) + 1
+	heightInMapUnits := int(br.ue()) + 1
+	frameMbsOnly := int(br.u(1))
+	if frameMbsOnly == 0 {
+		br.skip(1) // mb_adaptive_frame_field_flag
+	}
+	br.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if br.u(1) == 1 {
+		cropLeft = int(br.ue())
+		cropRight = int(br.ue())
+		cropTop = int(br.ue())
+		cropBottom = int(br.ue())
+	}
+	if br.err {
+		return nil, fmt.Errorf("H.264 SPS 数据不完整")
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	switch chromaFormatIdc {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+
+	sps.width = widthInMbs*16 - cropUnitX*(cropLeft+cropRight)
+	sps.height = (2-frameMbsOnly)*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom)
+	return sps, nil
+}
+
+func skipScalingList(br *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && !br.err; j++ {
+		if next != 0 {
+			next = (last + br.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// avcDecoderConfig 生成 avcC box 的内容，NAL 长度字段固定为 4 字节
+func avcDecoderConfig(sps *h264SPS, spsNAL, ppsNAL []byte) []byte {
+	b := []byte{
+		1, // configurationVersion
+		sps.profileIdc,
+		sps.compatibility,
+		sps.levelIdc,
+		0xFC | 3, // lengthSizeMinusOne
+		0xE0 | 1, // numOfSequenceParameterSets
+	}
+	b = appendU16(b, uint16(len(spsNAL)))
+	b = append(b, spsNAL...)
+	b = append(b, 1) // numOfPictureParameterSets
+	b = appendU16(b, uint16(len(ppsNAL)))
+	b = append(b, ppsNAL...)
+	return b
+}
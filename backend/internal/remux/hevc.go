@@ -0,0 +1,143 @@
+package remux
+
+import "fmt"
+
+// H.265 NAL 单元类型
+const (
+	hevcNALVPS = 32
+	hevcNALSPS = 33
+	hevcNALPPS = 34
+	hevcNALAUD = 35
+)
+
+func hevcNALType(nal []byte) byte {
+	return (nal[0] >> 1) & 0x3F
+}
+
+// hevcIsKeyframe 判断是否为 IRAP 图像 (BLA/IDR/CRA)
+func hevcIsKeyframe(nalType byte) bool {
+	return nalType >= 16 && nalType <= 23
+}
+
+type hevcSPS struct {
+	profileSpace       byte
+	tierFlag           byte
+	profileIdc         byte
+	compatibilityFlags uint32
+	constraintFlags    [6]byte
+	levelIdc           byte
+	chromaFormatIdc    byte
+	bitDepthLuma       byte
+	bitDepthChroma     byte
+	temporalLayers     byte
+	temporalIDNested   byte
+	width              int
+	height             int
+}
+
+func parseHEVCSPS(nal []byte) (*hevcSPS, error) {
+	if len(nal) < 16 {
+		return nil, fmt.Errorf("H.265 SPS 过短")
+	}
+
+	rbsp := unescapeRBSP(nal[2:])
+	br := &bitReader{data: rbsp}
+	sps := &hevcSPS{}
+
+	br.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(br.u(3))
+	sps.temporalLayers = byte(maxSubLayersMinus1 + 1)
+	sps.temporalIDNested = byte(br.u(1))
+
+	// profile_tier_level
+	sps.profileSpace = byte(br.u(2))
+	sps.tierFlag = byte(br.u(1))
+	sps.profileIdc = byte(br.u(5))
+	sps.compatibilityFlags = br.u(32)
+	for i := range sps.constraintFlags {
+		sps.constraintFlags[i] = byte(br.u(8))
+	}
+	sps.levelIdc = byte(br.u(8))
+
+	subLayerProfilePresent := make([]bool, maxSubLayersMinus1)
+	subLayerLevelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i] = br.u(1) == 1
+		subLayerLevelPresent[i] = br.u(1) == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			br.skip(2)
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] {
+			br.skip(88)
+		}
+		if subLayerLevelPresent[i] {
+			br.skip(8)
+		}
+	}
+
+	br.ue() // sps_seq_parameter_set_id
+	sps.chromaFormatIdc = byte(br.ue())
+	if sps.chromaFormatIdc == 3 {
+		br.skip(1) // separate_colour_plane_flag
+	}
+	width := int(br.ue())
+	height := int(br.ue())
+	if br.u(1) == 1 {
+		subWidth, subHeight := 1, 1
+		switch sps.chromaFormatIdc {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		left, right := int(br.ue()), int(br.ue())
+		top, bottom := int(br.ue()), int(br.ue())
+		width -= subWidth * (left + right)
+		height -= subHeight * (top + bottom)
+	}
+	sps.bitDepthLuma = byte(br.ue() + 8)
+	sps.bitDepthChroma = byte(br.ue() + 8)
+
+	if br.err {
+		return nil, fmt.Errorf("H.265 SPS 数据不完整")
+	}
+
+	sps.width, sps.height = width, height
+	return sps, nil
+}
+
+// hevcDecoderConfig 生成 hvcC box 的内容，NAL 长度字段固定为 4 字节
+func hevcDecoderConfig(sps *hevcSPS, vps, spsNAL, pps []byte) []byte {
+	b := []byte{
+		1, // configurationVersion
+		sps.profileSpace<<6 | sps.tierFlag<<5 | sps.profileIdc,
+	}
+	b = appendU32(b, sps.compatibilityFlags)
+	b = append(b, sps.constraintFlags[:]...)
+	b = append(b,
+		sps.levelIdc,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,                     // parallelismType
+		0xFC|sps.chromaFormatIdc, // chromaFormat
+		0xF8|(sps.bitDepthLuma-8),
+		0xF8|(sps.bitDepthChroma-8),
+		0, 0, // avgFrameRate
+		sps.temporalLayers<<3|sps.temporalIDNested<<2|3,
+		3, // numOfArrays
+	)
+
+	for _, array := range []struct {
+		nalType byte
+		nal     []byte
+	}{{hevcNALVPS, vps}, {hevcNALSPS, spsNAL}, {hevcNALPPS, pps}} {
+		b = append(b, 0x80|array.nalType)
+		b = appendU16(b, 1)
+		b = appendU16(b, uint16(len(array.nal)))
+		b = append(b, array.nal...)
+	}
+	return b
+}
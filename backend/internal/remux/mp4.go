@@ -0,0 +1,365 @@
+package remux
+
+import "encoding/binary"
+
+// movieTimescale 是 mvhd/tkhd/elst 使用的时间刻度（毫秒）
+const movieTimescale = 1000
+
+type mp4Sample struct {
+	size     uint32
+	dts      int64 // 轨道时间刻度
+	cto      int32 // 显示时间与解码时间的差
+	keyframe bool
+}
+
+type mp4Chunk struct {
+	offset  int64 // 相对 mdat 数据起点的偏移
+	samples uint32
+}
+
+type mp4Track struct {
+	id              uint32
+	video           bool
+	timescale       uint32
+	defaultDuration uint32
+	startPTS        int64 // 第一帧的显示时间 (90kHz)，用于对齐音视频
+	sampleEntry     []byte
+	width, height   int
+	samples         []mp4Sample
+	chunks          []mp4Chunk
+}
+
+func (t *mp4Track) durations() []uint32 {
+	n := len(t.samples)
+	durations := make([]uint32, n)
+	for i := 0; i+1 < n; i++ {
+		diff := t.samples[i+1].dts - t.samples[i].dts
+		if diff <= 0 {
+			diff = int64(t.defaultDuration)
+		}
+		durations[i] = uint32(diff)
+	}
+	if n > 1 {
+		durations[n-1] = durations[n-2]
+	} else if n == 1 {
+		durations[0] = t.defaultDuration
+	}
+	return durations
+}
+
+// buildMoov 生成 moov box，dataOffset 是 mdat 数据在文件中的起始位置
+func buildMoov(tracks []*mp4Track, dataOffset int64, useCo64 bool) []byte {
+	globalStart := tracks[0].startPTS
+	for _, t := range tracks[1:] {
+		globalStart = min(globalStart, t.startPTS)
+	}
+
+	var traks [][]byte
+	var movieDuration uint32
+	for _, t := range tracks {
+		trak, duration := buildTrak(t, globalStart, dataOffset, useCo64)
+		traks = append(traks, trak)
+		movieDuration = max(movieDuration, duration)
+	}
+
+	mvhd := make([]byte, 0, 96)
+	mvhd = appendU32(mvhd, 0) // creation_time
+	mvhd = appendU32(mvhd, 0) // modification_time
+	mvhd = appendU32(mvhd, movieTimescale)
+	mvhd = appendU32(mvhd, movieDuration)
+	mvhd = appendU32(mvhd, 0x00010000) // rate
+	mvhd = appendU16(mvhd, 0x0100)     // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = appendMatrix(mvhd)
+	mvhd = append(mvhd, make([]byte, 24)...) // pre_defined
+	mvhd = appendU32(mvhd, uint32(len(tracks)+1))
+
+	return box("moov", append([][]byte{fullBox("mvhd", 0, 0, mvhd)}, traks...)...)
+}
+
+func buildTrak(t *mp4Track, globalStart, dataOffset int64, useCo64 bool) ([]byte, uint32) {
+	durations := t.durations()
+	var mediaDuration int64
+	for _, d := range durations {
+		mediaDuration += int64(d)
+	}
+
+	// 编辑列表：先用空编辑补齐与最早轨道的起始差，再从第一帧的显示时间开始播放
+	var mediaTime int64
+	if len(t.samples) > 0 && t.samples[0].cto > 0 {
+		mediaTime = int64(t.samples[0].cto)
+	}
+	emptyDuration := uint32((t.startPTS - globalStart) * movieTimescale / 90000)
+	segmentDuration := uint32(max(mediaDuration-mediaTime, 0) * movieTimescale / int64(t.timescale))
+
+	var elst []byte
+	entries := uint32(1)
+	if emptyDuration > 0 {
+		entries++
+	}
+	elst = appendU32(elst, entries)
+	if emptyDuration > 0 {
+		elst = appendU32(elst, emptyDuration)
+		elst = appendU32(elst, 0xFFFFFFFF) // media_time = -1
+		elst = appendU32(elst, 0x00010000)
+	}
+	elst = appendU32(elst, segmentDuration)
+	elst = appendU32(elst, uint32(mediaTime))
+	elst = appendU32(elst, 0x00010000)
+	trackDuration := emptyDuration + segmentDuration
+
+	tkhd := make([]byte, 0, 80)
+	tkhd = appendU32(tkhd, 0) // creation_time
+	tkhd = appendU32(tkhd, 0) // modification_time
+	tkhd = appendU32(tkhd, t.id)
+	tkhd = appendU32(tkhd, 0)
+	tkhd = appendU32(tkhd, trackDuration)
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = appendU16(tkhd, 0) // layer
+	tkhd = appendU16(tkhd, 0) // alternate_group
+	if t.video {
+		tkhd = appendU16(tkhd, 0)
+	} else {
+		tkhd = appendU16(tkhd, 0x0100)
+	}
+	tkhd = appendU16(tkhd, 0)
+	tkhd = appendMatrix(tkhd)
+	tkhd = appendU32(tkhd, uint32(t.width)<<16)
+	tkhd = appendU32(tkhd, uint32(t.height)<<16)
+
+	mdhd := make([]byte, 0, 20)
+	mdhd = appendU32(mdhd, 0)
+	mdhd = appendU32(mdhd, 0)
+	mdhd = appendU32(mdhd, t.timescale)
+	mdhd = appendU32(mdhd, uint32(mediaDuration))
+	mdhd = appendU16(mdhd, 0x55C4) // language = "und"
+	mdhd = appendU16(mdhd, 0)
+
+	handlerType, handlerName := "soun", "SoundHandler"
+	mediaHeader := fullBox("smhd", 0, 0, make([]byte, 4))
+	if t.video {
+		handlerType, handlerName = "vide", "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+	hdlr := make([]byte, 0, 32)
+	hdlr = appendU32(hdlr, 0)
+	hdlr = append(hdlr, handlerType...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, handlerName...)
+	hdlr = append(hdlr, 0)
+
+	dref := fullBox("dref", 0, 0, []byte{0, 0, 0, 1}, fullBox("url ", 0, 1))
+
+	minf := box("minf",
+		mediaHeader,
+		box("dinf", dref),
+		buildStbl(t, durations, dataOffset, useCo64),
+	)
+	mdia := box("mdia", fullBox("mdhd", 0, 0, mdhd), fullBox("hdlr", 0, 0, hdlr), minf)
+
+	trak := box("trak",
+		fullBox("tkhd", 0, 3, tkhd),
+		box("edts", fullBox("elst", 0, 0, elst)),
+		mdia,
+	)
+	return trak, trackDuration
+}
+
+func buildStbl(t *mp4Track, durations []uint32, dataOffset int64, useCo64 bool) []byte {
+	stsd := fullBox("stsd", 0, 0, []byte{0, 0, 0, 1}, t.sampleEntry)
+
+	// stts: 相同时长的连续样本合并为一项
+	var stts []byte
+	var sttsEntries uint32
+	for i := 0; i < len(durations); {
+		j := i
+		for j < len(durations) && durations[j] == durations[i] {
+			j++
+		}
+		stts = appendU32(stts, uint32(j-i))
+		stts = appendU32(stts, durations[i])
+		sttsEntries++
+		i = j
+	}
+	boxes := [][]byte{stsd, fullBox("stts", 0, 0, appendU32(nil, sttsEntries), stts)}
+
+	hasCTO := false
+	for _, s := range t.samples {
+		if s.cto != 0 {
+			hasCTO = true
+			break
+		}
+	}
+	if hasCTO {
+		var ctts []byte
+		var cttsEntries uint32
+		for i := 0; i < len(t.samples); {
+			j := i
+			for j < len(t.samples) && t.samples[j].cto == t.samples[i].cto {
+				j++
+			}
+			ctts = appendU32(ctts, uint32(j-i))
+			ctts = appendU32(ctts, uint32(max(t.samples[i].cto, 0)))
+			cttsEntries++
+			i = j
+		}
+		boxes = append(boxes, fullBox("ctts", 0, 0, appendU32(nil, cttsEntries), ctts))
+	}
+
+	if t.video {
+		var stss []byte
+		var keyframes uint32
+		for i, s := range t.samples {
+			if s.keyframe {
+				stss = appendU32(stss, uint32(i+1))
+				keyframes++
+			}
+		}
+		boxes = append(boxes, fullBox("stss", 0, 0, appendU32(nil, keyframes), stss))
+	}
+
+	// stsc: 每块样本数相同的连续块合并为一项
+	var stsc []byte
+	var stscEntries uint32
+	for i, c := range t.chunks {
+		if i == 0 || c.samples != t.chunks[i-1].samples {
+			stsc = appendU32(stsc, uint32(i+1))
+			stsc = appendU32(stsc, c.samples)
+			stsc = appendU32(stsc, 1)
+			stscEntries++
+		}
+	}
+	boxes = append(boxes, fullBox("stsc", 0, 0, appendU32(nil, stscEntries), stsc))
+
+	stsz := make([]byte, 0, 8+4*len(t.samples))
+	stsz = appendU32(stsz, 0)
+	stsz = appendU32(stsz, uint32(len(t.samples)))
+	for _, s := range t.samples {
+		stsz = appendU32(stsz, s.size)
+	}
+	boxes = append(boxes, fullBox("stsz", 0, 0, stsz))
+
+	offsets := appendU32(nil, uint32(len(t.chunks)))
+	for _, c := range t.chunks {
+		if useCo64 {
+			offsets = appendU64(offsets, uint64(dataOffset+c.offset))
+		} else {
+			offsets = appendU32(offsets, uint32(dataOffset+c.offset))
+		}
+	}
+	if useCo64 {
+		boxes = append(boxes, fullBox("co64", 0, 0, offsets))
+	} else {
+		boxes = append(boxes, fullBox("stco", 0, 0, offsets))
+	}
+
+	return box("stbl", boxes...)
+}
+
+// videoSampleEntry 生成 avc1/hvc1 样本描述，config 为 avcC/hvcC box
+func videoSampleEntry(format string, width, height int, config []byte) []byte {
+	b := make([]byte, 6, 78)
+	b = appendU16(b, 1) // data_reference_index
+	b = append(b, make([]byte, 16)...)
+	b = appendU16(b, uint16(width))
+	b = appendU16(b, uint16(height))
+	b = appendU32(b, 0x00480000) // horizresolution
+	b = appendU32(b, 0x00480000) // vertresolution
+	b = appendU32(b, 0)
+	b = appendU16(b, 1) // frame_count
+	b = append(b, make([]byte, 32)...)
+	b = appendU16(b, 0x0018) // depth
+	b = appendU16(b, 0xFFFF) // pre_defined = -1
+	return box(format, b, config)
+}
+
+// audioSampleEntry 生成 mp4a 样本描述
+func audioSampleEntry(channels, sampleRate int, asc []byte) []byte {
+	b := make([]byte, 6, 28)
+	b = appendU16(b, 1) // data_reference_index
+	b = append(b, make([]byte, 8)...)
+	b = appendU16(b, uint16(channels))
+	b = appendU16(b, 16) // samplesize
+	b = appendU32(b, 0)
+	b = appendU32(b, uint32(sampleRate)<<16)
+	return box("mp4a", b, buildEsds(asc))
+}
+
+func buildEsds(asc []byte) []byte {
+	decoderSpecific := descriptor(0x05, asc)
+	decoderConfig := descriptor(0x04, []byte{
+		0x40,    // objectTypeIndication: MPEG-4 Audio
+		0x15,    // streamType: AudioStream
+		0, 0, 0, // bufferSizeDB
+		0, 0, 0, 0, // maxBitrate
+		0, 0, 0, 0, // avgBitrate
+	}, decoderSpecific)
+	slConfig := descriptor(0x06, []byte{0x02})
+	es := descriptor(0x03, []byte{0, 0, 0}, decoderConfig, slConfig)
+	return fullBox("esds", 0, 0, es)
+}
+
+func descriptor(tag byte, parts ...[]byte) []byte {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := []byte{tag, byte(size)}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func ftypBox() []byte {
+	return box("ftyp", []byte("isom"), appendU32(nil, 0x200), []byte("isomiso2avc1mp41"))
+}
+
+// mdatHeader 生成 mdat 头，超过 4GB 时使用 64 位 largesize
+func mdatHeader(dataSize int64) []byte {
+	if dataSize+8 > 0xFFFFFFFF {
+		b := appendU32(nil, 1)
+		b = append(b, "mdat"...)
+		return appendU64(b, uint64(dataSize+16))
+	}
+	b := appendU32(nil, uint32(dataSize+8))
+	return append(b, "mdat"...)
+}
+
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = appendU32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+func appendMatrix(b []byte) []byte {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = appendU32(b, v)
+	}
+	return b
+}
+
+func appendU16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendU64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
@@ -0,0 +1,572 @@
+// Package remux 提供不依赖 ffmpeg 的 MPEG-TS 解析与 MP4 封装
+package remux
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// ErrUnsupportedCodec 表示输入中包含原生封装器不支持的编码
+var ErrUnsupportedCodec = errors.New("不支持的编码格式")
+
+const (
+	tsTimestampWrap = int64(1) << 33
+	// maxTimestampJump 超过该值的时间戳跳变视为不连续，按上一帧时长续接
+	maxTimestampJump = 10 * 90000
+	// defaultVideoDuration 无法从相邻帧推算时使用的帧时长 (90kHz, 25fps)
+	defaultVideoDuration = 3600
+)
+
+// Discontinuity 表示从第 Input 个输入开始新的不连续段，时间戳接续上一段重新计算，
+// 两段之间留出 Gap 的空白（例如缺失的分片）
+type Discontinuity struct {
+	Input int
+	Gap   time.Duration
+}
+
+// TSToMP4 将多个 TS 文件按顺序解复用并封装为一个 faststart MP4，
+// 支持 H.264/H.265 视频和 AAC 音频，tmpDir 用于存放 mdat 临时数据
+func TSToMP4(ctx context.Context, inputs []string, discontinuities []Discontinuity, outputFilename, tmpDir string) error {
+	r, err := newRemuxer(tmpDir)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	for i, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if j := slices.IndexFunc(discontinuities, func(d Discontinuity) bool { return d.Input == i }); j >= 0 {
+			if err := r.discontinuity(discontinuities[j].Gap); err != nil {
+				return err
+			}
+		}
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return fmt.Errorf("读取分片失败: %v", err)
+		}
+		packets, _ := SplitPackets(data)
+		for _, pkt := range packets {
+			if err := r.writePacket(pkt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.flush(); err != nil {
+		return err
+	}
+	return r.writeMP4(outputFilename)
+}
+
+type pesStream struct {
+	buf     []byte
+	started bool
+}
+
+type videoState struct {
+	streamType byte
+	vps        []byte
+	sps        []byte
+	pps        []byte
+	track      *mp4Track
+	timeline   timeline
+}
+
+type audioState struct {
+	pending []byte
+	track   *mp4Track
+	offset  int64         // 按 PES 时间戳换算的解码时间与输出时间轴之差（采样数）
+	reset   bool          // 下一帧位于不连续点之后，需要重新对齐
+	gap     time.Duration // 不连续点之后额外留出的空白
+}
+
+type remuxer struct {
+	mdatFile *os.File
+	mdat     *bufio.Writer
+	mdatSize int64
+
+	pmtPID   uint16
+	hasPAT   bool
+	videoPID uint16
+	audioPID uint16
+	streams  map[uint16]*pesStream
+
+	video     videoState
+	audio     audioState
+	lastTrack *mp4Track
+}
+
+func newRemuxer(tmpDir string) (*remuxer, error) {
+	f, err := os.CreateTemp(tmpDir, "mdat-*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	return &remuxer{
+		mdatFile: f,
+		mdat:     bufio.NewWriterSize(f, 1<<20),
+		streams:  make(map[uint16]*pesStream),
+	}, nil
+}
+
+func (r *remuxer) close() {
+	r.mdatFile.Close()
+	os.Remove(r.mdatFile.Name())
+}
+
+func (r *remuxer) writePacket(pkt []byte) error {
+	pid := PacketPID(pkt)
+	payload, pusi := packetPayload(pkt)
+	if payload == nil {
+		return nil
+	}
+
+	switch {
+	case pid == 0:
+		if pusi {
+			if pmtPID, ok := parsePAT(payload); ok {
+				r.pmtPID, r.hasPAT = pmtPID, true
+			}
+		}
+	case r.hasPAT && pid == r.pmtPID:
+		if pusi {
+			if streams, ok := parsePMT(payload); ok {
+				return r.handlePMT(streams)
+			}
+		}
+	case pid == r.videoPID || pid == r.audioPID:
+		s := r.streams[pid]
+		if pusi {
+			if err := r.flushPES(pid, s); err != nil {
+				return err
+			}
+			s.buf = append(s.buf[:0], payload...)
+			s.started = true
+		} else if s.started {
+			s.buf = append(s.buf, payload...)
+		}
+	}
+	return nil
+}
+
+// handlePMT 选取第一路支持的视频流和音频流，只有不支持的编码时返回 ErrUnsupportedCodec
+func (r *remuxer) handlePMT(streams []elementaryStream) error {
+	var videoPID, audioPID uint16
+	var videoType, unsupportedVideo, unsupportedAudio byte
+
+	for _, es := range streams {
+		switch es.streamType {
+		case streamTypeH264, streamTypeH265:
+			if videoPID == 0 {
+				videoPID, videoType = es.pid, es.streamType
+			}
+		case streamTypeAAC:
+			if audioPID == 0 {
+				audioPID = es.pid
+			}
+		case 0x01, 0x02, 0x10: // MPEG-1/2 视频, MPEG-4 Part 2
+			unsupportedVideo = es.streamType
+		case 0x03, 0x04, 0x11, 0x81, 0x87: // MP3, LATM AAC, AC-3, E-AC-3
+			unsupportedAudio = es.streamType
+		}
+	}
+
+	if videoPID == 0 && unsupportedVideo != 0 {
+		return fmt.Errorf("%w: 视频流类型 0x%02X", ErrUnsupportedCodec, unsupportedVideo)
+	}
+	if audioPID == 0 && unsupportedAudio != 0 {
+		return fmt.Errorf("%w: 音频流类型 0x%02X", ErrUnsupportedCodec, unsupportedAudio)
+	}
+	if videoPID != 0 && r.video.streamType != 0 && videoType != r.video.streamType {
+		return fmt.Errorf("%w: 视频编码在分片之间发生变化", ErrUnsupportedCodec)
+	}
+
+	if videoPID != r.videoPID {
+		if err := r.flushPES(r.videoPID, r.streams[r.videoPID]); err != nil {
+			return err
+		}
+		r.videoPID = videoPID
+		r.video.streamType = videoType
+	}
+	if audioPID != r.audioPID {
+		if err := r.flushPES(r.audioPID, r.streams[r.audioPID]); err != nil {
+			return err
+		}
+		r.audioPID = audioPID
+	}
+	for _, pid := range []uint16{r.videoPID, r.audioPID} {
+		if pid != 0 && r.streams[pid] == nil {
+			r.streams[pid] = &pesStream{}
+		}
+	}
+	return nil
+}
+
+// flush 处理缓冲中最后一个 PES 包并写出 mdat 数据
+func (r *remuxer) flush() error {
+	for pid, s := range r.streams {
+		if err := r.flushPES(pid, s); err != nil {
+			return err
+		}
+	}
+	return r.mdat.Flush()
+}
+
+// discontinuity 写出上一段缓冲的数据，下一帧视频的时间戳接在上一帧之后再留出 gap，
+// 音频同样留出 gap，不完整的 ADTS 帧丢弃
+func (r *remuxer) discontinuity(gap time.Duration) error {
+	for pid, s := range r.streams {
+		if err := r.flushPES(pid, s); err != nil {
+			return err
+		}
+	}
+	r.video.timeline.reset = true
+	r.video.timeline.gap = int64(gap * 90000 / time.Second)
+	if r.audio.track != nil {
+		r.audio.reset = true
+		r.audio.gap += gap
+	}
+	r.audio.pending = nil
+	return nil
+}
+
+func (r *remuxer) flushPES(pid uint16, s *pesStream) error {
+	if s == nil || !s.started {
+		return nil
+	}
+	s.started = false
+
+	pes, ok := parsePES(s.buf)
+	if !ok {
+		return nil
+	}
+	switch pid {
+	case r.videoPID:
+		return r.writeVideo(pes)
+	case r.audioPID:
+		return r.writeAudio(pes)
+	}
+	return nil
+}
+
+// writeVideo 将一个 PES 包作为一个访问单元写入，参数集转存到 avcC/hvcC 中
+func (r *remuxer) writeVideo(pes *pesPacket) error {
+	v := &r.video
+	hevc := v.streamType == streamTypeH265
+
+	var sample []byte
+	keyframe := false
+	for _, nal := range splitNALUnits(pes.data) {
+		if hevc {
+			switch nalType := hevcNALType(nal); {
+			case nalType == hevcNALAUD:
+				continue
+			case nalType == hevcNALVPS:
+				if err := v.setParameterSet(&v.vps, nal, "VPS"); err != nil {
+					return err
+				}
+				continue
+			case nalType == hevcNALSPS:
+				if err := v.setParameterSet(&v.sps, nal, "SPS"); err != nil {
+					return err
+				}
+				continue
+			case nalType == hevcNALPPS:
+				if err := v.setParameterSet(&v.pps, nal, "PPS"); err != nil {
+					return err
+				}
+				continue
+			case hevcIsKeyframe(nalType):
+				keyframe = true
+			}
+		} else {
+			switch h264NALType(nal) {
+			case h264NALAUD:
+				continue
+			case h264NALSPS:
+				if err := v.setParameterSet(&v.sps, nal, "SPS"); err != nil {
+					return err
+				}
+				continue
+			case h264NALPPS:
+				if err := v.setParameterSet(&v.pps, nal, "PPS"); err != nil {
+					return err
+				}
+				continue
+			case h264NALIDR:
+				keyframe = true
+			}
+		}
+		sample = appendU32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+	if len(sample) == 0 || pes.pts < 0 {
+		return nil
+	}
+
+	if v.track == nil {
+		// 第一个关键帧之前的数据无法解码，直接丢弃
+		if !keyframe {
+			return nil
+		}
+		track, err := newVideoTrack(v)
+		if err != nil || track == nil {
+			return err
+		}
+		v.track = track
+	}
+
+	dts := v.timeline.adjust(pes.dts)
+	cto := (pes.pts - pes.dts + tsTimestampWrap) % tsTimestampWrap
+	if cto > maxTimestampJump {
+		cto = 0
+	}
+	if len(v.track.samples) == 0 {
+		v.track.startPTS = dts + cto
+	}
+
+	return r.writeSample(v.track, sample, mp4Sample{
+		dts:      dts,
+		cto:      int32(cto),
+		keyframe: keyframe,
+	})
+}
+
+// setParameterSet 保存参数集。avcC/hvcC 只有一份，轨道创建后参数集变化（例如不连续点后
+// 分辨率或档位切换）时返回 ErrUnsupportedCodec，交给 ffmpeg 处理
+func (v *videoState) setParameterSet(dst *[]byte, nal []byte, name string) error {
+	nal = bytes.TrimRight(nal, "\x00")
+	if v.track != nil {
+		if !bytes.Equal(*dst, nal) {
+			return fmt.Errorf("%w: 视频 %s 在轨道中途发生变化", ErrUnsupportedCodec, name)
+		}
+		return nil
+	}
+	*dst = append((*dst)[:0], nal...)
+	return nil
+}
+
+// newVideoTrack 根据参数集创建视频轨道，参数集尚未齐全时返回 nil
+func newVideoTrack(v *videoState) (*mp4Track, error) {
+	if v.streamType == streamTypeH265 {
+		if v.vps == nil || v.sps == nil || v.pps == nil {
+			return nil, nil
+		}
+		sps, err := parseHEVCSPS(v.sps)
+		if err != nil {
+			return nil, err
+		}
+		config := box("hvcC", hevcDecoderConfig(sps, v.vps, v.sps, v.pps))
+		return &mp4Track{
+			video:           true,
+			timescale:       90000,
+			defaultDuration: defaultVideoDuration,
+			width:           sps.width,
+			height:          sps.height,
+			sampleEntry:     videoSampleEntry("hvc1", sps.width, sps.height, config),
+		}, nil
+	}
+
+	if v.sps == nil || v.pps == nil {
+		return nil, nil
+	}
+	sps, err := parseH264SPS(v.sps)
+	if err != nil {
+		return nil, err
+	}
+	config := box("avcC", avcDecoderConfig(sps, v.sps, v.pps))
+	return &mp4Track{
+		video:           true,
+		timescale:       90000,
+		defaultDuration: defaultVideoDuration,
+		width:           sps.width,
+		height:          sps.height,
+		sampleEntry:     videoSampleEntry("avc1", sps.width, sps.height, config),
+	}, nil
+}
+
+// writeAudio 从 PES 负载中切出 ADTS 帧，跨 PES 的不完整帧留到下一次处理。
+// 帧的解码时间按所在 PES 的 PTS 加上它在 PES 中的帧序号计算，跨 PES 的帧接在上一帧之后
+func (r *remuxer) writeAudio(pes *pesPacket) error {
+	a := &r.audio
+	carried := len(a.pending) // buf 开头属于上一个 PES 的字节数
+	buf := append(a.pending, pes.data...)
+	consumed, frame := 0, 0
+	for len(buf) >= 7 {
+		h, ok := parseADTSHeader(buf)
+		if !ok {
+			next := findADTSSync(buf)
+			if next < 0 {
+				consumed += len(buf) - 1
+				buf = buf[len(buf)-1:]
+				break
+			}
+			consumed += next
+			buf = buf[next:]
+			continue
+		}
+		if h.frameLength > len(buf) {
+			break
+		}
+
+		if a.track == nil {
+			a.track = &mp4Track{
+				timescale:       uint32(h.sampleRate()),
+				defaultDuration: aacSamplesPerFrame,
+				startPTS:        max(pes.pts, 0),
+				sampleEntry:     audioSampleEntry(int(h.channels), h.sampleRate(), h.audioSpecificConfig()),
+			}
+		}
+		pts := int64(-1)
+		if consumed >= carried {
+			pts = pes.pts
+		}
+		sample := mp4Sample{dts: a.dts(pts, frame)}
+		if err := r.writeSample(a.track, buf[h.headerLength:h.frameLength], sample); err != nil {
+			return err
+		}
+		if consumed >= carried {
+			frame++
+		}
+		consumed += h.frameLength
+		buf = buf[h.frameLength:]
+	}
+	a.pending = append(a.pending[:0:0], buf...)
+	return nil
+}
+
+// dts 返回 PES 中第 frame 帧的解码时间（轨道时间刻度）。pts 为负（帧始于上一个 PES）时
+// 接在上一帧之后；按 PTS 算出的时间与上一帧之后偏差超过一帧（时间戳跳变、不连续点）时
+// 重新对齐到上一帧之后，不连续点再留出 gap
+func (a *audioState) dts(pts int64, frame int) int64 {
+	t := a.track
+	var next int64
+	if n := len(t.samples); n > 0 {
+		next = t.samples[n-1].dts + aacSamplesPerFrame
+	}
+	if pts < 0 {
+		return next
+	}
+
+	elapsed := (pts - t.startPTS + tsTimestampWrap) % tsTimestampWrap
+	v := elapsed*int64(t.timescale)/90000 + int64(frame)*aacSamplesPerFrame + a.offset
+	if drift := v - next; a.reset || drift > aacSamplesPerFrame || drift < -aacSamplesPerFrame {
+		if a.reset {
+			next += int64(a.gap) * int64(t.timescale) / int64(time.Second)
+		}
+		a.reset, a.gap = false, 0
+		a.offset += next - v
+		v = next
+	}
+	return v
+}
+
+func (r *remuxer) writeSample(t *mp4Track, data []byte, s mp4Sample) error {
+	if _, err := r.mdat.Write(data); err != nil {
+		return fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	if r.lastTrack != t || len(t.chunks) == 0 {
+		t.chunks = append(t.chunks, mp4Chunk{offset: r.mdatSize})
+	}
+	t.chunks[len(t.chunks)-1].samples++
+
+	s.size = uint32(len(data))
+	t.samples = append(t.samples, s)
+	r.mdatSize += int64(len(data))
+	r.lastTrack = t
+	return nil
+}
+
+// writeMP4 依次写出 ftyp、moov、mdat，moov 在前以便边下边播
+func (r *remuxer) writeMP4(outputFilename string) error {
+	var tracks []*mp4Track
+	for _, t := range []*mp4Track{r.video.track, r.audio.track} {
+		if t != nil && len(t.samples) > 0 {
+			t.id = uint32(len(tracks) + 1)
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("未找到可封装的 H.264/H.265/AAC 数据")
+	}
+
+	ftyp := ftypBox()
+	mdatHdr := mdatHeader(r.mdatSize)
+
+	// 偏移字段为定长，先用 0 计算 moov 大小，再回填真实偏移
+	useCo64 := false
+	moov := buildMoov(tracks, 0, useCo64)
+	dataOffset := int64(len(ftyp) + len(moov) + len(mdatHdr))
+	if dataOffset+r.mdatSize > 0xFFFFFFFF {
+		useCo64 = true
+		moov = buildMoov(tracks, 0, useCo64)
+		dataOffset = int64(len(ftyp) + len(moov) + len(mdatHdr))
+	}
+	moov = buildMoov(tracks, dataOffset, useCo64)
+
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer out.Close()
+
+	for _, b := range [][]byte{ftyp, moov, mdatHdr} {
+		if _, err := out.Write(b); err != nil {
+			return fmt.Errorf("写入输出文件失败: %v", err)
+		}
+	}
+	if _, err := r.mdatFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("读取临时文件失败: %v", err)
+	}
+	if _, err := io.Copy(out, r.mdatFile); err != nil {
+		return fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	return out.Close()
+}
+
+// timeline 处理 33 位时间戳回绕和分片之间的时间戳跳变，保证解码时间单调递增
+type timeline struct {
+	started bool
+	reset   bool  // 下一个时间戳位于不连续点之后
+	gap     int64 // 不连续点之后额外留出的空白
+	offset  int64
+	last    int64
+	step    int64
+}
+
+func (t *timeline) adjust(ts int64) int64 {
+	if !t.started {
+		t.started = true
+		t.last = ts
+		t.step = defaultVideoDuration
+		return ts
+	}
+
+	v := ts + t.offset
+	delta := v - t.last
+	if delta < -tsTimestampWrap/2 {
+		t.offset += tsTimestampWrap
+		v += tsTimestampWrap
+		delta += tsTimestampWrap
+	}
+	if delta <= 0 || delta > maxTimestampJump || t.reset {
+		next := t.last + t.step
+		if t.reset {
+			next += t.gap
+		}
+		t.reset, t.gap = false, 0
+		t.offset += next - v
+		v = next
+	} else {
+		t.step = delta
+	}
+	t.last = v
+	return v
+}
@@ -0,0 +1,461 @@
+package remux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+	testPMTPID   = 0x1000
+	testFrameDur = 3600 // 25fps
+	// 48kHz 下一个 AAC 帧的时长 (90kHz)
+	testAudioFrameDur = aacSamplesPerFrame * 90000 / 48000
+)
+
+// bitWriter 按位写入，用于构造 SPS
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>i&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+// testSPS 生成 Baseline 档次、指定分辨率的 H.264 SPS（宽高须为 16 的倍数）
+func testSPS(width, height int) []byte {
+	w := &bitWriter{}
+	w.u(8, 0x67) // NAL 头
+	w.u(8, 66)   // profile_idc
+	w.u(8, 0xC0) // constraint flags
+	w.u(8, 30)   // level_idc
+	w.ue(0)      // seq_parameter_set_id
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(0)      // pic_order_cnt_type
+	w.ue(0)      // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)      // max_num_ref_frames
+	w.u(1, 0)    // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint32(width/16 - 1))
+	w.ue(uint32(height/16 - 1))
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	w.u(1, 0) // frame_cropping_flag
+	w.u(1, 0) // vui_parameters_present_flag
+	w.u(1, 1) // rbsp_stop_one_bit
+	return w.buf
+}
+
+var testPPS = []byte{0x68, 0xCE, 0x38, 0x80}
+
+// testADTS 生成一个 48kHz 双声道 AAC-LC 的 ADTS 帧
+func testADTS() []byte {
+	payload := bytes.Repeat([]byte{0x21}, 16)
+	n := 7 + len(payload)
+	h := []byte{
+		0xFF, 0xF1,
+		1<<6 | 3<<2 | 0, // AAC-LC, 48000Hz, 声道高位
+		2<<6 | byte(n>>11),
+		byte(n >> 3),
+		byte(n&7)<<5 | 0x1F,
+		0xFC,
+	}
+	return append(h, payload...)
+}
+
+// tsWriter 把 PSI 和 PES 切成 188 字节的 TS 包
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[uint16]byte
+}
+
+func (w *tsWriter) write(pid uint16, payload []byte) {
+	if w.cc == nil {
+		w.cc = make(map[uint16]byte)
+	}
+	for first := true; first || len(payload) > 0; first = false {
+		pkt := make([]byte, PacketSize)
+		pkt[0] = SyncByte
+		pkt[1] = byte(pid>>8) & 0x1F
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+
+		n := min(len(payload), PacketSize-4)
+		if n < PacketSize-4 {
+			// 用适配字段填充不足一个包的负载
+			pkt[3] = 0x30 | w.cc[pid]
+			stuffing := PacketSize - 4 - n - 1
+			pkt[4] = byte(stuffing)
+			if stuffing > 0 {
+				pkt[5] = 0
+				for i := 6; i < 5+stuffing; i++ {
+					pkt[i] = 0xFF
+				}
+			}
+			copy(pkt[5+stuffing:], payload[:n])
+		} else {
+			pkt[3] = 0x10 | w.cc[pid]
+			copy(pkt[4:], payload[:n])
+		}
+		w.cc[pid] = (w.cc[pid] + 1) & 0x0F
+		payload = payload[n:]
+		w.buf.Write(pkt)
+	}
+}
+
+func psi(tableID byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(length>>8), byte(length), 0, 1, 0xC1, 0, 0}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0) // CRC 不参与校验
+}
+
+func (w *tsWriter) writeTables(streams []elementaryStream) {
+	w.write(0, psi(0x00, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF}))
+	body := []byte{0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0}
+	for _, es := range streams {
+		body = append(body, es.streamType, 0xE0|byte(es.pid>>8), byte(es.pid), 0xF0, 0)
+	}
+	w.write(testPMTPID, psi(0x02, body))
+}
+
+func pesTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0E | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+func (w *tsWriter) writePES(pid uint16, streamID byte, pts int64, data []byte) {
+	pes := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5}
+	pes = append(pes, pesTimestamp(0x2, pts)...)
+	w.write(pid, append(pes, data...))
+}
+
+// fixture 描述一个测试用的 TS 分片
+type fixture struct {
+	start  int64 // 第一帧的 PTS (90kHz)
+	frames int
+	width  int
+	audio  bool
+	codec  byte // 视频流类型，默认 H.264
+}
+
+func (f fixture) write(t *testing.T, path string) {
+	t.Helper()
+	codec := f.codec
+	if codec == 0 {
+		codec = streamTypeH264
+	}
+	width := f.width
+	if width == 0 {
+		width = 320
+	}
+
+	w := &tsWriter{}
+	streams := []elementaryStream{{pid: testVideoPID, streamType: codec}}
+	if f.audio {
+		streams = append(streams, elementaryStream{pid: testAudioPID, streamType: streamTypeAAC})
+	}
+	w.writeTables(streams)
+
+	startCode := []byte{0, 0, 0, 1}
+	for i := 0; i < f.frames; i++ {
+		pts := f.start + int64(i)*testFrameDur
+		var au []byte
+		if i == 0 {
+			au = append(au, startCode...)
+			au = append(au, testSPS(width, 240)...)
+			au = append(au, startCode...)
+			au = append(au, testPPS...)
+			au = append(au, startCode...)
+			au = append(au, 0x65, 0x88, 0x84, 0x00, 0x33) // IDR
+		} else {
+			au = append(au, startCode...)
+			au = append(au, 0x41, 0x9A, 0x02, 0x03) // 非 IDR
+		}
+		w.writePES(testVideoPID, 0xE0, pts, au)
+		if f.audio {
+			w.writePES(testAudioPID, 0xC0, f.start+int64(i)*testAudioFrameDur, testADTS())
+		}
+	}
+
+	if err := os.WriteFile(path, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trackInfo 汇总 trak 中的 handler、时间刻度、时长和采样数
+type trackInfo struct {
+	handler   string
+	timescale uint32
+	duration  uint32
+	samples   uint32
+}
+
+// childBoxes 解析连续排列的 box，返回类型和负载
+func childBoxes(t *testing.T, data []byte) (types []string, payloads [][]byte) {
+	t.Helper()
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("box 头不完整")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %q 长度无效", data[4:8])
+		}
+		types = append(types, string(data[4:8]))
+		payloads = append(payloads, data[8:size])
+		data = data[size:]
+	}
+	return types, payloads
+}
+
+// childBox 按路径查找第一个匹配的子 box 的负载
+func childBox(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		types, payloads := childBoxes(t, data)
+		i := slices.Index(types, typ)
+		if i < 0 {
+			t.Fatalf("缺少 %s", typ)
+		}
+		data = payloads[i]
+	}
+	return data
+}
+
+func readTracks(t *testing.T, data []byte) []trackInfo {
+	t.Helper()
+	var tracks []trackInfo
+	types, payloads := childBoxes(t, childBox(t, data, "moov"))
+	for i, trak := range payloads {
+		if types[i] != "trak" {
+			continue
+		}
+		mdhd := childBox(t, trak, "mdia", "mdhd")
+		hdlr := childBox(t, trak, "mdia", "hdlr")
+		stsz := childBox(t, trak, "mdia", "minf", "stbl", "stsz")
+		tracks = append(tracks, trackInfo{
+			handler:   string(hdlr[8:12]),
+			timescale: binary.BigEndian.Uint32(mdhd[12:]),
+			duration:  binary.BigEndian.Uint32(mdhd[16:]),
+			samples:   binary.BigEndian.Uint32(stsz[8:]),
+		})
+	}
+	return tracks
+}
+
+func TestTSToMP4(t *testing.T) {
+	const base = 126000 // 1.4 秒
+
+	tests := []struct {
+		name            string
+		inputs          []fixture
+		discontinuities []Discontinuity
+		want            []trackInfo
+		wantErr         error
+	}{
+		{
+			name:   "video and audio",
+			inputs: []fixture{{start: base, frames: 5, audio: true}},
+			want: []trackInfo{
+				{"vide", 90000, 5 * testFrameDur, 5},
+				{"soun", 48000, 5 * aacSamplesPerFrame, 5},
+			},
+		},
+		{
+			name:   "continuous inputs",
+			inputs: []fixture{{start: base, frames: 4}, {start: base + 4*testFrameDur, frames: 4}},
+			want:   []trackInfo{{"vide", 90000, 8 * testFrameDur, 8}},
+		},
+		{
+			name:   "timestamp wrap",
+			inputs: []fixture{{start: tsTimestampWrap - 2*testFrameDur, frames: 5}},
+			want:   []trackInfo{{"vide", 90000, 5 * testFrameDur, 5}},
+		},
+		{
+			name:            "discontinuity",
+			inputs:          []fixture{{start: base, frames: 5, audio: true}, {start: 0, frames: 5, audio: true}},
+			discontinuities: []Discontinuity{{Input: 1}},
+			want: []trackInfo{
+				{"vide", 90000, 10 * testFrameDur, 10},
+				{"soun", 48000, 10 * aacSamplesPerFrame, 10},
+			},
+		},
+		{
+			name:            "discontinuity with gap",
+			inputs:          []fixture{{start: base, frames: 5, audio: true}, {start: 0, frames: 5, audio: true}},
+			discontinuities: []Discontinuity{{Input: 1, Gap: 2 * time.Second}},
+			want: []trackInfo{
+				{"vide", 90000, 10*testFrameDur + 2*90000, 10},
+				{"soun", 48000, 10*aacSamplesPerFrame + 2*48000, 10},
+			},
+		},
+		{
+			name:            "sps change",
+			inputs:          []fixture{{start: base, frames: 3}, {start: 0, frames: 3, width: 640}},
+			discontinuities: []Discontinuity{{Input: 1}},
+			wantErr:         ErrUnsupportedCodec,
+		},
+		{
+			name:    "unsupported codec",
+			inputs:  []fixture{{start: base, frames: 3, codec: 0x02}},
+			wantErr: ErrUnsupportedCodec,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var inputs []string
+			for i, f := range tt.inputs {
+				path := filepath.Join(dir, "segment_"+string(rune('0'+i))+".ts")
+				f.write(t, path)
+				inputs = append(inputs, path)
+			}
+			output := filepath.Join(dir, "out.mp4")
+
+			err := TSToMP4(context.Background(), inputs, tt.discontinuities, output, dir)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TSToMP4: %v", err)
+			}
+
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order, _ := childBoxes(t, data); !slices.Equal(order, []string{"ftyp", "moov", "mdat"}) {
+				t.Errorf("box 顺序 = %v, 期望 [ftyp moov mdat]", order)
+			}
+
+			got := readTracks(t, data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("轨道 = %+v, 期望 %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("轨道 %d = %+v, 期望 %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTSToMP4Empty(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "empty.ts")
+	w := &tsWriter{}
+	w.writeTables([]elementaryStream{{pid: testVideoPID, streamType: streamTypeH264}})
+	if err := os.WriteFile(path, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TSToMP4(context.Background(), []string{path}, nil, filepath.Join(dir, "out.mp4"), dir); err == nil {
+		t.Error("没有媒体数据时期望返回错误")
+	}
+}
+
+func TestSplitPackets(t *testing.T) {
+	packet := func(cc byte) []byte {
+		pkt := make([]byte, PacketSize)
+		pkt[0], pkt[3] = SyncByte, 0x10|cc
+		return pkt
+	}
+	packets := bytes.Join([][]byte{packet(0), packet(1), packet(2)}, nil)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantPackets int
+		wantSkipped int
+	}{
+		{"aligned", packets, 3, 0},
+		{"leading garbage", append([]byte{0x89, 'P', 'N', 'G', SyncByte}, packets...), 3, 5},
+		{"trailing partial packet", append(append([]byte{}, packets...), SyncByte, 1, 2), 3, 3},
+		{"not ts", bytes.Repeat([]byte{1}, 400), 0, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped := SplitPackets(tt.data)
+			if len(got) != tt.wantPackets || skipped != tt.wantSkipped {
+				t.Errorf("得到 %d 个包，丢弃 %d 字节, 期望 %d 个包，丢弃 %d 字节", len(got), skipped, tt.wantPackets, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestAudioDTS(t *testing.T) {
+	const start = 90000
+	a := &audioState{track: &mp4Track{timescale: 48000, startPTS: start}}
+	write := func(pts int64, frame int) int64 {
+		dts := a.dts(pts, frame)
+		a.track.samples = append(a.track.samples, mp4Sample{dts: dts})
+		return dts
+	}
+
+	steps := []struct {
+		name  string
+		pts   int64
+		frame int
+		reset time.Duration // 大于 0 时先标记不连续点
+		want  int64
+	}{
+		{"first frame", start, 0, 0, 0},
+		{"second frame in pes", start, 1, 0, 1024},
+		{"third frame in pes", start, 2, 0, 2048},
+		{"frame carried over pes", -1, 0, 0, 3072},
+		// 下一个 PES 的 PTS 比按帧数推算的晚 90 (48 个采样)，不足一帧时跟随 PTS
+		{"small drift follows pts", start + 4*testAudioFrameDur + 90, 0, 0, 4*1024 + 48},
+		{"frame after drift", start + 4*testAudioFrameDur + 90, 1, 0, 5*1024 + 48},
+		// PTS 跳变超过一帧时重新对齐到上一帧之后
+		{"timestamp jump", start + 100*90000, 0, 0, 6*1024 + 48},
+		{"after jump", start + 100*90000 + testAudioFrameDur, 0, 0, 7*1024 + 48},
+		{"discontinuity with gap", 0, 0, time.Second, 8*1024 + 48 + 48000},
+	}
+	for _, step := range steps {
+		if step.reset > 0 {
+			a.reset, a.gap = true, step.reset
+		}
+		if got := write(step.pts, step.frame); got != step.want {
+			t.Fatalf("%s: dts = %d, 期望 %d", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package remux
+
+import "bytes"
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+	NullPID    = 0x1FFF
+)
+
+// MPEG-TS PMT 中的流类型
+const (
+	streamTypeAAC  = 0x0F
+	streamTypeH264 = 0x1B
+	streamTypeH265 = 0x24
+)
+
+// SplitPackets 按 188 字节切分 TS 包，遇到同步字节错位时向后查找新的同步点，返回丢弃的字节数
+func SplitPackets(data []byte) ([][]byte, int) {
+	var packets [][]byte
+
+	// 起始位置同样需要确认，伪装头中可能恰好包含 0x47
+	pos := FindSync(data)
+	if pos < 0 {
+		return nil, len(data)
+	}
+	skipped := pos
+
+	for pos+PacketSize <= len(data) {
+		if data[pos] == SyncByte {
+			packets = append(packets, data[pos:pos+PacketSize])
+			pos += PacketSize
+			continue
+		}
+
+		next := FindSync(data[pos:])
+		if next < 0 {
+			skipped += len(data) - pos
+			return packets, skipped
+		}
+		skipped += next
+		pos += next
+	}
+
+	skipped += len(data) - pos
+	return packets, skipped
+}
+
+// FindSync 查找连续多个包都以同步字节开头的位置，避免误把负载中的 0x47 当作包头，找不到时返回 -1
+func FindSync(data []byte) int {
+	const confirmPackets = 3
+
+	for i := 0; i < len(data); i++ {
+		i0 := bytes.IndexByte(data[i:], SyncByte)
+		if i0 < 0 {
+			return -1
+		}
+		i += i0
+
+		ok := true
+		for n := 1; n < confirmPackets; n++ {
+			p := i + n*PacketSize
+			if p >= len(data) {
+				// 数据末尾不足以确认时，只要剩余部分能容纳一个完整的包就接受
+				ok = i+PacketSize <= len(data)
+				break
+			}
+			if data[p] != SyncByte {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// PacketPID 返回 TS 包的 PID
+func PacketPID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+// packetPayload 返回 TS 包的负载和 payload_unit_start_indicator，没有负载时返回 nil
+func packetPayload(pkt []byte) ([]byte, bool) {
+	pusi := pkt[1]&0x40 != 0
+	afc := (pkt[3] >> 4) & 0x03
+	if afc&0x01 == 0 {
+		return nil, pusi
+	}
+
+	offset := 4
+	if afc&0x02 != 0 {
+		offset += 1 + int(pkt[4])
+	}
+	if offset >= len(pkt) {
+		return nil, pusi
+	}
+	return pkt[offset:], pusi
+}
+
+// psiSection 跳过 pointer_field，返回 PSI 表的 section（不含 CRC）
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	sectionLength := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + sectionLength - 4
+	if end > len(section) || end < 8 {
+		return nil
+	}
+	return section[:end]
+}
+
+// parsePAT 返回第一个节目的 PMT PID
+func parsePAT(payload []byte) (uint16, bool) {
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x00 {
+		return 0, false
+	}
+
+	for p := 8; p+4 <= len(section); p += 4 {
+		programNumber := uint16(section[p])<<8 | uint16(section[p+1])
+		pid := uint16(section[p+2]&0x1F)<<8 | uint16(section[p+3])
+		if programNumber != 0 {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+type elementaryStream struct {
+	pid        uint16
+	streamType byte
+}
+
+// parsePMT 返回节目中的全部基本流
+func parsePMT(payload []byte) ([]elementaryStream, bool) {
+	section := psiSection(payload)
+	if section == nil || section[0] != 0x02 || len(section) < 12 {
+		return nil, false
+	}
+
+	programInfoLength := int(section[10]&0x0F)<<8 | int(section[11])
+	var streams []elementaryStream
+	for p := 12 + programInfoLength; p+5 <= len(section); {
+		streamType := section[p]
+		pid := uint16(section[p+1]&0x1F)<<8 | uint16(section[p+2])
+		esInfoLength := int(section[p+3]&0x0F)<<8 | int(section[p+4])
+		streams = append(streams, elementaryStream{pid: pid, streamType: streamType})
+		p += 5 + esInfoLength
+	}
+	return streams, true
+}
+
+// pesPacket 是重组后的 PES 包，时间戳单位为 90kHz，未携带时为 -1
+type pesPacket struct {
+	pts  int64
+	dts  int64
+	data []byte
+}
+
+func parsePES(buf []byte) (*pesPacket, bool) {
+	if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return nil, false
+	}
+
+	flags := buf[7]
+	headerLength := int(buf[8])
+	if 9+headerLength > len(buf) {
+		return nil, false
+	}
+
+	pes := &pesPacket{pts: -1, dts: -1, data: buf[9+headerLength:]}
+	if flags&0x80 != 0 && headerLength >= 5 {
+		pes.pts = parseTimestamp(buf[9:14])
+		pes.dts = pes.pts
+	}
+	if flags&0x40 != 0 && headerLength >= 10 {
+		pes.dts = parseTimestamp(buf[14:19])
+	}
+	return pes, true
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
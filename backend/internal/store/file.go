@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"videoDownload/internal/types"
+)
+
+// compactMinRecords 日志记录数超过该值且超过任务数的 4 倍时重写日志
+const compactMinRecords = 1000
+
+// logRecord 是任务日志中的一行
+type logRecord struct {
+	Op      string          `json:"op"` // "put" 或 "delete"
+	ID      string          `json:"id"`
+	Task    json.RawMessage `json:"task,omitempty"`
+	Request json.RawMessage `json:"request,omitempty"` // 任务的原始请求，含请求头、Cookie 等凭据
+}
+
+// storeFileMode 是任务日志的权限，日志中保存了请求的凭据，只允许服务自身读写
+const storeFileMode = 0600
+
+// FileStore 把任务以追加写的 JSON 日志保存在单个文件中，打开时重放日志得到最新状态，
+// 并在日志过长时重写为只包含当前任务的快照
+type FileStore struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	tasks    map[string][]byte
+	requests map[string][]byte
+	records  int
+}
+
+// OpenFileStore 打开或创建 path 处的任务日志，无法解析的行（例如进程退出时写了一半的最后一行）会被忽略
+func OpenFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建任务存储目录失败: %v", err)
+	}
+
+	s := &FileStore{path: path, tasks: make(map[string][]byte), requests: make(map[string][]byte)}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取任务日志失败: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec logRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.ID == "" {
+			continue
+		}
+		switch rec.Op {
+		case "put":
+			s.tasks[rec.ID] = rec.Task
+			s.requests[rec.ID] = rec.Request
+		case "delete":
+			delete(s.tasks, rec.ID)
+			delete(s.requests, rec.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取任务日志失败: %v", err)
+	}
+	return nil
+}
+
+// compact 把当前任务写入临时文件后替换原日志，再以追加模式重新打开
+func (s *FileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, storeFileMode)
+	if err != nil {
+		return fmt.Errorf("重写任务日志失败: %v", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for id, task := range s.tasks {
+		line, err := json.Marshal(logRecord{Op: "put", ID: id, Task: task, Request: s.requests[id]})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("重写任务日志失败: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("重写任务日志失败: %v", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("重写任务日志失败: %v", err)
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, storeFileMode)
+	if err != nil {
+		return fmt.Errorf("打开任务日志失败: %v", err)
+	}
+	s.records = len(s.tasks)
+	return nil
+}
+
+func (s *FileStore) append(rec logRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("写入任务日志失败: %v", err)
+	}
+
+	s.records++
+	if s.records > compactMinRecords && s.records > 4*len(s.tasks) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) Save(task *types.DownloadTask) error {
+	data, request, err := encodeTask(task)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks[task.ID] = data
+	s.requests[task.ID] = request
+	return s.append(logRecord{Op: "put", ID: task.ID, Task: data, Request: request})
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return nil
+	}
+	delete(s.tasks, id)
+	delete(s.requests, id)
+	return s.append(logRecord{Op: "delete", ID: id})
+}
+
+func (s *FileStore) Load() ([]*types.DownloadTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return decodeTasks(s.tasks, s.requests)
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"videoDownload/internal/types"
+)
+
+// MemoryStore 把任务保存在内存中，进程退出后丢失，适合测试
+type MemoryStore struct {
+	mu       sync.Mutex
+	tasks    map[string][]byte
+	requests map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tasks: make(map[string][]byte), requests: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Save(task *types.DownloadTask) error {
+	// 保存副本，调用方之后对任务的修改不影响已保存的状态
+	data, request, err := encodeTask(task)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.ID] = data
+	s.requests[task.ID] = request
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, id)
+	delete(s.requests, id)
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]*types.DownloadTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return decodeTasks(s.tasks, s.requests)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// encodeTask 分别编码任务和它的原始请求，没有原始请求时 request 为 nil
+func encodeTask(task *types.DownloadTask) (data, request []byte, err error) {
+	if data, err = json.Marshal(task); err != nil {
+		return nil, nil, err
+	}
+	if task.Request != nil {
+		if request, err = json.Marshal(task.Request); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, request, nil
+}
+
+func decodeTasks(records, requests map[string][]byte) ([]*types.DownloadTask, error) {
+	tasks := make([]*types.DownloadTask, 0, len(records))
+	for id, data := range records {
+		var task types.DownloadTask
+		if err := json.Unmarshal(data, &task); err != nil {
+			return nil, err
+		}
+		if request := requests[id]; request != nil {
+			task.Request = new(types.DownloadRequest)
+			if err := json.Unmarshal(request, task.Request); err != nil {
+				return nil, err
+			}
+		}
+		tasks = append(tasks, &task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt.Before(tasks[j].CreatedAt)
+	})
+	return tasks, nil
+}
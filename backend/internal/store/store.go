@@ -0,0 +1,15 @@
+// Package store 持久化下载任务，使任务记录在服务重启后仍然保留
+package store
+
+import "videoDownload/internal/types"
+
+// TaskStore 保存下载任务的最新状态。任务的原始请求不参与任务的 JSON 编码，由存储单独保存
+type TaskStore interface {
+	// Save 写入或覆盖一个任务及其原始请求
+	Save(task *types.DownloadTask) error
+	// Delete 删除一个任务，任务不存在时不报错
+	Delete(id string) error
+	// Load 返回全部任务，按创建时间排序
+	Load() ([]*types.DownloadTask, error)
+	Close() error
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"videoDownload/internal/types"
+)
+
+func testTask(id string, created time.Time) *types.DownloadTask {
+	return &types.DownloadTask{
+		ID:        id,
+		URL:       "https://cdn.example.com/" + id + ".m3u8",
+		Status:    "downloading",
+		CreatedAt: created,
+		Request:   &types.DownloadRequest{URL: "https://cdn.example.com/" + id + ".m3u8"},
+	}
+}
+
+func TestStores(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) (TaskStore, func() TaskStore)
+	}{
+		{"memory", func(t *testing.T) (TaskStore, func() TaskStore) {
+			s := NewMemoryStore()
+			return s, func() TaskStore { return s }
+		}},
+		{"file", func(t *testing.T) (TaskStore, func() TaskStore) {
+			path := filepath.Join(t.TempDir(), "tasks.jsonl")
+			s, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 关闭后重新打开，模拟服务重启
+			return s, func() TaskStore {
+				s.Close()
+				reopened, err := OpenFileStore(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { reopened.Close() })
+				return reopened
+			}
+		}},
+	}
+
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			s, reopen := st.open(t)
+			now := time.Now()
+			a, b, c := testTask("a", now), testTask("b", now.Add(time.Second)), testTask("c", now.Add(2*time.Second))
+			c.Request = nil
+
+			for _, task := range []*types.DownloadTask{b, a, c} {
+				if err := s.Save(task); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 保存的是副本，之后的修改需要再次 Save 才生效
+			a.Status = "completed"
+			b.Progress = 50
+			if err := s.Save(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(c.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("missing"); err != nil {
+				t.Fatalf("删除不存在的任务: %v", err)
+			}
+
+			tasks, err := reopen().Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) != 2 || tasks[0].ID != "a" || tasks[1].ID != "b" {
+				t.Fatalf("Load = %d 个任务, 期望按创建时间排列的 a、b", len(tasks))
+			}
+			if tasks[0].Status != "downloading" || tasks[1].Progress != 50 {
+				t.Errorf("任务状态 = %s/%d", tasks[0].Status, tasks[1].Progress)
+			}
+			if tasks[0].Request == nil || tasks[0].Request.URL != a.Request.URL {
+				t.Errorf("原始请求 = %+v, 期望 %+v", tasks[0].Request, a.Request)
+			}
+		})
+	}
+}
+
+func TestFileStoreLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.jsonl")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := testTask("a", time.Now())
+	task.Request.URL = "https://cdn.example.com/a.m3u8?token=secret"
+	if err := s.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != storeFileMode {
+		t.Errorf("日志权限 = %o, 期望 %o", mode, storeFileMode)
+	}
+
+	// 进程退出时写了一半的最后一行
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"op":"put","id":"b","task":{"id":`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("重新打开: %v", err)
+	}
+	defer s.Close()
+	tasks, err := s.Load()
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("Load = %d 个任务, %v", len(tasks), err)
+	}
+	if tasks[0].Request == nil || tasks[0].Request.URL != task.Request.URL {
+		t.Errorf("原始请求 = %+v", tasks[0].Request)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !bytes.Contains(data, []byte(`"request":{`)) {
+		t.Error("原始请求应单独记录在日志的 request 字段")
+	}
+}
+
+func TestEncodeTaskOmitsRequest(t *testing.T) {
+	task := testTask("a", time.Now())
+	task.Request.URL = "https://cdn.example.com/a.m3u8?token=secret"
+
+	data, request, err := encodeTask(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("token=secret")) {
+		t.Error("任务的 JSON 不应包含原始请求")
+	}
+	if !bytes.Contains(request, []byte("token=secret")) {
+		t.Error("原始请求应单独编码")
+	}
+}